@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxAssetSize is the largest file that can be uploaded.
+	maxAssetSize = 10 << 20
+	// assetGracePeriod is how long an uploaded asset is kept without any
+	// shape showing it, so the uploader has time to place the image.
+	assetGracePeriod = time.Hour
+	// assetCollectInterval is how often unused assets are collected.
+	assetCollectInterval = 10 * time.Minute
+)
+
+// assetTypes are the content types accepted for upload. They are all formats
+// the standard library can decode, so their size is known on upload.
+var assetTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+var assetStorage lib.AssetStorage
+
+// newAssetStorage stores assets in ASSET_DIR, or ./uploads by default.
+func newAssetStorage() (lib.AssetStorage, error) {
+	dir := os.Getenv("ASSET_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	return lib.NewLocalStorage(dir)
+}
+
+// handleAssets serves /room/assets. A POST with a multipart "file" field
+// uploads an image to the room given by roomID; a GET with roomID and assetID
+// downloads one. Both are limited to members of the room and to users who
+// joined it with a share link, whose token is passed as shareToken; uploads
+// need an editor link.
+func handleAssets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err == nil && !exists {
+		if token := r.URL.Query().Get("shareToken"); token != "" {
+			var role lib.ShareRole
+			role, err = lib.ShareLinkRepositoryInstance.CheckShareLink(roomID, user.ID, token)
+			exists = err == nil && (role == lib.ShareRoleEditor || r.Method == "GET")
+		}
+	}
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "POST" {
+		uploadAsset(w, r, user, roomID)
+	} else {
+		downloadAsset(w, r, roomID)
+	}
+}
+
+func uploadAsset(w http.ResponseWriter, r *http.Request, user *lib.User, roomID uuid.UUID) {
+	// Leave room for the multipart headers around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxAssetSize+64<<10)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "File is larger than 10 MiB", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "A file field is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAssetSize+1))
+	if err != nil {
+		http.Error(w, "Could not read file", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAssetSize {
+		http.Error(w, "File is larger than 10 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Trust the bytes, not the name or the header the client sent.
+	contentType := http.DetectContentType(data)
+	if !assetTypes[contentType] {
+		http.Error(w, "Only PNG, JPEG and GIF images can be uploaded", http.StatusUnsupportedMediaType)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "File is not a valid image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	asset := lib.Asset{
+		ID:          uuid.New(),
+		RoomID:      roomID,
+		UploaderID:  user.ID,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+	if err := assetStorage.Put(asset.ID.String(), bytes.NewReader(data)); err != nil {
+		log.Printf("Error storing asset for room %s: %v", roomID, err)
+		http.Error(w, "Could not store file", http.StatusInternalServerError)
+		return
+	}
+	if err := lib.AssetRepositoryInstance.CreateAsset(&asset); err != nil {
+		log.Printf("Error recording asset for room %s: %v", roomID, err)
+		assetStorage.Delete(asset.ID.String())
+		http.Error(w, "Could not store file", http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONHeader(w, asset, http.StatusCreated)
+}
+
+func downloadAsset(w http.ResponseWriter, r *http.Request, roomID uuid.UUID) {
+	assetID, err := uuid.Parse(r.URL.Query().Get("assetID"))
+	if err != nil {
+		http.Error(w, "Invalid assetID", http.StatusBadRequest)
+		return
+	}
+	asset, err := lib.AssetRepositoryInstance.GetAsset(roomID, assetID)
+	if err != nil {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+	file, err := assetStorage.Open(asset.ID.String())
+	if err != nil {
+		log.Printf("Error opening asset %s: %v", asset.ID, err)
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(asset.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Assets never change once uploaded, but only members may see them.
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	io.Copy(w, file)
+}
+
+// collectAssets periodically deletes assets that were uploaded but never
+// drawn, together with their files. Erased images stay, since undo and
+// history replay can bring them back.
+func collectAssets() {
+	ticker := time.NewTicker(assetCollectInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deleted, err := lib.AssetRepositoryInstance.DeleteUnusedAssets(time.Now().Add(-assetGracePeriod))
+		if err != nil {
+			log.Printf("Error collecting unused assets: %v", err)
+			continue
+		}
+		for _, asset := range deleted {
+			if err := assetStorage.Delete(asset.ID.String()); err != nil {
+				log.Printf("Error deleting file of asset %s: %v", asset.ID, err)
+			}
+		}
+		if len(deleted) > 0 {
+			log.Printf("Collected %d unused assets", len(deleted))
+		}
+	}
+}
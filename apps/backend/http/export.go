@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+// maxExportPadding bounds the padding an export may ask for.
+const maxExportPadding = 10000
+
+// loadExport reads the parameters shared by the export endpoints and loads
+// the shapes to export, in paint order. The query takes:
+//
+//	roomID      the room to export, required; the caller must be a member
+//	bbox        minX,minY,maxX,maxY to crop to, default all shapes
+//	padding     space around the exported area, default 0
+//	background  "#RRGGBB[AA]" background, default transparent
+//	shapeIDs    comma-separated IDs to export only those shapes
+//
+// Shapes on hidden layers are left out. On failure it writes the error and
+// returns false.
+func loadExport(w http.ResponseWriter, r *http.Request) (uuid.UUID, []lib.Shape, lib.ExportOptions, bool) {
+	var opts lib.ExportOptions
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return uuid.Nil, nil, opts, false
+	}
+	query := r.URL.Query()
+	roomID, err := uuid.Parse(query.Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return uuid.Nil, nil, opts, false
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return uuid.Nil, nil, opts, false
+	}
+
+	if bbox := query.Get("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		values := make([]float64, 0, 4)
+		for _, part := range parts {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(parts) != 4 || len(values) != 4 {
+			http.Error(w, "bbox must be minX,minY,maxX,maxY", http.StatusBadRequest)
+			return uuid.Nil, nil, opts, false
+		}
+		bounds := lib.Bounds{MinX: values[0], MinY: values[1], MaxX: values[2], MaxY: values[3]}
+		if !bounds.Valid() {
+			http.Error(w, "bbox must be minX,minY,maxX,maxY", http.StatusBadRequest)
+			return uuid.Nil, nil, opts, false
+		}
+		opts.Bounds = &bounds
+	}
+	if padding := query.Get("padding"); padding != "" {
+		opts.Padding, err = strconv.ParseFloat(padding, 64)
+		if err != nil || opts.Padding < 0 || opts.Padding > maxExportPadding {
+			http.Error(w, "padding must be a number between 0 and 10000", http.StatusBadRequest)
+			return uuid.Nil, nil, opts, false
+		}
+	}
+	if background := query.Get("background"); background != "" {
+		if _, err := lib.ParseColor(background); err != nil {
+			http.Error(w, "background must be a #RRGGBB or #RRGGBBAA color", http.StatusBadRequest)
+			return uuid.Nil, nil, opts, false
+		}
+		opts.Background = background
+	}
+	var wanted map[uuid.UUID]bool
+	if ids := query.Get("shapeIDs"); ids != "" {
+		wanted = make(map[uuid.UUID]bool)
+		for _, idStr := range strings.Split(ids, ",") {
+			id, err := uuid.Parse(strings.TrimSpace(idStr))
+			if err != nil {
+				http.Error(w, "shapeIDs must be comma-separated shape IDs", http.StatusBadRequest)
+				return uuid.Nil, nil, opts, false
+			}
+			wanted[id] = true
+		}
+	}
+
+	shapes, err := lib.ShapeRepositoryInstance.GetShapesByRoomID(roomID)
+	if err != nil {
+		log.Printf("Error loading shapes to export room %s: %v", roomID, err)
+		http.Error(w, "Could not load shapes", http.StatusInternalServerError)
+		return uuid.Nil, nil, opts, false
+	}
+	layers, err := lib.LayerRepositoryInstance.GetLayersByRoomID(roomID)
+	if err != nil {
+		log.Printf("Error loading layers to export room %s: %v", roomID, err)
+		http.Error(w, "Could not load shapes", http.StatusInternalServerError)
+		return uuid.Nil, nil, opts, false
+	}
+	hidden := make(map[uuid.UUID]bool)
+	for _, layer := range layers {
+		if !layer.Visible {
+			hidden[layer.ID] = true
+		}
+	}
+	selected := shapes[:0]
+	for _, shape := range shapes {
+		if shape.LayerID != nil && hidden[*shape.LayerID] {
+			continue
+		}
+		if wanted != nil && !wanted[shape.ID] {
+			continue
+		}
+		if opts.Bounds != nil && !opts.Bounds.Intersects(shape.Bounds()) {
+			continue
+		}
+		selected = append(selected, shape)
+	}
+
+	opts.LoadAsset = assetLoader(roomID)
+	return roomID, selected, opts, true
+}
+
+// assetLoader returns an ExportOptions.LoadAsset that reads the room's assets
+// from assetStorage.
+func assetLoader(roomID uuid.UUID) func(uuid.UUID) (string, []byte, error) {
+	return func(assetID uuid.UUID) (string, []byte, error) {
+		asset, err := lib.AssetRepositoryInstance.GetAsset(roomID, assetID)
+		if err != nil {
+			return "", nil, err
+		}
+		file, err := assetStorage.Open(asset.ID.String())
+		if err != nil {
+			return "", nil, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return asset.ContentType, data, err
+	}
+}
+
+// handleSVGExport serves GET /room/export/svg, see loadExport for the query.
+func handleSVGExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	roomID, shapes, opts, ok := loadExport(w, r)
+	if !ok {
+		return
+	}
+	svg, err := lib.RenderSVG(shapes, opts)
+	if err != nil {
+		log.Printf("Error exporting room %s to SVG: %v", roomID, err)
+		http.Error(w, "Could not export canvas", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(svg)
+}
+
+// maxThumbnailSize bounds the maxSize a PNG export may ask for.
+const maxThumbnailSize = 2048
+
+// handlePNGExport serves GET /room/export/png. Besides the loadExport query
+// it takes scale, the pixels per canvas unit (default 1), or maxSize, the
+// side of a square the image is shrunk to fit in, for thumbnails.
+func handlePNGExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	roomID, shapes, opts, ok := loadExport(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	scale := 1.0
+	if maxSize := query.Get("maxSize"); maxSize != "" {
+		size, err := strconv.Atoi(maxSize)
+		if err != nil || size < 1 || size > maxThumbnailSize {
+			http.Error(w, "maxSize must be a number between 1 and 2048", http.StatusBadRequest)
+			return
+		}
+		scale = lib.ThumbnailScale(shapes, opts, size)
+	} else if scaleStr := query.Get("scale"); scaleStr != "" {
+		var err error
+		scale, err = strconv.ParseFloat(scaleStr, 64)
+		if err != nil || !(scale >= lib.MinRasterScale && scale <= lib.MaxRasterScale) {
+			http.Error(w, fmt.Sprintf("scale must be a number between %v and %v", lib.MinRasterScale, lib.MaxRasterScale), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := lib.RenderPNG(shapes, opts, scale)
+	if errors.Is(err, lib.ErrRasterTooLarge) {
+		http.Error(w, "Requested image is too large, lower the scale or crop with bbox", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error exporting room %s to PNG: %v", roomID, err)
+		http.Error(w, "Could not export canvas", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxImportSize is the largest file that can be imported.
+	maxImportSize = 20 << 20
+	// maxImportShapes is the most shapes one import can add to a room.
+	maxImportShapes = 5000
+)
+
+// importResult reports what an import added to a room.
+type importResult struct {
+	Imported    int                      `json:"imported"`
+	ShapeIDs    []uuid.UUID              `json:"shapeIds"`
+	Sequence    int64                    `json:"sequence"`
+	Unsupported []lib.UnsupportedElement `json:"unsupported"`
+}
+
+// readImport checks that a POST comes from a member of the room given by
+// roomID and reads the multipart "file" field it uploads. On failure it
+// writes the error and returns false.
+func readImport(w http.ResponseWriter, r *http.Request) (*lib.User, uuid.UUID, []byte, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return nil, uuid.Nil, nil, false
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, uuid.Nil, nil, false
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return nil, uuid.Nil, nil, false
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, uuid.Nil, nil, false
+	}
+
+	// Leave room for the multipart headers around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+64<<10)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "File is larger than 20 MiB", http.StatusRequestEntityTooLarge)
+			return nil, uuid.Nil, nil, false
+		}
+		http.Error(w, "A file field is required", http.StatusBadRequest)
+		return nil, uuid.Nil, nil, false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxImportSize+1))
+	if err != nil {
+		http.Error(w, "Could not read file", http.StatusBadRequest)
+		return nil, uuid.Nil, nil, false
+	}
+	if len(data) > maxImportSize {
+		http.Error(w, "File is larger than 20 MiB", http.StatusRequestEntityTooLarge)
+		return nil, uuid.Nil, nil, false
+	}
+	return user, roomID, data, true
+}
+
+// importShapes adds shapes imported from a file in the given format on top of
+// the room's base layer in one batch, keeping their order, tells the users in
+// the room and reports the result.
+func importShapes(w http.ResponseWriter, user *lib.User, roomID uuid.UUID, format string, shapes []lib.Shape, unsupported []lib.UnsupportedElement) {
+	if len(shapes) > maxImportShapes {
+		http.Error(w, fmt.Sprintf("A file can add at most %d shapes", maxImportShapes), http.StatusBadRequest)
+		return
+	}
+	result := importResult{
+		Imported:    len(shapes),
+		ShapeIDs:    make([]uuid.UUID, 0, len(shapes)),
+		Unsupported: unsupported,
+	}
+	if result.Unsupported == nil {
+		result.Unsupported = []lib.UnsupportedElement{}
+	}
+	if len(shapes) > 0 {
+		operations := make([]lib.ShapeOperation, len(shapes))
+		for i := range shapes {
+			operations[i] = lib.ShapeOperation{Op: lib.ShapeOpCreate, Shape: &shapes[i]}
+			result.ShapeIDs = append(result.ShapeIDs, shapes[i].ID)
+		}
+		var err error
+		if _, result.Sequence, err = lib.ShapeRepositoryInstance.ApplyBatch(roomID, user.ID, operations); err != nil {
+			log.Printf("Error importing %s shapes into room %s: %v", format, roomID, err)
+			http.Error(w, "Could not import shapes", http.StatusInternalServerError)
+			return
+		}
+		// The shapes are stored, so a lost event only delays them until
+		// clients reload the room.
+		if err := lib.NotifyRoom(lib.RoomEvent{
+			RoomID:   roomID,
+			Type:     lib.MessageTypeShapesImport,
+			UserID:   user.ID,
+			UserName: user.UserName,
+			Content:  map[string]interface{}{"sequence": result.Sequence, "format": format},
+		}); err != nil {
+			log.Printf("Error announcing import into room %s: %v", roomID, err)
+		}
+	}
+	WriteJSONHeader(w, result, http.StatusCreated)
+}
+
+// writeExportFile sends an exported file as a download. The number of shapes
+// the format could not hold is reported in the X-Unsupported-Shapes header.
+func writeExportFile(w http.ResponseWriter, contentType, filename string, data []byte, unsupported []lib.UnsupportedElement) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Unsupported-Shapes", strconv.Itoa(len(unsupported)))
+	w.Write(data)
+}
+
+// handleExcalidrawExport serves GET /room/export/excalidraw, see loadExport
+// for the query.
+func handleExcalidrawExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	roomID, shapes, opts, ok := loadExport(w, r)
+	if !ok {
+		return
+	}
+	data, unsupported, err := lib.ExportExcalidraw(shapes, opts.Background)
+	if err != nil {
+		log.Printf("Error exporting room %s to Excalidraw: %v", roomID, err)
+		http.Error(w, "Could not export canvas", http.StatusInternalServerError)
+		return
+	}
+	writeExportFile(w, "application/json", roomID.String()+".excalidraw", data, unsupported)
+}
+
+// handleExcalidrawImport serves POST /room/import/excalidraw, which adds the
+// shapes of an uploaded .excalidraw file to the room given by roomID.
+func handleExcalidrawImport(w http.ResponseWriter, r *http.Request) {
+	user, roomID, data, ok := readImport(w, r)
+	if !ok {
+		return
+	}
+	shapes, unsupported, err := lib.ImportExcalidraw(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	importShapes(w, user, roomID, "excalidraw", shapes, unsupported)
+}
+
+// handleDrawioExport serves GET /room/export/drawio. Besides the loadExport
+// query it takes compressed=true to compress the page as draw.io does by
+// default.
+func handleDrawioExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	roomID, shapes, _, ok := loadExport(w, r)
+	if !ok {
+		return
+	}
+	compressed := false
+	if value := r.URL.Query().Get("compressed"); value != "" {
+		var err error
+		if compressed, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "compressed must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	data, unsupported, err := lib.ExportDrawio(shapes, compressed)
+	if err != nil {
+		log.Printf("Error exporting room %s to draw.io: %v", roomID, err)
+		http.Error(w, "Could not export canvas", http.StatusInternalServerError)
+		return
+	}
+	writeExportFile(w, "application/xml", roomID.String()+".drawio", data, unsupported)
+}
+
+// handleDrawioImport serves POST /room/import/drawio, which adds the shapes
+// of the first page of an uploaded .drawio file to the room given by roomID.
+func handleDrawioImport(w http.ResponseWriter, r *http.Request) {
+	user, roomID, data, ok := readImport(w, r)
+	if !ok {
+		return
+	}
+	shapes, unsupported, err := lib.ImportDrawio(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	importShapes(w, user, roomID, "drawio", shapes, unsupported)
+}
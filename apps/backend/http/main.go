@@ -26,6 +26,25 @@ func WriteJSONHeader(w http.ResponseWriter, v any, statusCode int) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// parseOptionalInt parses an optional integer query parameter, returning 0 when
+// it is absent.
+func parseOptionalInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseOptionalCursor parses an optional message ID cursor, returning 0 when it
+// is absent.
+func parseOptionalCursor(value string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+	cursor, err := strconv.ParseUint(value, 10, strconv.IntSize)
+	return uint(cursor), err
+}
+
 type key string
 
 const userIDKey key = "user"
@@ -69,6 +88,7 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 func main() {
+	lib.InitDB()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		WriteJSON(w, "Hello Ji")
@@ -180,6 +200,10 @@ func main() {
 	})
 
 	http.HandleFunc("/room", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			handleRoomDelete(w, r)
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "404 Not Found", http.StatusNotFound)
 			return
@@ -250,6 +274,12 @@ func main() {
 			return
 		}
 
+		user, ok := r.Context().Value(userIDKey).(*lib.User)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		roomName := r.URL.Query().Get("RoomName")
 		if roomName == "" {
 			http.Error(w, "RoomName parameter is required", http.StatusBadRequest)
@@ -266,7 +296,7 @@ func main() {
 			return
 		}
 
-		roomID, err := lib.ChatRepositoryInstance.GetRoomID(payload.RoomName)
+		roomID, err := lib.ChatRepositoryInstance.GetRoomID(payload.RoomName, user.ID)
 		if err != nil {
 			http.Error(w, "Room Doesnt Exist", http.StatusBadRequest)
 			return
@@ -324,7 +354,19 @@ func main() {
 			WriteJSONHeader(w, "Unauthorized to add user to room", http.StatusUnauthorized)
 			return
 		}
-		err = lib.ChatRepositoryInstance.AddUserToRoom(userID, uuid, string(lib.Member))
+		// Admins add members; only the creator appoints admins.
+		role := payload.Role
+		if role == "" {
+			role = lib.Member
+		}
+		if role == lib.Admin {
+			callerRole, err := lib.ChatRepositoryInstance.GetMemberRole(user.ID, uuid)
+			if err != nil || callerRole != lib.Creator {
+				WriteJSONHeader(w, "Only the creator of a room can add admins", http.StatusForbidden)
+				return
+			}
+		}
+		err = lib.ChatRepositoryInstance.AddUserToRoom(userID, uuid, string(role))
 
 		if err != nil {
 			http.Error(w, "Error Adding User To Room", http.StatusInternalServerError)
@@ -337,71 +379,91 @@ func main() {
 	http.HandleFunc("/room/chats", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "404 Not Found", http.StatusNotFound)
+			return
 		}
 
-		var roomId string = r.URL.Query().Get("roomID")
-		var limit string = r.URL.Query().Get("limit")
-		var offset string = r.URL.Query().Get("offset")
-		if roomId == "" || limit == "" || offset == "" {
+		query := r.URL.Query()
+		roomId := query.Get("roomID")
+		if roomId == "" {
 			http.Error(w, "Missing RoomId parameter", http.StatusBadRequest)
 			return
 		}
-
-		intlimit, err := strconv.Atoi(limit)
+		id, err := uuid.Parse(roomId)
 		if err != nil {
-			fmt.Println("Conversion error:", err)
-		} else {
-			fmt.Println("Converted int:", intlimit)
+			http.Error(w, "Invalid UUID format", http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseOptionalInt(query.Get("limit"))
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
 		}
-		intOffset, err := strconv.Atoi(offset)
+		before, err := parseOptionalCursor(query.Get("before"))
 		if err != nil {
-			fmt.Println("Conversion error:", err)
-		} else {
-			fmt.Println("Converted int:", intOffset)
+			http.Error(w, "before must be a message ID", http.StatusBadRequest)
+			return
 		}
-		id, err := uuid.Parse(roomId)
+		after, err := parseOptionalCursor(query.Get("after"))
 		if err != nil {
-			http.Error(w, "Invalid UUID format", http.StatusBadRequest)
+			http.Error(w, "after must be a message ID", http.StatusBadRequest)
 			return
 		}
+
 		user, ok := r.Context().Value(userIDKey).(*lib.User)
 		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, id)
-		if err != nil || !exists {
+		if err != nil {
+			log.Printf("Error checking membership of user %s in room %s: %v", user.ID, roomId, err)
+			http.Error(w, "Could not fetch chats", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-		var chats []lib.ReturnMessageFormat
-		chats, err = lib.ChatRepositoryInstance.GetRoomMessages(id, intlimit, intOffset)
-		fmt.Printf("Chats fetched for room %s is %v \n", roomId, chats)
+
+		page, err := lib.ChatRepositoryInstance.GetRoomMessagesPage(id, before, after, limit)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				WriteJSONHeader(w, "No Messages for this Room", http.StatusNoContent)
-			}
+			log.Printf("Error fetching chats for room %s: %v", roomId, err)
+			http.Error(w, "Could not fetch chats", http.StatusInternalServerError)
+			return
 		}
-		// if chats == nil && err != nil {
-		// 	WriteJSON(w, map[string]interface{}{
-		// 		"chats": append(chats, lib.ReturnMessageFormat{
-		// 			Type: "Joined",
-		// 			Content: lib.ContentInfo{
-		// 				Message: "Hello from server",
-		// 			},
-		// 			Timestamp: time.Now(),
-		// 			Sender: lib.SenderInfo{
-		// 				ID:   "1",
-		// 				Name: "Server",
-		// 			},
-		// 		}),
-		// 	})
-		// 	return
-		// }
 
-		WriteJSON(w, map[string]interface{}{
-			"chats": chats,
-		})
+		WriteJSON(w, page)
 	}))
+	var err error
+	if assetStorage, err = newAssetStorage(); err != nil {
+		log.Fatal("Failed to set up asset storage:", err)
+	}
+	go collectAssets()
+	http.HandleFunc("/room/assets", AuthMiddleware(handleAssets))
+	http.HandleFunc("/room/export/svg", AuthMiddleware(handleSVGExport))
+	http.HandleFunc("/room/export/png", AuthMiddleware(handlePNGExport))
+	http.HandleFunc("/room/export/excalidraw", AuthMiddleware(handleExcalidrawExport))
+	http.HandleFunc("/room/import/excalidraw", AuthMiddleware(handleExcalidrawImport))
+	http.HandleFunc("/room/export/drawio", AuthMiddleware(handleDrawioExport))
+	http.HandleFunc("/room/import/drawio", AuthMiddleware(handleDrawioImport))
+	http.HandleFunc("/room/versions", AuthMiddleware(handleVersions))
+	http.HandleFunc("/room/versions/preview", AuthMiddleware(handleVersionPreview))
+	http.HandleFunc("/room/settings", AuthMiddleware(handleRoomSettings))
+	http.HandleFunc("/room/transfer", AuthMiddleware(handleRoomTransfer))
+	http.HandleFunc("/room/members", AuthMiddleware(handleRoomMembers))
+	http.HandleFunc("/room/leave", AuthMiddleware(handleRoomLeave))
+	http.HandleFunc("/room/fork", AuthMiddleware(handleRoomFork))
+	http.HandleFunc("/room/links", AuthMiddleware(handleShareLinks))
+	http.HandleFunc("/room/read", AuthMiddleware(handleRoomRead))
+	http.HandleFunc("/room/requests", AuthMiddleware(handleJoinRequests))
+	http.HandleFunc("/room/requests/approve", AuthMiddleware(handleJoinRequestDecision(true)))
+	http.HandleFunc("/room/requests/deny", AuthMiddleware(handleJoinRequestDecision(false)))
+	http.HandleFunc("/rooms", AuthMiddleware(handleMyRooms))
+	http.HandleFunc("/rooms/discover", AuthMiddleware(handleRoomDiscovery))
+	http.HandleFunc("/templates", AuthMiddleware(handleTemplates))
+	http.HandleFunc("/templates/room", AuthMiddleware(handleTemplateRoom))
+
 	fmt.Println("Server Starting on port 8081")
 	http.ListenAndServe(":8081", nil)
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+// handleRoomMembers serves /room/members for the room given by roomID:
+//
+//	GET     lists the members with their roles
+//	PATCH   changes the role of the member given by userID, body
+//	        { "Role": "Admin" | "Member" }
+//	DELETE  removes the member given by userID from the room
+//
+// Every member can list the members. Only the creator changes roles. The
+// creator can remove anyone else, admins only plain members.
+func handleRoomMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PATCH" && r.Method != "DELETE" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	callerRole, err := lib.ChatRepositoryInstance.GetMemberRole(user.ID, roomID)
+	if errors.Is(err, lib.ErrNotRoomMember) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading role of user %s in room %s: %v", user.ID, roomID, err)
+		http.Error(w, "Could not manage members", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "GET" {
+		members, err := lib.ChatRepositoryInstance.GetRoomMemberships(roomID)
+		if err != nil {
+			log.Printf("Error listing members of room %s: %v", roomID, err)
+			http.Error(w, "Could not list members", http.StatusInternalServerError)
+			return
+		}
+		WriteJSON(w, map[string]interface{}{"members": members})
+		return
+	}
+
+	memberID, err := uuid.Parse(r.URL.Query().Get("userID"))
+	if err != nil {
+		http.Error(w, "Invalid userID", http.StatusBadRequest)
+		return
+	}
+	if memberID == user.ID {
+		http.Error(w, "Use /room/leave to leave a room", http.StatusBadRequest)
+		return
+	}
+	memberRole, err := lib.ChatRepositoryInstance.GetMemberRole(memberID, roomID)
+	if errors.Is(err, lib.ErrNotRoomMember) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading role of user %s in room %s: %v", memberID, roomID, err)
+		http.Error(w, "Could not manage members", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		changeMemberRole(w, r, user, roomID, callerRole, memberID, memberRole)
+	case "DELETE":
+		removeMember(w, user, roomID, callerRole, memberID, memberRole)
+	}
+}
+
+func changeMemberRole(w http.ResponseWriter, r *http.Request, user *lib.User, roomID uuid.UUID, callerRole lib.Role, memberID uuid.UUID, memberRole lib.Role) {
+	var payload lib.IncomingMemberRolePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid Input", http.StatusBadRequest)
+		return
+	}
+	if err := lib.ValidatePayload(payload); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if callerRole != lib.Creator {
+		http.Error(w, "Only the creator of a room can change roles", http.StatusForbidden)
+		return
+	}
+	if memberRole == lib.Creator {
+		http.Error(w, "Use /room/transfer to hand over a room", http.StatusBadRequest)
+		return
+	}
+
+	err := lib.ChatRepositoryInstance.SetMemberRole(memberID, roomID, payload.Role)
+	if errors.Is(err, lib.ErrNotRoomMember) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing role of user %s in room %s: %v", memberID, roomID, err)
+		http.Error(w, "Could not change role", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s made user %s %s of room %s", user.ID, memberID, payload.Role, roomID)
+	if err := lib.NotifyRoom(lib.RoomEvent{
+		RoomID:   roomID,
+		Type:     lib.MessageTypeMemberRole,
+		UserID:   user.ID,
+		UserName: user.UserName,
+		Content:  map[string]interface{}{"userId": memberID, "role": payload.Role},
+	}); err != nil {
+		log.Printf("Error notifying room %s of a role change: %v", roomID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeMember(w http.ResponseWriter, user *lib.User, roomID uuid.UUID, callerRole lib.Role, memberID uuid.UUID, memberRole lib.Role) {
+	allowed := callerRole == lib.Creator && memberRole != lib.Creator ||
+		callerRole == lib.Admin && memberRole != lib.Creator && memberRole != lib.Admin
+	if !allowed {
+		http.Error(w, "Only the creator can remove admins, and admins plain members", http.StatusForbidden)
+		return
+	}
+	if !removeFromRoom(w, user, roomID, memberID) {
+		return
+	}
+	log.Printf("User %s removed user %s from room %s", user.ID, memberID, roomID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRoomLeave serves POST /room/leave, which takes the caller out of the
+// room given by roomID. The creator has to hand the room over or delete it
+// instead.
+func handleRoomLeave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	role, err := lib.ChatRepositoryInstance.GetMemberRole(user.ID, roomID)
+	if errors.Is(err, lib.ErrNotRoomMember) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading role of user %s in room %s: %v", user.ID, roomID, err)
+		http.Error(w, "Could not leave room", http.StatusInternalServerError)
+		return
+	}
+	if role == lib.Creator {
+		http.Error(w, "The creator of a room must transfer or delete it to leave", http.StatusBadRequest)
+		return
+	}
+	if !removeFromRoom(w, user, roomID, user.ID) {
+		return
+	}
+	log.Printf("User %s left room %s", user.ID, roomID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFromRoom takes a member out of a room on behalf of user and has the
+// ws service disconnect them from it. If it fails, it writes the error
+// response and reports false.
+func removeFromRoom(w http.ResponseWriter, user *lib.User, roomID, memberID uuid.UUID) bool {
+	if err := lib.ChatRepositoryInstance.RemoveUserFromRoom(memberID, roomID); err != nil {
+		log.Printf("Error removing user %s from room %s: %v", memberID, roomID, err)
+		http.Error(w, "Could not remove member", http.StatusInternalServerError)
+		return false
+	}
+	if err := lib.NotifyRoom(lib.RoomEvent{
+		RoomID:   roomID,
+		Type:     lib.MessageTypeMemberRemove,
+		UserID:   user.ID,
+		UserName: user.UserName,
+		Content:  map[string]interface{}{"userId": memberID},
+	}); err != nil {
+		log.Printf("Error notifying room %s of a removed member: %v", roomID, err)
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+// presenceClient asks the ws service who is online; it must answer quickly
+// or room listings go without presence.
+var presenceClient = &http.Client{Timeout: 2 * time.Second}
+
+// wsServiceURL is where the ws service is reached, from WS_SERVICE_URL or
+// http://localhost:8082 by default.
+func wsServiceURL() string {
+	if url := os.Getenv("WS_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8082"
+}
+
+// fetchPresence returns who is online in the rooms of the user making r, by
+// room ID, forwarding their token cookie to the ws service.
+func fetchPresence(r *http.Request) (map[uuid.UUID][]lib.OnlineUser, error) {
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(r.Context(), "GET", wsServiceURL()+"/presence", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	response, err := presenceClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ws service answered %s", response.Status)
+	}
+	var presence map[uuid.UUID][]lib.OnlineUser
+	if err := json.NewDecoder(response.Body).Decode(&presence); err != nil {
+		return nil, err
+	}
+	return presence, nil
+}
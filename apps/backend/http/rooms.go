@@ -0,0 +1,797 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// handleRoomFork serves POST /room/fork, which copies the canvas of the room
+// given by roomID into a new room owned by the caller. The body, a
+// lib.IncomingRoomForkPayload, may rename the fork, change its description and
+// privacy, and ask for the members of the room to be copied with their roles.
+// Shapes and layers get fresh IDs, images get copies of their files, and chat
+// history is left behind. Only members of the room can fork it, and only its
+// creator and admins can copy its members or make the fork of a private room
+// public.
+func handleRoomFork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sourceID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, sourceID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var payload lib.IncomingRoomForkPayload
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid Input", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := lib.ValidatePayload(payload); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := lib.ChatRepositoryInstance.GetRoom(sourceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", sourceID, err)
+		http.Error(w, "Could not fork room", http.StatusInternalServerError)
+		return
+	}
+	room := &lib.Room{
+		ID:          uuid.New(),
+		Name:        forkName(source.Name),
+		Description: source.Description,
+		IsPrivate:   source.IsPrivate,
+		CreatorID:   user.ID,
+	}
+	if payload.Name != nil {
+		room.Name = *payload.Name
+	}
+	if payload.Description != nil {
+		room.Description = *payload.Description
+	}
+	if payload.IsPrivate != nil {
+		room.IsPrivate = *payload.IsPrivate
+	}
+	if payload.CopyMembers || (source.IsPrivate && !room.IsPrivate) {
+		admin, err := isRoomAdmin(user.ID, sourceID)
+		if err != nil {
+			log.Printf("Error checking admins of room %s: %v", sourceID, err)
+			http.Error(w, "Could not fork room", http.StatusInternalServerError)
+			return
+		}
+		if !admin && payload.CopyMembers {
+			http.Error(w, "Only room admins can copy the members of a room", http.StatusForbidden)
+			return
+		}
+		if !admin {
+			room.IsPrivate = source.IsPrivate
+		}
+	}
+
+	assets, err := copyRoomAssets(sourceID)
+	if err != nil {
+		log.Printf("Error copying assets of room %s: %v", sourceID, err)
+		http.Error(w, "Could not fork room", http.StatusInternalServerError)
+		return
+	}
+	shapeCount, err := lib.ChatRepositoryInstance.ForkRoom(sourceID, room, payload.CopyMembers, assets)
+	if err != nil {
+		log.Printf("Error forking room %s: %v", sourceID, err)
+		for _, asset := range assets {
+			assetStorage.Delete(asset.ID.String())
+		}
+		http.Error(w, "Could not fork room", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s forked room %s into %s with %d shapes", user.ID, sourceID, room.ID, shapeCount)
+
+	WriteJSONHeader(w, map[string]interface{}{
+		"roomID":     room.ID,
+		"name":       room.Name,
+		"shapeCount": shapeCount,
+	}, http.StatusCreated)
+}
+
+// forkName names a fork after its room, within the room name limit.
+func forkName(name string) string {
+	runes := []rune("Copy of " + name)
+	if len(runes) > 30 {
+		runes = runes[:30]
+	}
+	return string(runes)
+}
+
+// copyRoomAssets stores a copy of the file of every asset shown on the canvas
+// of a room and returns the rows of the copies, keyed by the original asset.
+func copyRoomAssets(roomID uuid.UUID) (map[uuid.UUID]lib.Asset, error) {
+	assets, err := lib.AssetRepositoryInstance.GetShapeAssets(roomID)
+	if err != nil {
+		return nil, err
+	}
+	copies := make(map[uuid.UUID]lib.Asset, len(assets))
+	for _, asset := range assets {
+		original := asset.ID
+		asset.ID, asset.CreatedAt = uuid.New(), time.Time{}
+		if err := copyAssetFile(original, asset.ID); err != nil {
+			for _, copied := range copies {
+				assetStorage.Delete(copied.ID.String())
+			}
+			return nil, err
+		}
+		copies[original] = asset
+	}
+	return copies, nil
+}
+
+func copyAssetFile(from, to uuid.UUID) error {
+	file, err := assetStorage.Open(from.String())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return assetStorage.Put(to.String(), file)
+}
+
+// isRoomAdmin reports whether a user is the creator or an admin of a room.
+func isRoomAdmin(userID, roomID uuid.UUID) (bool, error) {
+	admins, err := lib.ChatRepositoryInstance.GetAdminRooms(roomID)
+	if err != nil {
+		return false, err
+	}
+	for _, admin := range admins {
+		if admin.ID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handleShareLinks serves /room/links, the share links of the room given by
+// roomID:
+//
+//	GET     lists the links, newest first
+//	POST    creates a link, body { "role": "viewer" | "editor",
+//	        "expiresAt": "<RFC 3339 time>", "maxUses": n }, where expiresAt
+//	        and maxUses are optional. The response holds the link and its
+//	        token, which is not shown again.
+//	DELETE  revokes the link given by linkID; users in the room through
+//	        it are sent out of it
+//
+// A link token lets whoever holds it join the room over the WebSocket, see
+// the join message. All requests are limited to the creator and admins of
+// the room.
+func handleShareLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	admin, err := isRoomAdmin(user.ID, roomID)
+	if err != nil || !admin {
+		http.Error(w, "Only the creator or an admin of a room can manage its links", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		links, err := lib.ShareLinkRepositoryInstance.GetShareLinks(roomID)
+		if err != nil {
+			log.Printf("Error listing share links of room %s: %v", roomID, err)
+			http.Error(w, "Could not list links", http.StatusInternalServerError)
+			return
+		}
+		WriteJSON(w, map[string]interface{}{"links": links})
+	case "POST":
+		var payload struct {
+			Role      lib.ShareRole `json:"role"`
+			ExpiresAt *time.Time    `json:"expiresAt"`
+			MaxUses   *int          `json:"maxUses"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid Input", http.StatusBadRequest)
+			return
+		}
+		if payload.Role != lib.ShareRoleViewer && payload.Role != lib.ShareRoleEditor {
+			http.Error(w, "role must be viewer or editor", http.StatusBadRequest)
+			return
+		}
+		if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+			http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+			return
+		}
+		if payload.MaxUses != nil && *payload.MaxUses < 1 {
+			http.Error(w, "maxUses must be at least 1", http.StatusBadRequest)
+			return
+		}
+		link, token, err := lib.ShareLinkRepositoryInstance.CreateShareLink(roomID, user.ID, payload.Role, payload.ExpiresAt, payload.MaxUses)
+		if err != nil {
+			log.Printf("Error creating share link for room %s: %v", roomID, err)
+			http.Error(w, "Could not create link", http.StatusInternalServerError)
+			return
+		}
+		WriteJSONHeader(w, map[string]interface{}{"link": link, "token": token}, http.StatusCreated)
+	case "DELETE":
+		linkID, err := uuid.Parse(r.URL.Query().Get("linkID"))
+		if err != nil {
+			http.Error(w, "Invalid linkID", http.StatusBadRequest)
+			return
+		}
+		err = lib.ShareLinkRepositoryInstance.RevokeShareLink(roomID, linkID)
+		if errors.Is(err, lib.ErrShareLinkNotFound) {
+			http.Error(w, "Link not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error revoking share link %s: %v", linkID, err)
+			http.Error(w, "Could not revoke link", http.StatusInternalServerError)
+			return
+		}
+		// Users still in the room through the link are sent out of it.
+		if err := lib.NotifyRoom(lib.RoomEvent{
+			RoomID:   roomID,
+			Type:     lib.MessageTypeShareRevoke,
+			UserID:   user.ID,
+			UserName: user.UserName,
+			Content:  map[string]interface{}{"linkId": linkID},
+		}); err != nil {
+			log.Printf("Error notifying room %s of revoked link %s: %v", roomID, linkID, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleJoinRequests serves /room/requests for the room given by roomID:
+//
+//	POST  asks to join the room, body { "message": "..." } (optional). A
+//	      public room is joined right away; for a private room a request is
+//	      left for its admins, who are notified over the WebSocket.
+//	GET   lists the pending requests, for the creator and admins only
+//
+// Requests are approved or denied through /room/requests/approve and
+// /room/requests/deny.
+func handleJoinRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		admin, err := isRoomAdmin(user.ID, roomID)
+		if err != nil || !admin {
+			http.Error(w, "Only the creator or an admin of a room can see its requests", http.StatusForbidden)
+			return
+		}
+		requests, err := lib.JoinRequestRepositoryInstance.GetPendingJoinRequests(roomID)
+		if err != nil {
+			log.Printf("Error listing join requests of room %s: %v", roomID, err)
+			http.Error(w, "Could not list requests", http.StatusInternalServerError)
+			return
+		}
+		pending := make([]map[string]interface{}, len(requests))
+		for i, request := range requests {
+			pending[i] = joinRequestContent(&request, request.User.UserName)
+		}
+		WriteJSON(w, map[string]interface{}{"requests": pending})
+		return
+	}
+
+	var payload struct {
+		Message string `json:"message"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid Input", http.StatusBadRequest)
+			return
+		}
+	}
+	message := strings.TrimSpace(payload.Message)
+	if utf8.RuneCountInString(message) > lib.MaxJoinRequestMessageLength {
+		http.Error(w, "message must be at most "+strconv.Itoa(lib.MaxJoinRequestMessageLength)+" characters", http.StatusBadRequest)
+		return
+	}
+	room, err := lib.ChatRepositoryInstance.GetRoom(roomID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		http.Error(w, "Could not request access", http.StatusInternalServerError)
+		return
+	}
+	member, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil {
+		log.Printf("Error checking membership of room %s: %v", roomID, err)
+		http.Error(w, "Could not request access", http.StatusInternalServerError)
+		return
+	}
+	if member {
+		http.Error(w, "Already a member of this room", http.StatusConflict)
+		return
+	}
+
+	if !room.IsPrivate {
+		if err := lib.ChatRepositoryInstance.AddUserToRoom(user.ID, roomID, string(lib.Member)); err != nil {
+			log.Printf("Error adding user %s to room %s: %v", user.ID, roomID, err)
+			http.Error(w, "Could not join room", http.StatusInternalServerError)
+			return
+		}
+		WriteJSONHeader(w, map[string]interface{}{"status": "joined"}, http.StatusCreated)
+		return
+	}
+
+	request, err := lib.JoinRequestRepositoryInstance.CreateJoinRequest(roomID, user.ID, message)
+	if errors.Is(err, lib.ErrJoinRequestPending) {
+		http.Error(w, "A request to join this room is already pending", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating join request for room %s: %v", roomID, err)
+		http.Error(w, "Could not request access", http.StatusInternalServerError)
+		return
+	}
+	err = lib.NotifyRoom(lib.RoomEvent{
+		RoomID:     roomID,
+		Type:       lib.MessageTypeJoinRequest,
+		UserID:     user.ID,
+		UserName:   user.UserName,
+		Content:    joinRequestContent(request, user.UserName),
+		AdminsOnly: true,
+	})
+	if err != nil {
+		// The request is listed for admins all the same.
+		log.Printf("Error notifying admins of room %s: %v", roomID, err)
+	}
+	WriteJSONHeader(w, map[string]interface{}{"status": string(request.Status), "request": request}, http.StatusAccepted)
+}
+
+// joinRequestContent is how a join request is shown to admins.
+func joinRequestContent(request *lib.JoinRequest, userName string) map[string]interface{} {
+	return map[string]interface{}{
+		"requestID": request.ID,
+		"userID":    request.UserID,
+		"userName":  userName,
+		"message":   request.Message,
+		"createdAt": request.CreatedAt,
+	}
+}
+
+// handleJoinRequestDecision serves POST /room/requests/approve and
+// /room/requests/deny for the request given by roomID and requestID. Only the
+// creator and admins of the room can decide; approving a request makes its
+// user a member.
+func handleJoinRequestDecision(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "404 Not Found", http.StatusNotFound)
+			return
+		}
+		user, ok := r.Context().Value(userIDKey).(*lib.User)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		query := r.URL.Query()
+		roomID, err := uuid.Parse(query.Get("roomID"))
+		if err != nil {
+			http.Error(w, "Invalid roomID", http.StatusBadRequest)
+			return
+		}
+		requestID, err := uuid.Parse(query.Get("requestID"))
+		if err != nil {
+			http.Error(w, "Invalid requestID", http.StatusBadRequest)
+			return
+		}
+		admin, err := isRoomAdmin(user.ID, roomID)
+		if err != nil || !admin {
+			http.Error(w, "Only the creator or an admin of a room can decide on its requests", http.StatusForbidden)
+			return
+		}
+		request, err := lib.JoinRequestRepositoryInstance.DecideJoinRequest(roomID, requestID, user.ID, approve)
+		if errors.Is(err, lib.ErrJoinRequestNotFound) {
+			http.Error(w, "No pending request with this ID", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error deciding join request %s: %v", requestID, err)
+			http.Error(w, "Could not decide request", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %s %s join request %s for room %s", user.ID, request.Status, requestID, roomID)
+		WriteJSON(w, request)
+	}
+}
+
+const (
+	defaultRoomPageSize = 20
+	maxRoomPageSize     = 100
+)
+
+// handleRoomDiscovery serves GET /rooms/discover, which lists public rooms.
+// The query takes q to search names and descriptions, sort ("activity", the
+// default, or "members"), limit (default 20, at most 100) and cursor, the
+// nextCursor of the previous page. nextCursor is absent on the last page.
+func handleRoomDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	sort := lib.RoomSort(query.Get("sort"))
+	if sort == "" {
+		sort = lib.RoomSortActivity
+	}
+	if sort != lib.RoomSortActivity && sort != lib.RoomSortMembers {
+		http.Error(w, "sort must be activity or members", http.StatusBadRequest)
+		return
+	}
+	limit := defaultRoomPageSize
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxRoomPageSize {
+			http.Error(w, fmt.Sprintf("limit must be a number between 1 and %d", maxRoomPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	var cursor *lib.RoomCursor
+	if value := query.Get("cursor"); value != "" {
+		var err error
+		if cursor, err = decodeRoomCursor(value, sort); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rooms, next, err := lib.ChatRepositoryInstance.DiscoverRooms(strings.TrimSpace(query.Get("q")), sort, cursor, limit)
+	if err != nil {
+		log.Printf("Error discovering rooms: %v", err)
+		http.Error(w, "Could not list rooms", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{"rooms": rooms}
+	if next != nil {
+		response["nextCursor"] = encodeRoomCursor(next, sort)
+	}
+	WriteJSON(w, response)
+}
+
+// encodeRoomCursor makes an opaque cursor out of where a page of rooms ends.
+// The sort is part of it so a cursor cannot be reused with another order.
+func encodeRoomCursor(cursor *lib.RoomCursor, sort lib.RoomSort) string {
+	value := fmt.Sprintf("%s|%d|%s", sort, cursor.SortKey, cursor.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeRoomCursor(value string, sort lib.RoomSort) (*lib.RoomCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(decoded), "|")
+	if len(parts) != 3 || lib.RoomSort(parts[0]) != sort {
+		return nil, errors.New("cursor does not match the sort")
+	}
+	sortKey, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return &lib.RoomCursor{SortKey: sortKey, ID: id}, nil
+}
+
+// handleMyRooms serves GET /rooms, the rooms of the caller, most active first,
+// with their role, member count, last activity, unread chat count and who is
+// online. onlineUsers is null for every room if the ws service can't be
+// reached.
+func handleMyRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rooms, err := lib.ChatRepositoryInstance.GetUserRoomSummaries(user.ID)
+	if err != nil {
+		log.Printf("Error listing rooms of user %s: %v", user.ID, err)
+		http.Error(w, "Could not list rooms", http.StatusInternalServerError)
+		return
+	}
+	presence, err := fetchPresence(r)
+	if err != nil {
+		log.Printf("Error fetching presence for user %s: %v", user.ID, err)
+	} else {
+		for i := range rooms {
+			rooms[i].OnlineUsers = presence[rooms[i].ID]
+			if rooms[i].OnlineUsers == nil {
+				rooms[i].OnlineUsers = []lib.OnlineUser{}
+			}
+		}
+	}
+	WriteJSON(w, map[string]interface{}{"rooms": rooms})
+}
+
+// handleRoomRead serves POST /room/read, which marks the chat of the room
+// given by roomID as seen by the caller.
+func handleRoomRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := lib.ChatRepositoryInstance.MarkRoomRead(user.ID, roomID); err != nil {
+		log.Printf("Error marking room %s read for user %s: %v", roomID, user.ID, err)
+		http.Error(w, "Could not mark room read", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// roomSettingsContent is the content of the events telling the users of a
+// room that its settings changed.
+func roomSettingsContent(room *lib.Room) map[string]interface{} {
+	return map[string]interface{}{
+		"roomID":      room.ID,
+		"name":        room.Name,
+		"description": room.Description,
+		"isPrivate":   room.IsPrivate,
+		"creatorId":   room.CreatorID,
+	}
+}
+
+// handleRoomSettings serves PATCH /room/settings, which changes the name,
+// description or privacy of the room given by roomID. The body is a
+// lib.IncomingRoomSettingsPayload; fields left out are kept. Only the creator
+// or an admin of the room can change it.
+func handleRoomSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	var payload lib.IncomingRoomSettingsPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid Input", http.StatusBadRequest)
+		return
+	}
+	if err := lib.ValidatePayload(payload); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	admin, err := isRoomAdmin(user.ID, roomID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking admins of room %s: %v", roomID, err)
+		http.Error(w, "Could not update room", http.StatusInternalServerError)
+		return
+	}
+	if !admin {
+		http.Error(w, "Only the creator or an admin of a room can change it", http.StatusForbidden)
+		return
+	}
+
+	room, err := lib.ChatRepositoryInstance.UpdateRoomSettings(roomID, payload)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating room %s: %v", roomID, err)
+		http.Error(w, "Could not update room", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s updated the settings of room %s", user.ID, roomID)
+	if err := lib.NotifyRoom(lib.RoomEvent{
+		RoomID:   roomID,
+		Type:     lib.MessageTypeRoomUpdate,
+		UserID:   user.ID,
+		UserName: user.UserName,
+		Content:  roomSettingsContent(room),
+	}); err != nil {
+		log.Printf("Error notifying room %s of its new settings: %v", roomID, err)
+	}
+	WriteJSON(w, room)
+}
+
+// handleRoomDelete serves DELETE /room, which deletes the room given by
+// roomID with its canvas, chat, memberships and images. Users connected to it
+// are told and taken out of it. Only the creator of the room can delete it.
+func handleRoomDelete(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	room, ok := creatorRoom(w, r, user, "delete")
+	if !ok {
+		return
+	}
+
+	assets, err := lib.ChatRepositoryInstance.DeleteRoom(room.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting room %s: %v", room.ID, err)
+		http.Error(w, "Could not delete room", http.StatusInternalServerError)
+		return
+	}
+	for _, asset := range assets {
+		if err := assetStorage.Delete(asset.ID.String()); err != nil {
+			log.Printf("Error deleting file of asset %s: %v", asset.ID, err)
+		}
+	}
+	log.Printf("User %s deleted room %s with %d assets", user.ID, room.ID, len(assets))
+	if err := lib.NotifyRoom(lib.RoomEvent{
+		RoomID:   room.ID,
+		Type:     lib.MessageTypeRoomDelete,
+		UserID:   user.ID,
+		UserName: user.UserName,
+		Content:  map[string]interface{}{"roomID": room.ID},
+	}); err != nil {
+		log.Printf("Error notifying room %s of its deletion: %v", room.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRoomTransfer serves POST /room/transfer, which makes the member given
+// by the body { "userID": "..." } the creator of the room given by roomID.
+// The caller, who must be its creator, stays on as an admin.
+func handleRoomTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var payload struct {
+		UserID uuid.UUID `json:"userID"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.UserID == uuid.Nil {
+		http.Error(w, "Invalid Input", http.StatusBadRequest)
+		return
+	}
+	room, ok := creatorRoom(w, r, user, "transfer")
+	if !ok {
+		return
+	}
+
+	err := lib.ChatRepositoryInstance.TransferRoom(room.ID, payload.UserID)
+	if errors.Is(err, lib.ErrNotRoomMember) {
+		http.Error(w, "The new creator must be a member of the room", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error transferring room %s to user %s: %v", room.ID, payload.UserID, err)
+		http.Error(w, "Could not transfer room", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s transferred room %s to user %s", user.ID, room.ID, payload.UserID)
+	room.CreatorID = payload.UserID
+	if err := lib.NotifyRoom(lib.RoomEvent{
+		RoomID:   room.ID,
+		Type:     lib.MessageTypeRoomUpdate,
+		UserID:   user.ID,
+		UserName: user.UserName,
+		Content:  roomSettingsContent(room),
+	}); err != nil {
+		log.Printf("Error notifying room %s of its new creator: %v", room.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// creatorRoom loads the room given by roomID for an action only its creator
+// may take. If it can't, it writes the error response and reports false.
+func creatorRoom(w http.ResponseWriter, r *http.Request, user *lib.User, action string) (*lib.Room, bool) {
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return nil, false
+	}
+	room, err := lib.ChatRepositoryInstance.GetRoom(roomID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		http.Error(w, "Could not "+action+" room", http.StatusInternalServerError)
+		return nil, false
+	}
+	if room.CreatorID != user.ID {
+		http.Error(w, "Only the creator of a room can "+action+" it", http.StatusForbidden)
+		return nil, false
+	}
+	return room, true
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultTemplatePageSize = 20
+	maxTemplatePageSize     = 100
+)
+
+// handleTemplates serves /templates, the library of room templates:
+//
+//	GET     lists templates, newest first. The query takes q to search names
+//	        and descriptions, limit (default 20, at most 100) and offset.
+//	POST    publishes the canvas of a room as a template, body
+//	        { "roomID": "...", "name": "...", "description": "..." }
+//	DELETE  deletes the template given by templateID
+//
+// Every signed-in user can list and use templates. Only the creator or an
+// admin of a room can publish it, and only whoever published a template can
+// delete it.
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		listTemplates(w, r)
+	case "POST":
+		publishTemplate(w, r, user)
+	case "DELETE":
+		deleteTemplate(w, r, user)
+	}
+}
+
+func listTemplates(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultTemplatePageSize
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTemplatePageSize {
+			http.Error(w, fmt.Sprintf("limit must be a number between 1 and %d", maxTemplatePageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		var err error
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	templates, err := lib.TemplateRepositoryInstance.GetTemplates(strings.TrimSpace(query.Get("q")), limit, offset)
+	if err != nil {
+		log.Printf("Error listing templates: %v", err)
+		http.Error(w, "Could not list templates", http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"templates": templates})
+}
+
+func publishTemplate(w http.ResponseWriter, r *http.Request, user *lib.User) {
+	var payload struct {
+		RoomID      uuid.UUID `json:"roomID"`
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid Input", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(payload.Name)
+	if name == "" || utf8.RuneCountInString(name) > lib.MaxTemplateNameLength {
+		http.Error(w, "name must be between 1 and "+strconv.Itoa(lib.MaxTemplateNameLength)+" characters", http.StatusBadRequest)
+		return
+	}
+	description := strings.TrimSpace(payload.Description)
+	if utf8.RuneCountInString(description) > lib.MaxTemplateDescriptionLength {
+		http.Error(w, "description must be at most "+strconv.Itoa(lib.MaxTemplateDescriptionLength)+" characters", http.StatusBadRequest)
+		return
+	}
+	admin, err := isRoomAdmin(user.ID, payload.RoomID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !admin) {
+		http.Error(w, "Only the creator or an admin of a room can publish it", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking admins of room %s: %v", payload.RoomID, err)
+		http.Error(w, "Could not publish template", http.StatusInternalServerError)
+		return
+	}
+
+	assets, err := lib.AssetRepositoryInstance.GetShapeAssets(payload.RoomID)
+	if err != nil {
+		log.Printf("Error listing assets of room %s: %v", payload.RoomID, err)
+		http.Error(w, "Could not publish template", http.StatusInternalServerError)
+		return
+	}
+	copies := make(map[uuid.UUID]lib.TemplateAsset, len(assets))
+	for _, asset := range assets {
+		copied := lib.TemplateAsset{
+			ID:          uuid.New(),
+			ContentType: asset.ContentType,
+			Size:        asset.Size,
+			Width:       asset.Width,
+			Height:      asset.Height,
+		}
+		if err = copyAssetFile(asset.ID, copied.ID); err != nil {
+			break
+		}
+		copies[asset.ID] = copied
+	}
+	template := &lib.RoomTemplate{CreatorID: &user.ID, Name: name, Description: description}
+	if err == nil {
+		err = lib.TemplateRepositoryInstance.PublishTemplate(template, payload.RoomID, copies)
+	}
+	if err != nil {
+		log.Printf("Error publishing room %s as a template: %v", payload.RoomID, err)
+		for _, copied := range copies {
+			assetStorage.Delete(copied.ID.String())
+		}
+		http.Error(w, "Could not publish template", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s published room %s as template %s", user.ID, payload.RoomID, template.ID)
+	WriteJSONHeader(w, template, http.StatusCreated)
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request, user *lib.User) {
+	templateID, err := uuid.Parse(r.URL.Query().Get("templateID"))
+	if err != nil {
+		http.Error(w, "Invalid templateID", http.StatusBadRequest)
+		return
+	}
+	template, err := lib.TemplateRepositoryInstance.GetTemplate(templateID)
+	if errors.Is(err, lib.ErrTemplateNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading template %s: %v", templateID, err)
+		http.Error(w, "Could not delete template", http.StatusInternalServerError)
+		return
+	}
+	if template.CreatorID == nil || *template.CreatorID != user.ID {
+		http.Error(w, "Only whoever published a template can delete it", http.StatusForbidden)
+		return
+	}
+	assets, err := lib.TemplateRepositoryInstance.DeleteTemplate(templateID)
+	if err != nil && !errors.Is(err, lib.ErrTemplateNotFound) {
+		log.Printf("Error deleting template %s: %v", templateID, err)
+		http.Error(w, "Could not delete template", http.StatusInternalServerError)
+		return
+	}
+	for _, asset := range assets {
+		if err := assetStorage.Delete(asset.ID.String()); err != nil {
+			log.Printf("Error deleting file of template asset %s: %v", asset.ID, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTemplateRoom serves POST /templates/room, which creates a room owned
+// by the caller starting with a copy of the canvas of the template given by
+// templateID. The body is the same as for creating an empty room.
+func handleTemplateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	templateID, err := uuid.Parse(r.URL.Query().Get("templateID"))
+	if err != nil {
+		http.Error(w, "Invalid templateID", http.StatusBadRequest)
+		return
+	}
+	var payload lib.IncomingRoomPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid Input", http.StatusBadRequest)
+		return
+	}
+	if err := lib.ValidateBooleanPayload(payload); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	template, err := lib.TemplateRepositoryInstance.GetTemplate(templateID)
+	if errors.Is(err, lib.ErrTemplateNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading template %s: %v", templateID, err)
+		http.Error(w, "Could not create room", http.StatusInternalServerError)
+		return
+	}
+
+	room, err := lib.ChatRepositoryInstance.CreateRoom(uuid.New(), user.ID, payload.Name, payload.Description, payload.IsPrivate)
+	if err != nil {
+		log.Printf("Room creation error: %v", err)
+		http.Error(w, "Could not create room", http.StatusInternalServerError)
+		return
+	}
+
+	// The room is committed before the canvas is copied into it, so it is
+	// deleted again if the copy fails.
+	copies := make(map[uuid.UUID]lib.Asset, len(template.Assets))
+	for _, asset := range template.Assets {
+		copied := lib.Asset{
+			ID:          uuid.New(),
+			ContentType: asset.ContentType,
+			Size:        asset.Size,
+			Width:       asset.Width,
+			Height:      asset.Height,
+		}
+		if err = copyAssetFile(asset.ID, copied.ID); err != nil {
+			break
+		}
+		copies[asset.ID] = copied
+	}
+	shapeCount := 0
+	if err == nil {
+		shapeCount, err = lib.TemplateRepositoryInstance.ApplyTemplate(room.ID, templateID, user.ID, copies)
+	}
+	if err != nil {
+		log.Printf("Error copying template %s into room %s: %v", templateID, room.ID, err)
+		for _, copied := range copies {
+			assetStorage.Delete(copied.ID.String())
+		}
+		if _, deleteErr := lib.ChatRepositoryInstance.DeleteRoom(room.ID); deleteErr != nil {
+			log.Printf("Error deleting room %s after a failed template copy: %v", room.ID, deleteErr)
+		}
+		if errors.Is(err, lib.ErrTemplateNotFound) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Could not create room", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s created room %s from template %s with %d shapes", user.ID, room.ID, templateID, shapeCount)
+
+	WriteJSONHeader(w, map[string]interface{}{
+		"roomID":     room.ID,
+		"shapeCount": shapeCount,
+	}, http.StatusCreated)
+}
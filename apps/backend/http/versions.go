@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"backend/lib"
+
+	"github.com/google/uuid"
+)
+
+// handleVersions serves /room/versions for the room given by roomID:
+//
+//	GET     lists the saved versions, newest first
+//	POST    saves the current canvas as a version, body { "name": "..." }
+//	DELETE  deletes the version given by versionID
+//
+// Restoring a version goes through the WebSocket server so that everyone in
+// the room sees it, see the version_restore message. All requests are limited
+// to members of the room; a version can only be deleted by whoever saved it
+// or by an admin of the room.
+func handleVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	roomID, err := uuid.Parse(r.URL.Query().Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		versions, err := lib.VersionRepositoryInstance.GetVersions(roomID)
+		if err != nil {
+			log.Printf("Error listing versions of room %s: %v", roomID, err)
+			http.Error(w, "Could not list versions", http.StatusInternalServerError)
+			return
+		}
+		WriteJSON(w, map[string]interface{}{"versions": versions})
+	case "POST":
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid Input", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(payload.Name)
+		if name == "" || utf8.RuneCountInString(name) > lib.MaxVersionNameLength {
+			http.Error(w, "name must be between 1 and "+strconv.Itoa(lib.MaxVersionNameLength)+" characters", http.StatusBadRequest)
+			return
+		}
+		version, err := lib.VersionRepositoryInstance.SaveVersion(roomID, user.ID, name)
+		if err != nil {
+			log.Printf("Error saving version of room %s: %v", roomID, err)
+			http.Error(w, "Could not save version", http.StatusInternalServerError)
+			return
+		}
+		WriteJSONHeader(w, version, http.StatusCreated)
+	case "DELETE":
+		versionID, err := uuid.Parse(r.URL.Query().Get("versionID"))
+		if err != nil {
+			http.Error(w, "Invalid versionID", http.StatusBadRequest)
+			return
+		}
+		version, err := lib.VersionRepositoryInstance.GetVersion(roomID, versionID)
+		if errors.Is(err, lib.ErrVersionNotFound) {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading version %s: %v", versionID, err)
+			http.Error(w, "Could not delete version", http.StatusInternalServerError)
+			return
+		}
+		if version.CreatorID == nil || *version.CreatorID != user.ID {
+			admin, err := isRoomAdmin(user.ID, roomID)
+			if err != nil {
+				http.Error(w, "Could not delete version", http.StatusInternalServerError)
+				return
+			}
+			if !admin {
+				http.Error(w, "Only whoever saved a version or an admin can delete it", http.StatusForbidden)
+				return
+			}
+		}
+		if err := lib.VersionRepositoryInstance.DeleteVersion(roomID, versionID); err != nil && !errors.Is(err, lib.ErrVersionNotFound) {
+			log.Printf("Error deleting version %s: %v", versionID, err)
+			http.Error(w, "Could not delete version", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleVersionPreview serves GET /room/versions/preview, which draws the
+// version given by roomID and versionID as it would look once restored. The
+// query takes format, "svg" (default) or "png", and for PNGs maxSize, the side
+// of the square the image fits in, default 512.
+func handleVersionPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	user, ok := r.Context().Value(userIDKey).(*lib.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	roomID, err := uuid.Parse(query.Get("roomID"))
+	if err != nil {
+		http.Error(w, "Invalid roomID", http.StatusBadRequest)
+		return
+	}
+	exists, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err != nil || !exists {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	versionID, err := uuid.Parse(query.Get("versionID"))
+	if err != nil {
+		http.Error(w, "Invalid versionID", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "svg"
+	}
+	if format != "svg" && format != "png" {
+		http.Error(w, "format must be svg or png", http.StatusBadRequest)
+		return
+	}
+	maxSize := 512
+	if value := query.Get("maxSize"); value != "" {
+		maxSize, err = strconv.Atoi(value)
+		if err != nil || maxSize < 1 || maxSize > maxThumbnailSize {
+			http.Error(w, "maxSize must be a number between 1 and 2048", http.StatusBadRequest)
+			return
+		}
+	}
+
+	version, err := lib.VersionRepositoryInstance.GetVersion(roomID, versionID)
+	if errors.Is(err, lib.ErrVersionNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading version %s: %v", versionID, err)
+		http.Error(w, "Could not preview version", http.StatusInternalServerError)
+		return
+	}
+	shapes, layers, err := version.Contents()
+	if err != nil {
+		log.Printf("Error decoding version %s: %v", versionID, err)
+		http.Error(w, "Could not preview version", http.StatusInternalServerError)
+		return
+	}
+	hidden := make(map[uuid.UUID]bool)
+	for _, layer := range layers {
+		if !layer.Visible {
+			hidden[layer.ID] = true
+		}
+	}
+	visible := shapes[:0]
+	for _, shape := range shapes {
+		if shape.LayerID == nil || !hidden[*shape.LayerID] {
+			visible = append(visible, shape)
+		}
+	}
+
+	opts := lib.ExportOptions{Padding: 10, LoadAsset: assetLoader(roomID)}
+	var data []byte
+	contentType := "image/svg+xml"
+	if format == "svg" {
+		data, err = lib.RenderSVG(visible, opts)
+	} else {
+		contentType = "image/png"
+		data, err = lib.RenderPNG(visible, opts, lib.ThumbnailScale(visible, opts, maxSize))
+	}
+	if err != nil {
+		log.Printf("Error previewing version %s: %v", versionID, err)
+		http.Error(w, "Could not preview version", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
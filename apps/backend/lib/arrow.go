@@ -0,0 +1,86 @@
+package lib
+
+import "math"
+
+// center returns the middle of the shape's box, the point bound arrows aim at.
+// It is also the center of rotation.
+func (s *Shape) center() (float64, float64) {
+	return (s.MinX + s.MaxX) / 2, (s.MinY + s.MaxY) / 2
+}
+
+// outlinePoint returns where a ray from the shape's center towards (x, y)
+// leaves the shape: on the ellipse for ellipses and on the box otherwise.
+func (s *Shape) outlinePoint(x, y float64) (float64, float64) {
+	cx, cy := s.center()
+	// Boxes are measured in their own unrotated frame. The stored bounds of
+	// lines and strokes already include their rotation.
+	rotated := s.Rotation != 0
+	var rx, ry float64
+	switch s.Type {
+	case ShapeRectangle, ShapeEllipse, ShapeImage:
+		// Stop at the outer edge of the stroke rather than its middle.
+		rx, ry = math.Abs(s.Width/2)+s.StrokeWidth/2, math.Abs(s.Height/2)+s.StrokeWidth/2
+	case ShapeText:
+		width, height := s.TextSize()
+		rx, ry = width/2, height/2
+	default:
+		rotated = false
+		rx, ry = (s.MaxX-s.MinX)/2, (s.MaxY-s.MinY)/2
+	}
+	if rotated {
+		x, y = rotatePoint(x, y, cx, cy, -s.Rotation)
+	}
+	dx, dy := x-cx, y-cy
+	if dx == 0 && dy == 0 {
+		return cx, cy
+	}
+
+	var t float64
+	if s.Type == ShapeEllipse {
+		t = 1 / math.Sqrt(math.Pow(dx/rx, 2)+math.Pow(dy/ry, 2))
+	} else {
+		t = math.Inf(1)
+		if dx != 0 {
+			t = rx / math.Abs(dx)
+		}
+		if dy != 0 {
+			t = math.Min(t, ry/math.Abs(dy))
+		}
+	}
+	if math.IsNaN(t) || math.IsInf(t, 0) {
+		return cx, cy
+	}
+	px, py := cx+dx*t, cy+dy*t
+	if rotated {
+		return rotatePoint(px, py, cx, cy, s.Rotation)
+	}
+	return px, py
+}
+
+// BindArrow moves the bound ends of an arrow onto the outlines of the shapes
+// they are bound to. start and end are the bound shapes, nil for a free end;
+// a bound end whose shape is nil is unbound and stays where it is. Each bound
+// end aims at the center of the other end's shape, or at the free end.
+func (s *Shape) BindArrow(start, end *Shape) {
+	if start == nil {
+		s.StartShapeID = nil
+	}
+	if end == nil {
+		s.EndShapeID = nil
+	}
+
+	startX, startY := s.X, s.Y
+	if start != nil {
+		startX, startY = start.center()
+	}
+	endX, endY := s.EndX, s.EndY
+	if end != nil {
+		endX, endY = end.center()
+	}
+	if start != nil {
+		s.X, s.Y = start.outlinePoint(endX, endY)
+	}
+	if end != nil {
+		s.EndX, s.EndY = end.outlinePoint(startX, startY)
+	}
+}
@@ -1,25 +1,41 @@
 package lib
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
 var (
-	Db                      *gorm.DB
-	UserRepositoryInstance  *UserRepository
-	ChatRepositoryInstance  *ChatRepository
+	Db                     *gorm.DB
+	UserRepositoryInstance *UserRepository
+	ChatRepositoryInstance *ChatRepository
 	// highlight-start
 	ShapeRepositoryInstance *ShapeRepository
 	// highlight-end
+	SnapshotRepositoryInstance    *SnapshotRepository
+	LayerRepositoryInstance       *LayerRepository
+	AssetRepositoryInstance       *AssetRepository
+	VersionRepositoryInstance     *VersionRepository
+	HistoryRepositoryInstance     *HistoryRepository
+	TemplateRepositoryInstance    *TemplateRepository
+	ShareLinkRepositoryInstance   *ShareLinkRepository
+	JoinRequestRepositoryInstance *JoinRequestRepository
 )
 
 type UserRepository struct {
@@ -152,19 +168,283 @@ func (r *ChatRepository) CreateRoom(roomID, userId uuid.UUID, name string, descr
 	return room, nil
 }
 
+// ErrNotRoomMember is returned when a user a room operation is about must be
+// a member of the room and isn't.
+var ErrNotRoomMember = errors.New("user is not a member of the room")
+
+// UpdateRoomSettings changes the settings of a room that are set, and returns
+// the room as updated.
+func (r *ChatRepository) UpdateRoomSettings(roomID uuid.UUID, settings IncomingRoomSettingsPayload) (*Room, error) {
+	updates := map[string]interface{}{}
+	if settings.Name != nil {
+		updates["name"] = *settings.Name
+	}
+	if settings.Description != nil {
+		updates["description"] = *settings.Description
+	}
+	if settings.IsPrivate != nil {
+		updates["is_private"] = *settings.IsPrivate
+	}
+	var room Room
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&room, "id = ?", roomID).Error; err != nil {
+			return err
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(&room).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// DeleteRoom deletes a room with its canvas, history, chat and memberships.
+// It returns the assets of the room, whose files are left for the caller to
+// delete.
+func (r *ChatRepository) DeleteRoom(roomID uuid.UUID) ([]Asset, error) {
+	var assets []Asset
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var room Room
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&room, "id = ?", roomID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", roomID).Find(&assets).Error; err != nil {
+			return fmt.Errorf("failed to list assets of room %s: %w", roomID, err)
+		}
+		// Version assets don't cascade with their asset, so they go first.
+		versions := tx.Model(&CanvasVersion{}).Select("id").Where("room_id = ?", roomID)
+		if err := tx.Where("version_id IN (?)", versions).Delete(&VersionAsset{}).Error; err != nil {
+			return fmt.Errorf("failed to delete version assets of room %s: %w", roomID, err)
+		}
+		if err := tx.Where("room_id = ?", roomID).Delete(&Message{}).Error; err != nil {
+			return fmt.Errorf("failed to delete messages of room %s: %w", roomID, err)
+		}
+		if err := tx.Where("room_id = ?", roomID).Delete(&UserRoom{}).Error; err != nil {
+			return fmt.Errorf("failed to delete members of room %s: %w", roomID, err)
+		}
+		// Everything else cascades with the room.
+		if err := tx.Delete(&room).Error; err != nil {
+			return fmt.Errorf("failed to delete room %s: %w", roomID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+// TransferRoom makes a member of a room its creator. The previous creator
+// stays on as an admin.
+func (r *ChatRepository) TransferRoom(roomID, userID uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var room Room
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&room, "id = ?", roomID).Error; err != nil {
+			return err
+		}
+		if room.CreatorID == userID {
+			return nil
+		}
+		result := tx.Model(&UserRoom{}).Where("room_id = ? AND user_id = ?", roomID, userID).Update("role", string(Creator))
+		if result.Error != nil {
+			return fmt.Errorf("failed to make user %s creator of room %s: %w", userID, roomID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotRoomMember
+		}
+		if err := tx.Model(&UserRoom{}).Where("room_id = ? AND user_id = ?", roomID, room.CreatorID).Update("role", string(Admin)).Error; err != nil {
+			return fmt.Errorf("failed to make user %s admin of room %s: %w", room.CreatorID, roomID, err)
+		}
+		return tx.Model(&room).Update("creator_id", userID).Error
+	})
+}
+
+// ForkRoom creates room, owned by its CreatorID, with a copy of the canvas
+// of the room given by sourceID: shapes and layers get fresh IDs, and images
+// show the asset copies given by assets, keyed by the ID of the original.
+// assets hold the new rows, whose files must already be stored. With
+// copyMembers, the members of the source room join with their roles; its
+// creator joins as an admin. Chat is not copied. It returns the number of
+// shapes copied.
+func (r *ChatRepository) ForkRoom(sourceID uuid.UUID, room *Room, copyMembers bool, assets map[uuid.UUID]Asset) (int, error) {
+	var copied int
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			return fmt.Errorf("failed to create room %s: %w", room.ID, err)
+		}
+		if err := tx.Create(&UserRoom{UserID: room.CreatorID, RoomID: room.ID, Role: string(Creator)}).Error; err != nil {
+			return fmt.Errorf("failed to add creator to room %s: %w", room.ID, err)
+		}
+		if copyMembers {
+			var members []UserRoom
+			if err := tx.Where("room_id = ? AND user_id <> ?", sourceID, room.CreatorID).Find(&members).Error; err != nil {
+				return fmt.Errorf("failed to get members of room %s: %w", sourceID, err)
+			}
+			for i := range members {
+				members[i].RoomID = room.ID
+				members[i].JoinedAt = time.Time{}
+				if members[i].Role == string(Creator) {
+					members[i].Role = string(Admin)
+				}
+			}
+			if len(members) > 0 {
+				if err := tx.Omit(clause.Associations).Create(&members).Error; err != nil {
+					return fmt.Errorf("failed to copy members of room %s: %w", sourceID, err)
+				}
+			}
+		}
+
+		var shapes []Shape
+		if err := tx.Where("room_id = ?", sourceID).Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+			return fmt.Errorf("failed to get shapes of room %s: %w", sourceID, err)
+		}
+		var layers []Layer
+		if err := tx.Where("room_id = ?", sourceID).Find(&layers).Error; err != nil {
+			return fmt.Errorf("failed to get layers of room %s: %w", sourceID, err)
+		}
+		assetIDs := make(map[uuid.UUID]uuid.UUID, len(assets))
+		for original, asset := range assets {
+			asset.RoomID = room.ID
+			if err := tx.Omit(clause.Associations).Create(&asset).Error; err != nil {
+				return fmt.Errorf("failed to copy asset %s: %w", original, err)
+			}
+			assetIDs[original] = asset.ID
+		}
+		shapes, layers = CopyCanvas(room.ID, shapes, layers, assetIDs)
+		copied = len(shapes)
+		return insertCanvas(tx, room.ID, room.CreatorID, shapes, layers)
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	return copied, err
+}
+
+// insertCanvas adds shapes and layers copied from elsewhere to an empty room
+// as one change recorded in its history.
+func insertCanvas(tx *gorm.DB, roomID, authorID uuid.UUID, shapes []Shape, layers []Layer) error {
+	sequence, err := bumpRoomSequence(tx, roomID)
+	if err != nil {
+		return err
+	}
+	if len(layers) > 0 {
+		if err := tx.Omit(clause.Associations).Create(&layers).Error; err != nil {
+			return fmt.Errorf("failed to copy layers into room %s: %w", roomID, err)
+		}
+	}
+	if len(shapes) == 0 {
+		return nil
+	}
+	for i := range shapes {
+		if err := shapes[i].ComputeBounds(); err != nil {
+			return fmt.Errorf("shape %s: %w", shapes[i].ID, err)
+		}
+	}
+	if err := tx.Omit(clause.Associations).CreateInBatches(&shapes, 500).Error; err != nil {
+		return fmt.Errorf("failed to copy shapes into room %s: %w", roomID, err)
+	}
+	history := newShapeHistory(roomID, sequence, authorID)
+	if err := history.add(ShapeOpCreate, shapes...); err != nil {
+		return err
+	}
+	return history.save(tx)
+}
+
+// GetRoom retrieves a room without any of its relationships.
+func (r *ChatRepository) GetRoom(id uuid.UUID) (*Room, error) {
+	var room Room
+	if err := r.db.First(&room, "id = ?", id).Error; err != nil {
+		return nil, fmt.Errorf("failed to get room %s: %w", id, err)
+	}
+	return &room, nil
+}
+
+// trigramSearch is set when the pg_trgm extension is available.
+var trigramSearch bool
+
+// roomSummaries selects the rooms matching a query as RoomSummary rows, with
+// a sort_key column for RoomSort, as a derived table to filter and order.
+func roomSummaries(db *gorm.DB, query *gorm.DB, sort RoomSort) *gorm.DB {
+	sortKey := "activity_key"
+	if sort == RoomSortMembers {
+		sortKey = "member_count"
+	}
+	summaries := query.Table("rooms").
+		Select("rooms.id, rooms.name, rooms.description, rooms.is_private, rooms.creator_id, rooms.created_at, " +
+			"users.user_name AS creator_name, " +
+			"(SELECT count(*) FROM user_rooms WHERE user_rooms.room_id = rooms.id) AS member_count, " +
+			"COALESCE(rooms.last_activity_at, rooms.created_at) AS last_activity_at, " +
+			// Microseconds, the precision of timestamps, so cursors are exact.
+			"(extract(epoch FROM COALESCE(rooms.last_activity_at, rooms.created_at)) * 1000000)::bigint AS activity_key").
+		Joins("LEFT JOIN users ON users.id = rooms.creator_id")
+	return db.Table("(?) AS summaries", summaries).Select("*, " + sortKey + " AS sort_key")
+}
+
+// RoomCursor is where a room listing page ends: the sort key and ID of its
+// last room.
+type RoomCursor struct {
+	SortKey int64
+	ID      uuid.UUID
+}
+
+// DiscoverRooms lists public rooms, most active or most populated first,
+// limit at a time, continuing after cursor when it is set. A non-empty search
+// keeps rooms whose name or description contains it or, when trigram search
+// is available, resembles it. The returned cursor is nil on the last page.
+func (r *ChatRepository) DiscoverRooms(search string, sort RoomSort, cursor *RoomCursor, limit int) ([]RoomSummary, *RoomCursor, error) {
+	query := r.db.Where("rooms.is_private = ?", false)
+	if search != "" {
+		pattern := "%" + escapeLike(search) + "%"
+		if trigramSearch {
+			query = query.Where("rooms.name ILIKE ? OR rooms.description ILIKE ? OR word_similarity(?, rooms.name) > 0.3 OR word_similarity(?, rooms.description) > 0.3",
+				pattern, pattern, search, search)
+		} else {
+			query = query.Where("rooms.name ILIKE ? OR rooms.description ILIKE ?", pattern, pattern)
+		}
+	}
+
+	page := roomSummaries(r.db, query, sort)
+	if cursor != nil {
+		page = r.db.Table("(?) AS page", page).Where("(sort_key, id) < (?, ?)", cursor.SortKey, cursor.ID)
+	}
+	var rows []struct {
+		RoomSummary
+		SortKey int64
+	}
+	if err := page.Order("sort_key DESC, id DESC").Limit(limit + 1).Scan(&rows).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list public rooms: %w", err)
+	}
+
+	var next *RoomCursor
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next = &RoomCursor{SortKey: rows[limit-1].SortKey, ID: rows[limit-1].ID}
+	}
+	rooms := make([]RoomSummary, len(rows))
+	for i := range rows {
+		rooms[i] = rows[i].RoomSummary
+	}
+	return rooms, next, nil
+}
+
 func (r *ChatRepository) GetRoomByID(id uuid.UUID) (*Room, error) {
 	var room Room
 	err := r.db.Preload("Creator").Preload("Users").Preload("Messages.User").First(&room, id).Error
 	return &room, err
 }
 
-func (r *ChatRepository) GetRoomID(RoomName string) ([]ReturnRoomsFormat, error) {
+// GetRoomID returns the rooms named RoomName that userID may see: public
+// rooms and private rooms userID is a member of.
+func (r *ChatRepository) GetRoomID(RoomName string, userID uuid.UUID) ([]ReturnRoomsFormat, error) {
 	var res []ReturnRoomsFormat
 	if RoomName == "" {
 		return res, fmt.Errorf("Room Name is nil")
 	}
 	var rooms []Room
-	result := r.db.Preload("Creator").Where("name = ?", RoomName).Find(&rooms)
+	result := r.db.Preload("Creator").
+		Where("name = ?", RoomName).
+		Where("is_private = ? OR EXISTS (SELECT 1 FROM user_rooms WHERE user_rooms.room_id = rooms.id AND user_rooms.user_id = ?)", false, userID).
+		Find(&rooms)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return res, fmt.Errorf("room with name '%s' not found", RoomName)
@@ -187,11 +467,46 @@ func (r *ChatRepository) GetUserRooms(userID uuid.UUID) ([]Room, error) {
 	return user.Rooms, err
 }
 
+// GetUserRoomSummaries lists the rooms of a user, most active first, with
+// their role and unread chat count. OnlineUsers is left nil.
+func (r *ChatRepository) GetUserRoomSummaries(userID uuid.UUID) ([]UserRoomSummary, error) {
+	memberOf := r.db.Table("user_rooms").Select("room_id").Where("user_id = ?", userID)
+	summaries := roomSummaries(r.db, r.db.Where("rooms.id IN (?)", memberOf), RoomSortActivity)
+	var rooms []UserRoomSummary
+	err := r.db.Table("(?) AS mine", summaries).
+		Select("mine.*, user_rooms.role, "+
+			"(SELECT count(*) FROM messages WHERE messages.room_id = mine.id AND messages.user_id <> user_rooms.user_id AND "+
+			"CASE WHEN user_rooms.last_read_message_id IS NULL THEN messages.created_at > user_rooms.joined_at "+
+			"ELSE messages.id > user_rooms.last_read_message_id END) AS unread_count").
+		Joins("JOIN user_rooms ON user_rooms.room_id = mine.id AND user_rooms.user_id = ?", userID).
+		Order("mine.sort_key DESC, mine.id DESC").
+		Scan(&rooms).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms of user %s: %w", userID, err)
+	}
+	return rooms, nil
+}
+
+// GetUserRoomIDs returns the IDs of the rooms a user is a member of.
+func (r *ChatRepository) GetUserRoomIDs(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := r.db.Model(&UserRoom{}).Where("user_id = ?", userID).Pluck("room_id", &ids).Error
+	return ids, err
+}
+
+// MarkRoomRead marks every chat message of a room as seen by the user. It
+// does nothing if the user isn't a member.
+func (r *ChatRepository) MarkRoomRead(userID, roomID uuid.UUID) error {
+	return r.db.Model(&UserRoom{}).
+		Where("user_id = ? AND room_id = ?", userID, roomID).
+		UpdateColumn("last_read_message_id", gorm.Expr("(SELECT max(id) FROM messages WHERE room_id = ?)", roomID)).Error
+}
+
 func (r *ChatRepository) GetAdminRooms(roomID uuid.UUID) ([]User, error) {
 	// Get explicit admins from user_rooms
 	var userRooms []UserRoom
 	if err := r.db.Preload("User").
-		Where("room_id = ? AND role = ?", roomID, "admin").
+		Where("room_id = ? AND role = ?", roomID, string(Admin)).
 		Find(&userRooms).Error; err != nil {
 		return nil, err
 	}
@@ -229,44 +544,89 @@ func (r *ChatRepository) RemoveUserFromRoom(userID, roomID uuid.UUID) error {
 
 // Message operations
 func (r *ChatRepository) CreateMessage(message *Message) error {
-	return r.db.Create(message).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Room{}).Where("id = ?", message.RoomID).UpdateColumn("last_activity_at", gorm.Expr("now()")).Error
+	})
 }
 
-func (r *ChatRepository) GetRoomMessages(roomID uuid.UUID, limit int, offset int) ([]ReturnMessageFormat, error) {
+// GetRoomMessagesPage returns up to limit messages of a room keyed on message
+// ID. With only before set (or neither) it pages backwards from the newest
+// message; with after set it pages forwards. The page is always returned in
+// chronological order.
+func (r *ChatRepository) GetRoomMessagesPage(roomID uuid.UUID, before, after uint, limit int) (*ChatHistoryPage, error) {
+	if limit <= 0 {
+		limit = DefaultChatPageSize
+	}
+	if limit > MaxChatPageSize {
+		limit = MaxChatPageSize
+	}
+	if before != 0 && after != 0 && after >= before {
+		return nil, fmt.Errorf("after cursor %d must be smaller than before cursor %d", after, before)
+	}
+
+	query := r.db.Preload("User").Where("room_id = ?", roomID)
+	if before != 0 {
+		query = query.Where("id < ?", before)
+	}
+	if after != 0 {
+		query = query.Where("id > ?", after).Order("id ASC")
+	} else {
+		query = query.Order("id DESC")
+	}
+
+	// Fetch one extra row to know whether another page exists.
 	var messages []Message
-	err := r.db.Preload("User").Where("room_id = ?", roomID).
-		Order("created_at DESC").Limit(limit).Offset(offset).Find(&messages).Error
-	if err != nil {
-		return nil, err
+	if err := query.Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch messages for room %s: %w", roomID, err)
 	}
-	var returnMessages []ReturnMessageFormat = make([]ReturnMessageFormat, len(messages))
-	if len(messages) > 0 {
-		for index, message := range messages {
-			_,after,_ := strings.Cut(message.Content, "map[Message:")
-			after = after[0 : len(after)-1]
-			returnMessages[index] = ReturnMessageFormat{
-				Type:      string(message.Type),
-				Timestamp: message.UpdatedAt,
-				Sender: SenderInfo{
-					ID:   message.User.ID.String(),
-					Name: message.User.UserName,
-				},
-
-				Content: ContentInfo{
-					Message: after,
-				},
-			}
-		}
+
+	page := &ChatHistoryPage{Chats: make([]ReturnMessageFormat, 0, limit)}
+	if len(messages) > limit {
+		page.HasMore = true
+		messages = messages[:limit]
+	}
+	if after == 0 {
+		slices.Reverse(messages)
+	}
+	for _, message := range messages {
+		page.Chats = append(page.Chats, FormatMessage(message))
+	}
+	if len(page.Chats) > 0 {
+		page.Before = page.Chats[0].ID
+		page.After = page.Chats[len(page.Chats)-1].ID
 	}
-	return returnMessages, nil
+	return page, nil
 }
 
-func (r *ChatRepository) GetLatestMessages(roomID uuid.UUID, limit int) ([]Message, error) {
-	var messages []Message
-	err := r.db.Preload("User").Where("room_id = ?", roomID).
-		Order("created_at ASC").Limit(limit).Find(&messages).Error
+// GetLatestMessages returns the newest limit messages of a room in
+// chronological order.
+func (r *ChatRepository) GetLatestMessages(roomID uuid.UUID, limit int) (*ChatHistoryPage, error) {
+	return r.GetRoomMessagesPage(roomID, 0, 0, limit)
+}
 
-	return messages, err
+// FormatMessage converts a stored message into the shape sent to clients.
+// Chat content is persisted as the formatted ws payload ("map[Message:...]"),
+// so the text is unwrapped here.
+func FormatMessage(message Message) ReturnMessageFormat {
+	content := message.Content
+	if after, found := strings.CutPrefix(content, "map[Message:"); found {
+		content = strings.TrimSuffix(after, "]")
+	}
+	return ReturnMessageFormat{
+		ID:        message.ID,
+		Type:      string(message.Type),
+		Timestamp: message.UpdatedAt,
+		Sender: SenderInfo{
+			ID:   message.User.ID.String(),
+			Name: message.User.UserName,
+		},
+		Content: ContentInfo{
+			Message: content,
+		},
+	}
 }
 
 // Check if user is in room
@@ -276,6 +636,51 @@ func (r *ChatRepository) IsUserInRoom(userID, roomID uuid.UUID) (bool, error) {
 	return count > 0, err
 }
 
+// GetRoomMemberships lists the members of a room with their roles, in the
+// order they joined.
+func (r *ChatRepository) GetRoomMemberships(roomID uuid.UUID) ([]RoomMember, error) {
+	var members []RoomMember
+	err := r.db.Table("user_rooms").
+		Select("users.id, users.user_name, user_rooms.role, user_rooms.joined_at").
+		Joins("JOIN users ON users.id = user_rooms.user_id").
+		Where("user_rooms.room_id = ?", roomID).
+		Order("user_rooms.joined_at, users.id").
+		Scan(&members).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members of room %s: %w", roomID, err)
+	}
+	return members, nil
+}
+
+// GetMemberRole returns the role of a user in a room, or ErrNotRoomMember.
+func (r *ChatRepository) GetMemberRole(userID, roomID uuid.UUID) (Role, error) {
+	var userRoom UserRoom
+	err := r.db.Where("user_id = ? AND room_id = ?", userID, roomID).Take(&userRoom).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrNotRoomMember
+	}
+	if err != nil {
+		return "", err
+	}
+	return Role(userRoom.Role), nil
+}
+
+// SetMemberRole makes a member of a room an admin or a plain member. The
+// creator's role only changes with TransferRoom, so it returns
+// ErrNotRoomMember for the creator as for users outside the room.
+func (r *ChatRepository) SetMemberRole(userID, roomID uuid.UUID, role Role) error {
+	result := r.db.Model(&UserRoom{}).
+		Where("user_id = ? AND room_id = ? AND role <> ?", userID, roomID, string(Creator)).
+		Update("role", string(role))
+	if result.Error != nil {
+		return fmt.Errorf("failed to make user %s %s of room %s: %w", userID, role, roomID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotRoomMember
+	}
+	return nil
+}
+
 // Get room members
 func (r *ChatRepository) GetRoomMembers(roomID uuid.UUID) ([]User, error) {
 	var room Room
@@ -284,138 +689,1998 @@ func (r *ChatRepository) GetRoomMembers(roomID uuid.UUID) ([]User, error) {
 }
 
 type ShapeRepositoryInterface interface {
-	CreateShape(shape *Shape) error
+	CreateShape(shape *Shape) (int64, error)
 	GetShapesByRoomID(roomID uuid.UUID) ([]Shape, error)
-	UpdateShape(shape *Shape) error
-	DeleteShape(shapeID uuid.UUID) error
-	DeleteShapesByRoomID(roomID uuid.UUID) error // For clearing the canvas
+	DeleteShape(roomID, shapeID, authorID uuid.UUID) ([]Shape, int64, error)
+	DeleteShapesByRoomID(roomID, authorID uuid.UUID) (int64, error) // For clearing the canvas
 }
 
 type ShapeRepository struct {
 	db *gorm.DB
 }
 
-func NewShapeRepository(db *gorm.DB) *ShapeRepository {
-	return &ShapeRepository{db: db}
-}
+// shapeBoundsExpr is the indexed box expression over a shape's bounding box.
+const shapeBoundsExpr = "box(point(min_x, min_y), point(max_x, max_y))"
 
-// CreateShape adds a new shape to the database.
-// This is called when a user finishes drawing a new shape.
-func (s *ShapeRepository) CreateShape(shape *Shape) error {
-	result := s.db.Create(shape)
-	if result.Error != nil {
-		return fmt.Errorf("failed to create shape: %w", result.Error)
+// shapePaintOrder orders shapes bottom to top: by layer, with the base layer
+// first, then by z-order key within the layer.
+const shapePaintOrder = `(SELECT layers.z_index FROM layers WHERE layers.id = shapes.layer_id) COLLATE "C" ASC NULLS FIRST, ` +
+	`shapes.z_index COLLATE "C" ASC, shapes.created_at ASC`
+
+// layerShapes scopes a query to the shapes of one layer of a room.
+func layerShapes(tx *gorm.DB, roomID uuid.UUID, layerID *uuid.UUID) *gorm.DB {
+	tx = tx.Model(&Shape{}).Where("room_id = ?", roomID)
+	if layerID == nil {
+		return tx.Where("layer_id IS NULL")
 	}
-	return nil
+	return tx.Where("layer_id = ?", *layerID)
 }
 
-// GetShapesByRoomID retrieves all shapes associated with a specific room.
-// This is called when a user first joins a room to load the canvas.
-func (s *ShapeRepository) GetShapesByRoomID(roomID uuid.UUID) ([]Shape, error) {
-	var shapes []Shape
-	result := s.db.Preload("Creator").Where("room_id = ?", roomID).Order("created_at ASC").Find(&shapes)
-	if result.Error != nil {
-		return nil, fmt.Errorf("failed to get shapes for room %s: %w", roomID, result.Error)
+// edgeZIndex returns the topmost (or bottommost) z-order key of a layer,
+// ignoring excludeID, or "" when the layer has no other shapes.
+func edgeZIndex(tx *gorm.DB, roomID uuid.UUID, layerID *uuid.UUID, top bool, excludeID uuid.UUID) (string, error) {
+	direction := " ASC"
+	if top {
+		direction = " DESC"
 	}
-	return shapes, nil
+	var keys []string
+	err := layerShapes(tx, roomID, layerID).Where("id <> ?", excludeID).
+		Order(zIndexOrder+direction).Limit(1).Pluck("z_index", &keys).Error
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	return keys[0], nil
 }
 
-// UpdateShape updates an existing shape in the database.
-// This is used for moving, resizing, or changing the color of a shape.
-// The provided shape struct should have its ID field populated.
-func (s *ShapeRepository) UpdateShape(shape *Shape) error {
-	if shape.ID == uuid.Nil {
-		return errors.New("cannot update shape without an ID")
+// placeOnTop validates the shape's layer and gives it a z-order key above
+// every other shape of that layer. The room row must already be locked by
+// bumpRoomSequence so concurrent inserts don't get the same key.
+func placeOnTop(tx *gorm.DB, shape *Shape) error {
+	if shape.LayerID != nil {
+		var count int64
+		if err := tx.Model(&Layer{}).Where("id = ? AND room_id = ?", *shape.LayerID, shape.RoomID).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check layer %s: %w", *shape.LayerID, err)
+		}
+		if count == 0 {
+			return fmt.Errorf("layer %s not found in room %s", *shape.LayerID, shape.RoomID)
+		}
 	}
+	top, err := edgeZIndex(tx, shape.RoomID, shape.LayerID, true, shape.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read z-order for room %s: %w", shape.RoomID, err)
+	}
+	shape.ZIndex, err = ZIndexBetween(top, "")
+	return err
+}
+
+func NewShapeRepository(db *gorm.DB) *ShapeRepository {
+	return &ShapeRepository{db: db}
+}
 
-	// Use Save to update all fields of the model based on its primary key.
-	// This is robust for updating any property (position, size, color, points, etc.).
-	result := s.db.Save(shape)
+// bumpRoomSequence advances the room's operation sequence inside tx and
+// returns the new value. Every shape mutation calls it in the same
+// transaction so the sequence and the shapes always commit together.
+func bumpRoomSequence(tx *gorm.DB, roomID uuid.UUID) (int64, error) {
+	var sequence int64
+	result := tx.Raw("UPDATE rooms SET sequence = sequence + 1, last_activity_at = now() WHERE id = ? RETURNING sequence", roomID).Scan(&sequence)
 	if result.Error != nil {
-		return fmt.Errorf("failed to update shape %s: %w", shape.ID, result.Error)
+		return 0, fmt.Errorf("failed to advance sequence for room %s: %w", roomID, result.Error)
 	}
 	if result.RowsAffected == 0 {
-		return fmt.Errorf("shape with ID %s not found for update", shape.ID)
+		return 0, fmt.Errorf("room %s not found", roomID)
+	}
+	return sequence, nil
+}
+
+// shapeHistory collects the shape events of one room sequence, in the order
+// the changes were made, so they can be stored with the change itself.
+type shapeHistory struct {
+	roomID   uuid.UUID
+	sequence int64
+	authorID *uuid.UUID
+	events   []ShapeEvent
+}
+
+// newShapeHistory starts the events of sequence, attributed to authorID or to
+// no one when it is uuid.Nil.
+func newShapeHistory(roomID uuid.UUID, sequence int64, authorID uuid.UUID) *shapeHistory {
+	h := &shapeHistory{roomID: roomID, sequence: sequence}
+	if authorID != uuid.Nil {
+		h.authorID = &authorID
+	}
+	return h
+}
+
+// add records shapes as they are after a create or an update.
+func (h *shapeHistory) add(op ShapeOperationType, shapes ...Shape) error {
+	for i := range shapes {
+		encoded, err := json.Marshal(&shapes[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode shape %s for history: %w", shapes[i].ID, err)
+		}
+		h.events = append(h.events, ShapeEvent{RoomID: h.roomID, Sequence: h.sequence, AuthorID: h.authorID, Op: op, ShapeID: shapes[i].ID, Shape: encoded})
 	}
 	return nil
 }
 
-// DeleteShape removes a single shape from the database by its ID.
-// This is called when a user selects and deletes a shape.
-func (s *ShapeRepository) DeleteShape(shapeID uuid.UUID) error {
-	log.Printf("Shaped id received to delete is %s",shapeID.String())
-	if shapeID == uuid.Nil {
-		return errors.New("cannot delete shape without an ID")
+// deleted records the deletion of shapes.
+func (h *shapeHistory) deleted(shapeIDs ...uuid.UUID) {
+	for _, shapeID := range shapeIDs {
+		h.events = append(h.events, ShapeEvent{RoomID: h.roomID, Sequence: h.sequence, AuthorID: h.authorID, Op: ShapeOpDelete, ShapeID: shapeID})
 	}
-	result := s.db.Where("id = ?", shapeID).Delete(&Shape{})
-	if result.Error != nil {
-		return fmt.Errorf("failed to delete shape %s: %w", shapeID, result.Error)
+}
+
+// reload records as updated shapes that were changed a few columns at a time,
+// reading them back whole.
+func (h *shapeHistory) reload(tx *gorm.DB, shapeIDs []uuid.UUID) error {
+	if len(shapeIDs) == 0 {
+		return nil
 	}
-	if result.RowsAffected == 0 {
-		return fmt.Errorf("shape with ID %s not found for deletion", shapeID)
+	var shapes []Shape
+	if err := tx.Where("room_id = ? AND id IN ?", h.roomID, shapeIDs).Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+		return fmt.Errorf("failed to read changed shapes for history: %w", err)
 	}
-	return nil
+	return h.add(ShapeOpUpdate, shapes...)
 }
 
-// DeleteShapesByRoomID removes all shapes from a specific room.
-// This is useful for a "Clear Canvas" feature.
-func (s *ShapeRepository) DeleteShapesByRoomID(roomID uuid.UUID) error {
-	if roomID == uuid.Nil {
-		return errors.New("cannot delete shapes without a room ID")
+// save stores the collected events.
+func (h *shapeHistory) save(tx *gorm.DB) error {
+	if len(h.events) == 0 {
+		return nil
 	}
-	// Note: This won't return an error if 0 rows are affected (i.e., the canvas was already empty).
-	result := s.db.Where("room_id = ?", roomID).Delete(&Shape{})
-	if result.Error != nil {
-		return fmt.Errorf("failed to delete all shapes for room %s: %w", roomID, result.Error)
+	if err := tx.CreateInBatches(h.events, 500).Error; err != nil {
+		return fmt.Errorf("failed to record shape history for room %s: %w", h.roomID, err)
 	}
 	return nil
 }
 
-func init() {
-	var err error
-	dsn := "host=postgres user=anant password=supersecret dbname=mydb port=5432 sslmode=disable"
-
-	// Add retry logic for database connection
-	var db *gorm.DB
-	for i := 0; i < 10; i++ {
-		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
-		if err == nil {
-			break
+// CreateShape adds a new shape to the database and returns the room sequence
+// the creation was recorded at.
+// This is called when a user finishes drawing a new shape.
+func (s *ShapeRepository) CreateShape(shape *Shape) (int64, error) {
+	if err := shape.Validate(); err != nil {
+		return 0, err
+	}
+	// Text revisions are counted by ApplyTextEdit, never by clients.
+	shape.TextRevision = 0
+	if err := shape.ComputeBounds(); err != nil {
+		return 0, err
+	}
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, shape.RoomID); err != nil {
+			return err
 		}
-		log.Println("Failed to connect to DB, retrying...")
-		time.Sleep(5 * time.Second)
+		if err := placeOnTop(tx, shape); err != nil {
+			return err
+		}
+		if err := linkShape(tx, shape); err != nil {
+			return err
+		}
+		if err := tx.Create(shape).Error; err != nil {
+			return fmt.Errorf("failed to create shape: %w", err)
+		}
+		history := newShapeHistory(shape.RoomID, sequence, shape.CreatorID)
+		if err := history.add(ShapeOpCreate, *shape); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	return sequence, err
+}
+
+// GetShapesByRoomID retrieves all shapes associated with a specific room.
+// Creators are not preloaded since they are never serialized with a shape.
+func (s *ShapeRepository) GetShapesByRoomID(roomID uuid.UUID) ([]Shape, error) {
+	var shapes []Shape
+	result := s.db.Where("room_id = ?", roomID).Order(shapePaintOrder).Find(&shapes)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get shapes for room %s: %w", roomID, result.Error)
 	}
+	return shapes, nil
+}
 
+// GetShapesInBounds retrieves the shapes of a room whose bounding box
+// intersects bounds, together with the room sequence they were read at.
+// The intersection test matches the expression of the shapes bounds index.
+func (s *ShapeRepository) GetShapesInBounds(roomID uuid.UUID, bounds Bounds) ([]Shape, int64, error) {
+	var shapes []Shape
+	var room Room
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id", "sequence").First(&room, "id = ?", roomID).Error; err != nil {
+			return fmt.Errorf("failed to read sequence for room %s: %w", roomID, err)
+		}
+		result := tx.Where("room_id = ?", roomID).
+			Where(shapeBoundsExpr+" && box(point(?, ?), point(?, ?))", bounds.MinX, bounds.MinY, bounds.MaxX, bounds.MaxY).
+			Order(shapePaintOrder).Find(&shapes)
+		if result.Error != nil {
+			return fmt.Errorf("failed to get shapes in %+v for room %s: %w", bounds, roomID, result.Error)
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		log.Fatal("Failed to connect to database after retries:", err)
+		return nil, 0, err
 	}
+	return shapes, room.Sequence, nil
+}
 
-	// Enable SQL logging
-	db.Logger = logger.Default.LogMode(logger.Info)
+// BackfillBounds computes the bounding box of shapes stored before bounds
+// were tracked, which still have an all-zero box.
+func (s *ShapeRepository) BackfillBounds() error {
+	var shapes []Shape
+	result := s.db.Where("min_x = 0 AND min_y = 0 AND max_x = 0 AND max_y = 0").
+		FindInBatches(&shapes, 500, func(tx *gorm.DB, batch int) error {
+			for i := range shapes {
+				if err := shapes[i].ComputeBounds(); err != nil {
+					log.Printf("Skipping bounds backfill for shape %s: %v", shapes[i].ID, err)
+					continue
+				}
+				err := s.db.Model(&Shape{}).Where("id = ?", shapes[i].ID).UpdateColumns(map[string]interface{}{
+					"min_x": shapes[i].MinX,
+					"min_y": shapes[i].MinY,
+					"max_x": shapes[i].MaxX,
+					"max_y": shapes[i].MaxY,
+				}).Error
+				if err != nil {
+					return fmt.Errorf("failed to backfill bounds for shape %s: %w", shapes[i].ID, err)
+				}
+			}
+			return nil
+		})
+	return result.Error
+}
 
-	// Migrate with error checking
-	err = db.AutoMigrate(&User{}, &Room{}, &Message{}, &UserRoom{}, &Shape{})
-	if err != nil {
-		log.Fatal("Failed to auto-migrate tables:", err)
+// ErrShapeNotFound is returned for a shape that doesn't exist in the room.
+var ErrShapeNotFound = errors.New("shape not found")
+
+// DeleteShape removes a single shape of a room by its ID and returns the
+// arrows that were bound to it, now unbound, with the room sequence the
+// deletion was recorded at, or ErrShapeNotFound. The deletion is attributed
+// to authorID in the room history.
+// This is called when a user selects and deletes a shape.
+func (s *ShapeRepository) DeleteShape(roomID, shapeID, authorID uuid.UUID) ([]Shape, int64, error) {
+	if shapeID == uuid.Nil {
+		return nil, 0, errors.New("cannot delete shape without an ID")
 	}
 
-	// Verify tables exist
-	if !db.Migrator().HasTable(&Message{}) {
-		log.Fatal("Messages table was not created")
+	var arrows []Shape
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND room_id = ?", shapeID, roomID).Delete(&Shape{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete shape %s: %w", shapeID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrShapeNotFound
+		}
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		if arrows, err = rebindArrows(tx, roomID, []uuid.UUID{shapeID}); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		history.deleted(shapeID)
+		if err := history.add(ShapeOpUpdate, arrows...); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, 0, err
 	}
-	if !db.Migrator().HasTable(&UserRoom{}) {
-		log.Fatal("UserRooms table was not created")
+	return arrows, sequence, nil
+}
+
+// DeleteShapes removes several shapes of a room in one transaction and
+// returns the IDs that were actually deleted and the arrows that were bound
+// to them, with the room sequence the deletion was recorded at. The deletion
+// is attributed to authorID in the room history.
+func (s *ShapeRepository) DeleteShapes(roomID, authorID uuid.UUID, shapeIDs []uuid.UUID) ([]uuid.UUID, []Shape, int64, error) {
+	if len(shapeIDs) == 0 {
+		return nil, nil, 0, nil
 	}
-	if !db.Migrator().HasTable(&Shape{}) {
-		log.Fatal("Shapes table was not created")
+
+	var deletedIDs []uuid.UUID
+	var arrows []Shape
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var deleted []Shape
+		result := tx.Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("room_id = ? AND id IN ?", roomID, shapeIDs).Delete(&deleted)
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete shapes in room %s: %w", roomID, result.Error)
+		}
+		if len(deleted) == 0 {
+			return nil
+		}
+		for _, shape := range deleted {
+			deletedIDs = append(deletedIDs, shape.ID)
+		}
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		if arrows, err = rebindArrows(tx, roomID, deletedIDs); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		history.deleted(deletedIDs...)
+		if err := history.add(ShapeOpUpdate, arrows...); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, nil, 0, err
 	}
+	return deletedIDs, arrows, sequence, nil
+}
 
-	Db = db
-	UserRepositoryInstance = NewUserRepository(Db)
-	ChatRepositoryInstance = NewChatRepository(Db)
-	// highlight-start
-	ShapeRepositoryInstance = NewShapeRepository(Db)
-	// highlight-end
+// ApplyBatch applies creates, updates and deletes to the shapes of a room in
+// a single transaction: either every operation succeeds or none does. New
+// shapes, and every change in the room history, are attributed to creatorID.
+// It returns the arrows outside the batch
+// that moved along with shapes they are bound to, and the room sequence the
+// batch was recorded at.
+func (s *ShapeRepository) ApplyBatch(roomID, creatorID uuid.UUID, operations []ShapeOperation) ([]Shape, int64, error) {
+	var arrows []Shape
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, creatorID)
+		changed := make([]uuid.UUID, 0, len(operations))
+		for i, operation := range operations {
+			if err := applyShapeOperation(tx, roomID, creatorID, operation); err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			if operation.Op == ShapeOpDelete {
+				changed = append(changed, operation.ShapeID)
+				history.deleted(operation.ShapeID)
+			} else {
+				changed = append(changed, operation.Shape.ID)
+				if err := history.add(operation.Op, *operation.Shape); err != nil {
+					return err
+				}
+			}
+		}
+		if arrows, err = rebindArrows(tx, roomID, changed); err != nil {
+			return err
+		}
+		if err := history.add(ShapeOpUpdate, arrows...); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return arrows, sequence, nil
+}
 
-	fmt.Println("Database initialized successfully!")
-}
\ No newline at end of file
+func applyShapeOperation(tx *gorm.DB, roomID, creatorID uuid.UUID, operation ShapeOperation) error {
+	switch operation.Op {
+	case ShapeOpCreate, ShapeOpUpdate:
+		shape := operation.Shape
+		if shape == nil || shape.ID == uuid.Nil {
+			return fmt.Errorf("%s needs a shape with an ID", operation.Op)
+		}
+		shape.RoomID = roomID
+		if err := shape.Validate(); err != nil {
+			return err
+		}
+		if operation.Op == ShapeOpCreate {
+			if err := shape.ComputeBounds(); err != nil {
+				return err
+			}
+			shape.CreatorID = creatorID
+			shape.TextRevision = 0
+			if err := placeOnTop(tx, shape); err != nil {
+				return err
+			}
+			if err := linkShape(tx, shape); err != nil {
+				return err
+			}
+			if err := tx.Create(shape).Error; err != nil {
+				return fmt.Errorf("failed to create shape %s: %w", shape.ID, err)
+			}
+			return nil
+		}
+		// Ownership, paint order and text content only change through their
+		// own messages.
+		var existing Shape
+		if err := tx.Select("id", "creator_id", "created_at", "layer_id", "z_index", "text", "text_revision").Where("id = ? AND room_id = ?", shape.ID, roomID).First(&existing).Error; err != nil {
+			return fmt.Errorf("shape with ID %s not found for update: %w", shape.ID, err)
+		}
+		shape.CreatorID = existing.CreatorID
+		shape.CreatedAt = existing.CreatedAt
+		shape.LayerID = existing.LayerID
+		shape.ZIndex = existing.ZIndex
+		shape.Text = existing.Text
+		shape.TextRevision = existing.TextRevision
+		if err := shape.ComputeBounds(); err != nil {
+			return err
+		}
+		if err := linkShape(tx, shape); err != nil {
+			return err
+		}
+		if err := tx.Save(shape).Error; err != nil {
+			return fmt.Errorf("failed to update shape %s: %w", shape.ID, err)
+		}
+		return nil
+	case ShapeOpDelete:
+		result := tx.Where("id = ? AND room_id = ?", operation.ShapeID, roomID).Delete(&Shape{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete shape %s: %w", operation.ShapeID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("shape with ID %s not found for deletion", operation.ShapeID)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", operation.Op)
+	}
+}
+
+// linkShape checks and resolves what a shape refers to before it is stored:
+// the asset an image shows, which must belong to the shape's room, and the
+// shapes an arrow is bound to.
+func linkShape(tx *gorm.DB, shape *Shape) error {
+	if shape.AssetID != nil {
+		var count int64
+		if err := tx.Model(&Asset{}).Where("id = ? AND room_id = ?", *shape.AssetID, shape.RoomID).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check asset %s: %w", *shape.AssetID, err)
+		}
+		if count == 0 {
+			return fmt.Errorf("asset %s not found in room %s", *shape.AssetID, shape.RoomID)
+		}
+	}
+	return bindArrow(tx, shape)
+}
+
+// bindArrow moves the bound ends of an arrow onto the shapes they are bound
+// to, unbinding ends whose shape no longer exists in the room. Arrows cannot
+// be bound to other arrows. Other shapes are left alone.
+func bindArrow(tx *gorm.DB, arrow *Shape) error {
+	if arrow.Type != ShapeArrow {
+		return nil
+	}
+	var ids []uuid.UUID
+	for _, id := range []*uuid.UUID{arrow.StartShapeID, arrow.EndShapeID} {
+		if id != nil {
+			ids = append(ids, *id)
+		}
+	}
+	var bound []Shape
+	if len(ids) > 0 {
+		if err := tx.Where("room_id = ? AND id IN ?", arrow.RoomID, ids).Find(&bound).Error; err != nil {
+			return fmt.Errorf("failed to get shapes bound to arrow %s: %w", arrow.ID, err)
+		}
+	}
+	find := func(id *uuid.UUID) (*Shape, error) {
+		if id == nil {
+			return nil, nil
+		}
+		for i := range bound {
+			if bound[i].ID == *id {
+				if bound[i].Type == ShapeArrow {
+					return nil, fmt.Errorf("arrow %s cannot be bound to arrow %s", arrow.ID, *id)
+				}
+				return &bound[i], nil
+			}
+		}
+		return nil, nil
+	}
+	start, err := find(arrow.StartShapeID)
+	if err != nil {
+		return err
+	}
+	end, err := find(arrow.EndShapeID)
+	if err != nil {
+		return err
+	}
+	arrow.BindArrow(start, end)
+	return arrow.ComputeBounds()
+}
+
+// rebindArrows recomputes the arrows bound to any of shapeIDs after those
+// shapes changed or were deleted, and returns the arrows it updated.
+func rebindArrows(tx *gorm.DB, roomID uuid.UUID, shapeIDs []uuid.UUID) ([]Shape, error) {
+	if len(shapeIDs) == 0 {
+		return nil, nil
+	}
+	var arrows []Shape
+	if err := tx.Where("room_id = ? AND type = ? AND (start_shape_id IN ? OR end_shape_id IN ?)", roomID, ShapeArrow, shapeIDs, shapeIDs).
+		Find(&arrows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get arrows bound to changed shapes: %w", err)
+	}
+	for i := range arrows {
+		if err := bindArrow(tx, &arrows[i]); err != nil {
+			return nil, err
+		}
+		err := tx.Model(&arrows[i]).
+			Select("x", "y", "end_x", "end_y", "start_shape_id", "end_shape_id", "min_x", "min_y", "max_x", "max_y").
+			Updates(&arrows[i]).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to move arrow %s: %w", arrows[i].ID, err)
+		}
+	}
+	return arrows, nil
+}
+
+// maxTextHistory is how many past edits of a text shape are kept. An edit
+// based on an older revision can no longer be merged and is rejected with
+// ErrStaleTextRevision.
+const maxTextHistory = 500
+
+// ErrStaleTextRevision means a text edit was based on a revision too old to
+// merge; the client should reload the shape.
+var ErrStaleTextRevision = errors.New("text revision is too old to merge")
+
+// ApplyTextEdit applies a character-level edit made on baseRevision of a text
+// shape. The edit is transformed against every edit applied since, so
+// concurrent typing by several users is merged rather than overwritten. It
+// returns the edit as applied, the updated shape, the arrows bound to it that
+// moved as the text box changed size, and the room sequence the edit was
+// recorded at.
+func (s *ShapeRepository) ApplyTextEdit(roomID, shapeID, authorID uuid.UUID, baseRevision int64, operation *TextOperation) (*TextOperation, *Shape, []Shape, int64, error) {
+	var shape Shape
+	var arrows []Shape
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND room_id = ?", shapeID, roomID).First(&shape).Error; err != nil {
+			return fmt.Errorf("shape with ID %s not found for text edit: %w", shapeID, err)
+		}
+		if shape.Type != ShapeText {
+			return fmt.Errorf("shape %s is not a text shape", shapeID)
+		}
+		if baseRevision < 0 || baseRevision > shape.TextRevision {
+			return fmt.Errorf("shape %s has no text revision %d", shapeID, baseRevision)
+		}
+
+		var concurrent []TextEdit
+		if err := tx.Where("shape_id = ? AND revision > ?", shapeID, baseRevision).Order("revision").Find(&concurrent).Error; err != nil {
+			return fmt.Errorf("failed to load text edits of shape %s: %w", shapeID, err)
+		}
+		if int64(len(concurrent)) != shape.TextRevision-baseRevision {
+			return ErrStaleTextRevision
+		}
+		for _, edit := range concurrent {
+			var applied TextOperation
+			if err := json.Unmarshal(edit.Operation, &applied); err != nil {
+				return fmt.Errorf("invalid text edit %d of shape %s: %w", edit.Revision, shapeID, err)
+			}
+			if operation, _, err = TransformText(operation, &applied); err != nil {
+				return err
+			}
+		}
+
+		text, err := operation.Apply(shape.Text)
+		if err != nil {
+			return err
+		}
+		shape.Text = text
+		shape.TextRevision++
+		if err := shape.Validate(); err != nil {
+			return err
+		}
+		if err := shape.ComputeBounds(); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(operation)
+		if err != nil {
+			return err
+		}
+		edit := TextEdit{ShapeID: shapeID, Revision: shape.TextRevision, AuthorID: authorID, Operation: encoded}
+		if err := tx.Create(&edit).Error; err != nil {
+			return fmt.Errorf("failed to record text edit of shape %s: %w", shapeID, err)
+		}
+		err = tx.Model(&shape).Updates(map[string]interface{}{
+			"text":          shape.Text,
+			"text_revision": shape.TextRevision,
+			"min_x":         shape.MinX,
+			"min_y":         shape.MinY,
+			"max_x":         shape.MaxX,
+			"max_y":         shape.MaxY,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to update text of shape %s: %w", shapeID, err)
+		}
+		if err := tx.Where("shape_id = ? AND revision <= ?", shapeID, shape.TextRevision-maxTextHistory).Delete(&TextEdit{}).Error; err != nil {
+			return fmt.Errorf("failed to prune text edits of shape %s: %w", shapeID, err)
+		}
+		if arrows, err = rebindArrows(tx, roomID, []uuid.UUID{shapeID}); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.add(ShapeOpUpdate, shape); err != nil {
+			return err
+		}
+		if err := history.add(ShapeOpUpdate, arrows...); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	return operation, &shape, arrows, sequence, nil
+}
+
+// MoveShapeZ moves a shape within the paint order of its layer and returns
+// its new z-order key with the room sequence the move was recorded at.
+// Moving the top shape forward (or the bottom one backward) keeps its key.
+// The move is attributed to authorID in the room history.
+func (s *ShapeRepository) MoveShapeZ(roomID, shapeID, authorID uuid.UUID, move ZMove) (string, int64, error) {
+	var zIndex string
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		var shape Shape
+		if err := tx.Select("id", "room_id", "layer_id", "z_index").Where("id = ? AND room_id = ?", shapeID, roomID).First(&shape).Error; err != nil {
+			return fmt.Errorf("shape with ID %s not found: %w", shapeID, err)
+		}
+
+		var above, below string
+		switch move {
+		case ZMoveToFront:
+			above, err = edgeZIndex(tx, roomID, shape.LayerID, true, shapeID)
+		case ZMoveToBack:
+			below, err = edgeZIndex(tx, roomID, shape.LayerID, false, shapeID)
+		case ZMoveForward, ZMoveBackward:
+			// Find the two neighbours in the direction of the move and slot
+			// the shape in between them.
+			compare, direction := " > ?", " ASC"
+			if move == ZMoveBackward {
+				compare, direction = " < ?", " DESC"
+			}
+			var neighbours []string
+			err = layerShapes(tx, roomID, shape.LayerID).Where(zIndexOrder+compare, shape.ZIndex).
+				Order(zIndexOrder+direction).Limit(2).Pluck("z_index", &neighbours).Error
+			if err == nil && len(neighbours) == 0 {
+				zIndex = shape.ZIndex
+				return nil
+			}
+			if err == nil {
+				next := ""
+				if len(neighbours) == 2 {
+					next = neighbours[1]
+				}
+				if move == ZMoveForward {
+					above, below = neighbours[0], next
+				} else {
+					above, below = next, neighbours[0]
+				}
+			}
+		default:
+			return fmt.Errorf("unknown z-order move %q", move)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read z-order for room %s: %w", roomID, err)
+		}
+
+		// above/below name the neighbours the shape ends up above/below.
+		if zIndex, err = ZIndexBetween(above, below); err != nil {
+			return err
+		}
+		if err := tx.Model(&Shape{}).Where("id = ?", shapeID).Update("z_index", zIndex).Error; err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.reload(tx, []uuid.UUID{shapeID}); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return zIndex, sequence, nil
+}
+
+// BackfillZIndexes gives z-order keys to shapes stored before paint order
+// was tracked, keeping their creation order.
+func (s *ShapeRepository) BackfillZIndexes() error {
+	var roomIDs []uuid.UUID
+	if err := s.db.Model(&Shape{}).Where("z_index = ''").Distinct().Pluck("room_id", &roomIDs).Error; err != nil {
+		return fmt.Errorf("failed to find shapes without z-index: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var shapeIDs []uuid.UUID
+			if err := tx.Model(&Shape{}).Where("room_id = ? AND z_index = ''", roomID).Order("created_at ASC").Pluck("id", &shapeIDs).Error; err != nil {
+				return err
+			}
+			keys := SpreadZIndexes(len(shapeIDs))
+			for i, shapeID := range shapeIDs {
+				if err := tx.Model(&Shape{}).Where("id = ?", shapeID).UpdateColumn("z_index", keys[i]).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to backfill z-index for room %s: %w", roomID, err)
+		}
+	}
+	return nil
+}
+
+// GroupShapes puts shapes of a room into groupID, taking them out of any
+// group they were in. It fails without changes unless every shape exists.
+// The change is attributed to authorID in the room history.
+func (s *ShapeRepository) GroupShapes(roomID, groupID, authorID uuid.UUID, shapeIDs []uuid.UUID) (int64, error) {
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Shape{}).Where("room_id = ? AND id IN ?", roomID, shapeIDs).Update("group_id", groupID)
+		if result.Error != nil {
+			return fmt.Errorf("failed to group shapes in room %s: %w", roomID, result.Error)
+		}
+		if result.RowsAffected != int64(len(shapeIDs)) {
+			return fmt.Errorf("only %d of %d shapes to group exist in room %s", result.RowsAffected, len(shapeIDs), roomID)
+		}
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.reload(tx, shapeIDs); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	return sequence, err
+}
+
+// UngroupShapes dissolves a group and returns the IDs of the shapes that
+// were in it. The change is attributed to authorID in the room history.
+func (s *ShapeRepository) UngroupShapes(roomID, groupID, authorID uuid.UUID) ([]uuid.UUID, int64, error) {
+	var shapeIDs []uuid.UUID
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var ungrouped []Shape
+		result := tx.Model(&ungrouped).Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("room_id = ? AND group_id = ?", roomID, groupID).Update("group_id", nil)
+		if result.Error != nil {
+			return fmt.Errorf("failed to ungroup %s in room %s: %w", groupID, roomID, result.Error)
+		}
+		if len(ungrouped) == 0 {
+			return fmt.Errorf("group %s not found in room %s", groupID, roomID)
+		}
+		for _, shape := range ungrouped {
+			shapeIDs = append(shapeIDs, shape.ID)
+		}
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.reload(tx, shapeIDs); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return shapeIDs, sequence, nil
+}
+
+// DeleteShapesByRoomID removes all shapes from a specific room. The deletion
+// is attributed to authorID in the room history.
+// This is useful for a "Clear Canvas" feature.
+func (s *ShapeRepository) DeleteShapesByRoomID(roomID, authorID uuid.UUID) (int64, error) {
+	if roomID == uuid.Nil {
+		return 0, errors.New("cannot delete shapes without a room ID")
+	}
+
+	var sequence int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Note: This won't return an error if 0 rows are affected (i.e., the canvas was already empty).
+		var deleted []Shape
+		result := tx.Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("room_id = ?", roomID).Delete(&deleted)
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete all shapes for room %s: %w", roomID, result.Error)
+		}
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		for _, shape := range deleted {
+			history.deleted(shape.ID)
+		}
+		return history.save(tx)
+	})
+	return sequence, err
+}
+
+type LayerRepository struct {
+	db *gorm.DB
+}
+
+func NewLayerRepository(db *gorm.DB) *LayerRepository {
+	return &LayerRepository{db: db}
+}
+
+// GetLayersByRoomID returns the named layers of a room, bottom to top.
+func (l *LayerRepository) GetLayersByRoomID(roomID uuid.UUID) ([]Layer, error) {
+	var layers []Layer
+	result := l.db.Where("room_id = ?", roomID).Order(zIndexOrder + " ASC").Find(&layers)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get layers for room %s: %w", roomID, result.Error)
+	}
+	return layers, nil
+}
+
+// CreateLayer adds a visible layer on top of the existing ones.
+func (l *LayerRepository) CreateLayer(roomID uuid.UUID, name string) (*Layer, int64, error) {
+	layer := &Layer{RoomID: roomID, Name: name, Visible: true}
+	var sequence int64
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		var keys []string
+		if err := tx.Model(&Layer{}).Where("room_id = ?", roomID).Order(zIndexOrder+" DESC").Limit(1).Pluck("z_index", &keys).Error; err != nil {
+			return fmt.Errorf("failed to read layer order for room %s: %w", roomID, err)
+		}
+		top := ""
+		if len(keys) > 0 {
+			top = keys[0]
+		}
+		if layer.ZIndex, err = ZIndexBetween(top, ""); err != nil {
+			return err
+		}
+		if err := tx.Create(layer).Error; err != nil {
+			return fmt.Errorf("failed to create layer in room %s: %w", roomID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return layer, sequence, nil
+}
+
+// UpdateLayer renames a layer and/or toggles its visibility. Nil arguments
+// are left unchanged.
+func (l *LayerRepository) UpdateLayer(roomID, layerID uuid.UUID, name *string, visible *bool) (*Layer, int64, error) {
+	updates := map[string]interface{}{}
+	if name != nil {
+		updates["name"] = *name
+	}
+	if visible != nil {
+		updates["visible"] = *visible
+	}
+	if len(updates) == 0 {
+		return nil, 0, errors.New("nothing to update")
+	}
+
+	var layer Layer
+	var sequence int64
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		result := tx.Model(&layer).Clauses(clause.Returning{}).Where("id = ? AND room_id = ?", layerID, roomID).Updates(updates)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update layer %s: %w", layerID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("layer %s not found in room %s", layerID, roomID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &layer, sequence, nil
+}
+
+// DeleteLayer removes a layer. Its shapes move on top of the base layer, in
+// the order they had, which is attributed to authorID in the room history. It
+// returns the moved shapes with their new z-index.
+func (l *LayerRepository) DeleteLayer(roomID, layerID, authorID uuid.UUID) ([]Shape, int64, error) {
+	var shapes []Shape
+	var sequence int64
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		if err := tx.Select("id", "room_id", "layer_id", "z_index").Where("room_id = ? AND layer_id = ?", roomID, layerID).
+			Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+			return fmt.Errorf("failed to get shapes of layer %s: %w", layerID, err)
+		}
+		if err := moveShapesToLayer(tx, shapes, nil); err != nil {
+			return err
+		}
+		result := tx.Where("id = ? AND room_id = ?", layerID, roomID).Delete(&Layer{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete layer %s: %w", layerID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("layer %s not found in room %s", layerID, roomID)
+		}
+		shapeIDs := make([]uuid.UUID, len(shapes))
+		for i := range shapes {
+			shapeIDs[i] = shapes[i].ID
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.reload(tx, shapeIDs); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return shapes, sequence, nil
+}
+
+// moveShapesToLayer puts shapes, given in paint order, on top of the layer
+// given by layerID, or the base layer when it is nil, keeping their order.
+func moveShapesToLayer(tx *gorm.DB, shapes []Shape, layerID *uuid.UUID) error {
+	for i := range shapes {
+		shapes[i].LayerID = layerID
+		if err := placeOnTop(tx, &shapes[i]); err != nil {
+			return err
+		}
+		err := tx.Model(&Shape{}).Where("id = ?", shapes[i].ID).
+			Updates(map[string]interface{}{"layer_id": layerID, "z_index": shapes[i].ZIndex}).Error
+		if err != nil {
+			return fmt.Errorf("failed to move shape %s: %w", shapes[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// AssignShapesToLayer moves shapes onto a layer (nil for the base layer),
+// stacking them on top of it in their current paint order. It returns the
+// moved shapes with their new z-order keys. The move is attributed to
+// authorID in the room history.
+func (l *LayerRepository) AssignShapesToLayer(roomID, authorID uuid.UUID, layerID *uuid.UUID, shapeIDs []uuid.UUID) ([]Shape, int64, error) {
+	var shapes []Shape
+	var sequence int64
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		if err := tx.Select("id", "room_id", "layer_id", "z_index").Where("room_id = ? AND id IN ?", roomID, shapeIDs).
+			Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+			return fmt.Errorf("failed to get shapes to move: %w", err)
+		}
+		if len(shapes) != len(shapeIDs) {
+			return fmt.Errorf("only %d of %d shapes to move exist in room %s", len(shapes), len(shapeIDs), roomID)
+		}
+		if err := moveShapesToLayer(tx, shapes, layerID); err != nil {
+			return err
+		}
+		history := newShapeHistory(roomID, sequence, authorID)
+		if err := history.reload(tx, shapeIDs); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return shapes, sequence, nil
+}
+
+type SnapshotRepository struct {
+	db *gorm.DB
+}
+
+func NewSnapshotRepository(db *gorm.DB) *SnapshotRepository {
+	return &SnapshotRepository{db: db}
+}
+
+// snapshotFormat versions the serialized shapes of a snapshot. Bump it when
+// Shape gains fields so that older snapshots are rebuilt instead of served.
+// Format 2 snapshots were compacted after shape events were recorded for
+// every change, so those events can bring them up to date.
+const snapshotFormat = 2
+
+// GetSnapshot returns the shapes of a room as of its current sequence. A
+// stale snapshot is served with the shape events recorded since it was
+// compacted applied on top, and the number of events applied is returned so
+// the caller can have it compacted again. Only a missing snapshot, or one of
+// an older format, is rebuilt before returning.
+func (s *SnapshotRepository) GetSnapshot(roomID uuid.UUID) (*RoomSnapshot, int, error) {
+	var snapshot RoomSnapshot
+	var events []ShapeEvent
+	var layers []Layer
+	found := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("room_id = ? AND format = ?", roomID, snapshotFormat).Limit(1).Find(&snapshot)
+		if result.Error != nil {
+			return fmt.Errorf("failed to get snapshot for room %s: %w", roomID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		found = true
+		var room Room
+		if err := tx.Select("id", "sequence").First(&room, "id = ?", roomID).Error; err != nil {
+			return fmt.Errorf("failed to read sequence for room %s: %w", roomID, err)
+		}
+		if room.Sequence <= snapshot.Sequence {
+			return nil
+		}
+		if err := tx.Where("room_id = ? AND sequence > ? AND sequence <= ?", roomID, snapshot.Sequence, room.Sequence).
+			Order("sequence, id").Find(&events).Error; err != nil {
+			return fmt.Errorf("failed to read shape events for room %s: %w", roomID, err)
+		}
+		if len(events) > 0 {
+			if err := tx.Where("room_id = ?", roomID).Find(&layers).Error; err != nil {
+				return fmt.Errorf("failed to get layers for room %s: %w", roomID, err)
+			}
+		}
+		// Sequences without shape events only changed layers.
+		snapshot.Sequence = room.Sequence
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		rebuilt, err := s.RebuildSnapshot(roomID)
+		return rebuilt, 0, err
+	}
+	if len(events) == 0 {
+		return &snapshot, 0, nil
+	}
+
+	var shapes []Shape
+	if err := json.Unmarshal(snapshot.Shapes, &shapes); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode snapshot for room %s: %w", roomID, err)
+	}
+	shapes, err = applyShapeEvents(shapes, events, layers)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to update snapshot for room %s: %w", roomID, err)
+	}
+	data, err := json.Marshal(shapes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to serialize shapes for room %s: %w", roomID, err)
+	}
+	snapshot.Shapes = data
+	snapshot.ShapeCount = len(shapes)
+	return &snapshot, len(events), nil
+}
+
+// applyShapeEvents replays events, in order, on shapes and returns the
+// result in paint order, see shapePaintOrder.
+func applyShapeEvents(shapes []Shape, events []ShapeEvent, layers []Layer) ([]Shape, error) {
+	index := make(map[uuid.UUID]int, len(shapes))
+	for i := range shapes {
+		index[shapes[i].ID] = i
+	}
+	deleted := make(map[uuid.UUID]bool)
+	for _, event := range events {
+		if event.Op == ShapeOpDelete {
+			deleted[event.ShapeID] = true
+			continue
+		}
+		var shape Shape
+		if err := json.Unmarshal(event.Shape, &shape); err != nil {
+			return nil, fmt.Errorf("invalid shape event %d: %w", event.ID, err)
+		}
+		delete(deleted, event.ShapeID)
+		if i, ok := index[event.ShapeID]; ok {
+			shapes[i] = shape
+		} else {
+			index[event.ShapeID] = len(shapes)
+			shapes = append(shapes, shape)
+		}
+	}
+	shapes = slices.DeleteFunc(shapes, func(shape Shape) bool { return deleted[shape.ID] })
+
+	layerZ := make(map[uuid.UUID]string, len(layers))
+	for _, layer := range layers {
+		layerZ[layer.ID] = layer.ZIndex
+	}
+	layerKey := func(shape Shape) (string, bool) {
+		if shape.LayerID == nil {
+			return "", false
+		}
+		z, ok := layerZ[*shape.LayerID]
+		return z, ok
+	}
+	slices.SortStableFunc(shapes, func(a, b Shape) int {
+		az, aLayered := layerKey(a)
+		bz, bLayered := layerKey(b)
+		if aLayered != bLayered {
+			if aLayered {
+				return 1 // Shapes outside of layers paint first
+			}
+			return -1
+		}
+		if c := strings.Compare(az, bz); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.ZIndex, b.ZIndex); c != 0 {
+			return c
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return shapes, nil
+}
+
+// RebuildSnapshot compacts the current shapes of a room into a new snapshot
+// and stores it, unless a newer snapshot was stored in the meantime.
+func (s *SnapshotRepository) RebuildSnapshot(roomID uuid.UUID) (*RoomSnapshot, error) {
+	snapshot := RoomSnapshot{RoomID: roomID, Format: snapshotFormat}
+
+	// Read the sequence and the shapes from the same database snapshot so they
+	// describe exactly the same state of the room.
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var room Room
+		if err := tx.Select("id", "sequence").First(&room, "id = ?", roomID).Error; err != nil {
+			return fmt.Errorf("failed to read sequence for room %s: %w", roomID, err)
+		}
+		var shapes []Shape
+		if err := tx.Where("room_id = ?", roomID).Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+			return fmt.Errorf("failed to get shapes for room %s: %w", roomID, err)
+		}
+		data, err := json.Marshal(shapes)
+		if err != nil {
+			return fmt.Errorf("failed to serialize shapes for room %s: %w", roomID, err)
+		}
+		snapshot.Sequence = room.Sequence
+		snapshot.ShapeCount = len(shapes)
+		snapshot.Shapes = data
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "room_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"sequence", "shape_count", "format", "shapes", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "room_snapshots.sequence < excluded.sequence OR room_snapshots.format < excluded.format"},
+		}},
+	}).Create(&snapshot)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to store snapshot for room %s: %w", roomID, result.Error)
+	}
+	return &snapshot, nil
+}
+
+type AssetRepository struct {
+	db *gorm.DB
+}
+
+func NewAssetRepository(db *gorm.DB) *AssetRepository {
+	return &AssetRepository{db: db}
+}
+
+// CreateAsset records an uploaded file. The file must already be stored.
+func (a *AssetRepository) CreateAsset(asset *Asset) error {
+	if err := a.db.Create(asset).Error; err != nil {
+		return fmt.Errorf("failed to create asset %s: %w", asset.ID, err)
+	}
+	return nil
+}
+
+// GetAsset retrieves an asset of a room. Assets of other rooms are not found.
+func (a *AssetRepository) GetAsset(roomID, assetID uuid.UUID) (*Asset, error) {
+	var asset Asset
+	if err := a.db.Where("id = ? AND room_id = ?", assetID, roomID).First(&asset).Error; err != nil {
+		return nil, fmt.Errorf("failed to get asset %s in room %s: %w", assetID, roomID, err)
+	}
+	return &asset, nil
+}
+
+// GetShapeAssets returns the assets shown by images of a room.
+func (a *AssetRepository) GetShapeAssets(roomID uuid.UUID) ([]Asset, error) {
+	var assets []Asset
+	err := a.db.Where("room_id = ? AND EXISTS (SELECT 1 FROM shapes WHERE shapes.asset_id = assets.id AND shapes.room_id = ?)", roomID, roomID).
+		Find(&assets).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get assets of room %s: %w", roomID, err)
+	}
+	return assets, nil
+}
+
+// DeleteUnusedAssets deletes the assets created before cutoff that were never
+// drawn and that no saved version shows, and returns them so their files can
+// be removed. The cutoff leaves time to draw a freshly uploaded image. An
+// image that was drawn stays in the room history even once erased, where
+// undo and replay still need its asset, so it is kept with the room.
+func (a *AssetRepository) DeleteUnusedAssets(cutoff time.Time) ([]Asset, error) {
+	var deleted []Asset
+	err := a.db.Clauses(clause.Returning{}).
+		Where("created_at < ? AND NOT EXISTS (SELECT 1 FROM shapes WHERE shapes.asset_id = assets.id) "+
+			"AND NOT EXISTS (SELECT 1 FROM shape_events WHERE "+shapeEventAssetExpr+" = assets.id::text) "+
+			"AND NOT EXISTS (SELECT 1 FROM version_assets WHERE version_assets.asset_id = assets.id)", cutoff).
+		Delete(&deleted).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete unused assets: %w", err)
+	}
+	return deleted, nil
+}
+
+// shapeEventAssetExpr is the indexed asset of the shape recorded by a shape
+// event.
+const shapeEventAssetExpr = "(shape->>'assetId')"
+
+type VersionRepository struct {
+	db *gorm.DB
+}
+
+func NewVersionRepository(db *gorm.DB) *VersionRepository {
+	return &VersionRepository{db: db}
+}
+
+// MaxVersionNameLength is the longest version name, in characters.
+const MaxVersionNameLength = 100
+
+// ErrVersionNotFound is returned for a version that doesn't exist in the room.
+var ErrVersionNotFound = errors.New("version not found")
+
+// SaveVersion stores a named copy of every shape and layer of a room.
+func (v *VersionRepository) SaveVersion(roomID, creatorID uuid.UUID, name string) (*CanvasVersion, error) {
+	var version *CanvasVersion
+	// Read the sequence, shapes and layers from the same database snapshot so
+	// they describe exactly the same state of the room.
+	err := v.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		version, err = saveVersion(tx, roomID, creatorID, name)
+		return err
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// saveVersion copies the current shapes and layers of a room into a new
+// version inside tx.
+func saveVersion(tx *gorm.DB, roomID, creatorID uuid.UUID, name string) (*CanvasVersion, error) {
+	var room Room
+	if err := tx.Select("id", "sequence").First(&room, "id = ?", roomID).Error; err != nil {
+		return nil, fmt.Errorf("failed to read sequence for room %s: %w", roomID, err)
+	}
+	var shapes []Shape
+	if err := tx.Where("room_id = ?", roomID).Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get shapes for room %s: %w", roomID, err)
+	}
+	var layers []Layer
+	if err := tx.Where("room_id = ?", roomID).Order(zIndexOrder + " ASC").Find(&layers).Error; err != nil {
+		return nil, fmt.Errorf("failed to get layers for room %s: %w", roomID, err)
+	}
+	shapeData, err := json.Marshal(shapes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize shapes for room %s: %w", roomID, err)
+	}
+	layerData, err := json.Marshal(layers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize layers for room %s: %w", roomID, err)
+	}
+
+	version := &CanvasVersion{
+		ID:         uuid.New(),
+		RoomID:     roomID,
+		CreatorID:  &creatorID,
+		Name:       name,
+		Sequence:   room.Sequence,
+		ShapeCount: len(shapes),
+		Format:     snapshotFormat,
+		Shapes:     shapeData,
+		Layers:     layerData,
+	}
+	if err := tx.Create(version).Error; err != nil {
+		return nil, fmt.Errorf("failed to save version of room %s: %w", roomID, err)
+	}
+	var assets []VersionAsset
+	seen := make(map[uuid.UUID]bool)
+	for _, shape := range shapes {
+		if shape.AssetID != nil && !seen[*shape.AssetID] {
+			seen[*shape.AssetID] = true
+			assets = append(assets, VersionAsset{VersionID: version.ID, AssetID: *shape.AssetID})
+		}
+	}
+	if len(assets) > 0 {
+		if err := tx.Create(&assets).Error; err != nil {
+			return nil, fmt.Errorf("failed to record assets of version %s: %w", version.ID, err)
+		}
+	}
+	return version, nil
+}
+
+// GetVersions lists the versions of a room, newest first, without their
+// contents.
+func (v *VersionRepository) GetVersions(roomID uuid.UUID) ([]CanvasVersion, error) {
+	var versions []CanvasVersion
+	err := v.db.Omit("shapes", "layers").Where("room_id = ?", roomID).Order("created_at DESC").Find(&versions).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions for room %s: %w", roomID, err)
+	}
+	return versions, nil
+}
+
+// GetVersion retrieves a version of a room with its contents.
+func (v *VersionRepository) GetVersion(roomID, versionID uuid.UUID) (*CanvasVersion, error) {
+	var version CanvasVersion
+	result := v.db.Where("id = ? AND room_id = ?", versionID, roomID).Limit(1).Find(&version)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get version %s: %w", versionID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrVersionNotFound
+	}
+	return &version, nil
+}
+
+// DeleteVersion deletes a version of a room. Its assets are released to
+// DeleteUnusedAssets.
+func (v *VersionRepository) DeleteVersion(roomID, versionID uuid.UUID) error {
+	result := v.db.Where("id = ? AND room_id = ?", versionID, roomID).Delete(&CanvasVersion{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete version %s: %w", versionID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionNotFound
+	}
+	return nil
+}
+
+// RestoreVersion replaces every shape and layer of a room with those of a
+// version. The state being replaced is first saved as a version of its own,
+// attributed to userID, so a restore can always be undone by restoring that
+// backup. It returns the backup, the restored shapes in paint order and
+// layers, and the room sequence the restore was recorded at.
+func (v *VersionRepository) RestoreVersion(roomID, versionID, userID uuid.UUID) (*CanvasVersion, []Shape, []Layer, int64, error) {
+	var backup *CanvasVersion
+	var shapes []Shape
+	var layers []Layer
+	var sequence int64
+	err := v.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		// Bumping the sequence first locks the room against other shape
+		// operations until the restore commits.
+		if sequence, err = bumpRoomSequence(tx, roomID); err != nil {
+			return err
+		}
+		var version CanvasVersion
+		result := tx.Where("id = ? AND room_id = ?", versionID, roomID).Limit(1).Find(&version)
+		if result.Error != nil {
+			return fmt.Errorf("failed to get version %s: %w", versionID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrVersionNotFound
+		}
+		if shapes, layers, err = version.Contents(); err != nil {
+			return err
+		}
+
+		name := []rune("Before restoring " + version.Name)
+		if len(name) > MaxVersionNameLength {
+			name = name[:MaxVersionNameLength]
+		}
+		if backup, err = saveVersion(tx, roomID, userID, string(name)); err != nil {
+			return err
+		}
+		var cleared []Shape
+		if err := tx.Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("room_id = ?", roomID).Delete(&cleared).Error; err != nil {
+			return fmt.Errorf("failed to clear shapes of room %s: %w", roomID, err)
+		}
+		if err := tx.Where("room_id = ?", roomID).Delete(&Layer{}).Error; err != nil {
+			return fmt.Errorf("failed to clear layers of room %s: %w", roomID, err)
+		}
+		for i := range layers {
+			layers[i].RoomID = roomID
+		}
+		if len(layers) > 0 {
+			if err := tx.Create(&layers).Error; err != nil {
+				return fmt.Errorf("failed to restore layers of room %s: %w", roomID, err)
+			}
+		}
+		for i := range shapes {
+			shapes[i].RoomID = roomID
+			// Versions saved before a shape field existed get its default.
+			if err := shapes[i].Validate(); err != nil {
+				return fmt.Errorf("shape %s: %w", shapes[i].ID, err)
+			}
+			if err := shapes[i].ComputeBounds(); err != nil {
+				return err
+			}
+		}
+		if len(shapes) > 0 {
+			if err := tx.CreateInBatches(&shapes, 500).Error; err != nil {
+				return fmt.Errorf("failed to restore shapes of room %s: %w", roomID, err)
+			}
+		}
+		history := newShapeHistory(roomID, sequence, userID)
+		for _, shape := range cleared {
+			history.deleted(shape.ID)
+		}
+		if err := history.add(ShapeOpCreate, shapes...); err != nil {
+			return err
+		}
+		return history.save(tx)
+	})
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	return backup, shapes, layers, sequence, nil
+}
+
+// Contents decodes the shapes, in paint order, and layers of a version.
+func (c *CanvasVersion) Contents() ([]Shape, []Layer, error) {
+	shapes, layers, err := decodeCanvas(c.Shapes, c.Layers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode version %s: %w", c.ID, err)
+	}
+	return shapes, layers, nil
+}
+
+// decodeCanvas decodes shapes and layers serialized as JSON arrays.
+func decodeCanvas(shapeData, layerData []byte) ([]Shape, []Layer, error) {
+	var shapes []Shape
+	if err := json.Unmarshal(shapeData, &shapes); err != nil {
+		return nil, nil, fmt.Errorf("invalid shapes: %w", err)
+	}
+	var layers []Layer
+	if len(layerData) > 0 {
+		if err := json.Unmarshal(layerData, &layers); err != nil {
+			return nil, nil, fmt.Errorf("invalid layers: %w", err)
+		}
+	}
+	return shapes, layers, nil
+}
+
+type HistoryRepository struct {
+	db *gorm.DB
+}
+
+func NewHistoryRepository(db *gorm.DB) *HistoryRepository {
+	return &HistoryRepository{db: db}
+}
+
+// GetShapesAt returns the shapes of a room as they were just before at,
+// rebuilt from the room history, bottom to top within each layer. Shapes
+// changed only before history was recorded are missing.
+func (h *HistoryRepository) GetShapesAt(roomID uuid.UUID, at time.Time) ([]Shape, error) {
+	var events []ShapeEvent
+	err := h.db.Raw(`SELECT * FROM (
+			SELECT DISTINCT ON (shape_id) * FROM shape_events
+			WHERE room_id = ? AND created_at < ?
+			ORDER BY shape_id, sequence DESC, id DESC
+		) latest WHERE op <> ?`, roomID, at, ShapeOpDelete).Scan(&events).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of room %s: %w", roomID, err)
+	}
+	shapes := make([]Shape, len(events))
+	for i := range events {
+		if err := json.Unmarshal(events[i].Shape, &shapes[i]); err != nil {
+			return nil, fmt.Errorf("invalid history event %d of room %s: %w", events[i].ID, roomID, err)
+		}
+	}
+	slices.SortStableFunc(shapes, func(a, b Shape) int {
+		if c := strings.Compare(a.ZIndex, b.ZIndex); c != 0 {
+			return c
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return shapes, nil
+}
+
+// GetEvents returns up to limit events of a room made in [from, to), in the
+// order they were applied, starting after the event given by afterSequence
+// and afterID (zero for the first page). Authors are preloaded.
+func (h *HistoryRepository) GetEvents(roomID uuid.UUID, from, to time.Time, afterSequence, afterID int64, limit int) ([]ShapeEvent, error) {
+	var events []ShapeEvent
+	result := h.db.Preload("Author").
+		Where("room_id = ? AND created_at >= ? AND created_at < ?", roomID, from, to).
+		Where("(sequence, id) > (?, ?)", afterSequence, afterID).
+		Order("sequence ASC, id ASC").Limit(limit).Find(&events)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to read history of room %s: %w", roomID, result.Error)
+	}
+	return events, nil
+}
+
+// GetSequenceEvents returns the events of a room made at one room sequence,
+// in the order they were applied.
+func (h *HistoryRepository) GetSequenceEvents(roomID uuid.UUID, sequence int64) ([]ShapeEvent, error) {
+	var events []ShapeEvent
+	result := h.db.Where("room_id = ? AND sequence = ?", roomID, sequence).Order("id ASC").Find(&events)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to read events %d of room %s: %w", sequence, roomID, result.Error)
+	}
+	return events, nil
+}
+
+type TemplateRepository struct {
+	db *gorm.DB
+}
+
+func NewTemplateRepository(db *gorm.DB) *TemplateRepository {
+	return &TemplateRepository{db: db}
+}
+
+// Limits on template names and descriptions, in characters.
+const (
+	MaxTemplateNameLength        = 100
+	MaxTemplateDescriptionLength = 500
+)
+
+// ErrTemplateNotFound is returned for a template that doesn't exist.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// PublishTemplate saves the canvas of a room as template, which needs its
+// CreatorID, Name and Description set. Shapes and layers get fresh IDs, and
+// images show the template asset copies given by assets, keyed by the ID of
+// the room asset; their files must already be stored.
+func (t *TemplateRepository) PublishTemplate(template *RoomTemplate, roomID uuid.UUID, assets map[uuid.UUID]TemplateAsset) error {
+	return t.db.Transaction(func(tx *gorm.DB) error {
+		var shapes []Shape
+		if err := tx.Where("room_id = ?", roomID).Order(shapePaintOrder).Find(&shapes).Error; err != nil {
+			return fmt.Errorf("failed to get shapes for room %s: %w", roomID, err)
+		}
+		var layers []Layer
+		if err := tx.Where("room_id = ?", roomID).Order(zIndexOrder + " ASC").Find(&layers).Error; err != nil {
+			return fmt.Errorf("failed to get layers for room %s: %w", roomID, err)
+		}
+		assetIDs := make(map[uuid.UUID]uuid.UUID, len(assets))
+		for original, asset := range assets {
+			assetIDs[original] = asset.ID
+		}
+		shapes, layers = CopyCanvas(uuid.Nil, shapes, layers, assetIDs)
+
+		var err error
+		if template.Shapes, err = json.Marshal(shapes); err != nil {
+			return fmt.Errorf("failed to serialize shapes for room %s: %w", roomID, err)
+		}
+		if template.Layers, err = json.Marshal(layers); err != nil {
+			return fmt.Errorf("failed to serialize layers for room %s: %w", roomID, err)
+		}
+		template.ID = uuid.New()
+		template.ShapeCount = len(shapes)
+		template.Format = snapshotFormat
+		if err := tx.Omit(clause.Associations).Create(template).Error; err != nil {
+			return fmt.Errorf("failed to publish template of room %s: %w", roomID, err)
+		}
+		for _, asset := range assets {
+			asset.TemplateID = template.ID
+			if err := tx.Omit(clause.Associations).Create(&asset).Error; err != nil {
+				return fmt.Errorf("failed to record asset %s of template %s: %w", asset.ID, template.ID, err)
+			}
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+}
+
+// GetTemplates lists templates without their contents, newest first. A
+// non-empty query keeps those whose name or description contains it,
+// ignoring case.
+func (t *TemplateRepository) GetTemplates(query string, limit, offset int) ([]RoomTemplate, error) {
+	templates := []RoomTemplate{}
+	db := t.db.Omit("shapes", "layers")
+	if query != "" {
+		pattern := "%" + escapeLike(query) + "%"
+		db = db.Where("name ILIKE ? OR description ILIKE ?", pattern, pattern)
+	}
+	if err := db.Order("created_at DESC").Limit(limit).Offset(offset).Find(&templates).Error; err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	return templates, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// GetTemplate retrieves a template with its contents and assets.
+func (t *TemplateRepository) GetTemplate(templateID uuid.UUID) (*RoomTemplate, error) {
+	var template RoomTemplate
+	result := t.db.Preload("Assets").Where("id = ?", templateID).Limit(1).Find(&template)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get template %s: %w", templateID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrTemplateNotFound
+	}
+	return &template, nil
+}
+
+// DeleteTemplate deletes a template and returns its assets so their files
+// can be removed.
+func (t *TemplateRepository) DeleteTemplate(templateID uuid.UUID) ([]TemplateAsset, error) {
+	var assets []TemplateAsset
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("template_id = ?", templateID).Find(&assets).Error; err != nil {
+			return fmt.Errorf("failed to get assets of template %s: %w", templateID, err)
+		}
+		result := tx.Where("id = ?", templateID).Delete(&RoomTemplate{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete template %s: %w", templateID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrTemplateNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+// ApplyTemplate copies the canvas of a template into an empty room, as a
+// change by authorID. Images show the room assets given by assets, keyed by
+// the template asset ID; their files must already be stored. It returns the
+// number of shapes copied.
+func (t *TemplateRepository) ApplyTemplate(roomID, templateID, authorID uuid.UUID, assets map[uuid.UUID]Asset) (int, error) {
+	var copied int
+	err := t.db.Transaction(func(tx *gorm.DB) error {
+		var template RoomTemplate
+		result := tx.Where("id = ?", templateID).Limit(1).Find(&template)
+		if result.Error != nil {
+			return fmt.Errorf("failed to get template %s: %w", templateID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrTemplateNotFound
+		}
+		shapes, layers, err := decodeCanvas(template.Shapes, template.Layers)
+		if err != nil {
+			return fmt.Errorf("failed to decode template %s: %w", templateID, err)
+		}
+		assetIDs := make(map[uuid.UUID]uuid.UUID, len(assets))
+		for original, asset := range assets {
+			asset.RoomID = roomID
+			asset.UploaderID = authorID
+			if err := tx.Omit(clause.Associations).Create(&asset).Error; err != nil {
+				return fmt.Errorf("failed to copy template asset %s: %w", original, err)
+			}
+			assetIDs[original] = asset.ID
+		}
+		shapes, layers = CopyCanvas(roomID, shapes, layers, assetIDs)
+		for i := range shapes {
+			shapes[i].CreatorID = authorID
+			// Templates saved before a shape field existed get its default.
+			if err := shapes[i].Validate(); err != nil {
+				return fmt.Errorf("shape %s: %w", shapes[i].ID, err)
+			}
+		}
+		copied = len(shapes)
+		return insertCanvas(tx, roomID, authorID, shapes, layers)
+	})
+	return copied, err
+}
+
+type ShareLinkRepository struct {
+	db *gorm.DB
+}
+
+func NewShareLinkRepository(db *gorm.DB) *ShareLinkRepository {
+	return &ShareLinkRepository{db: db}
+}
+
+// ErrShareLinkNotFound is returned for a link that doesn't exist in the room.
+var ErrShareLinkNotFound = errors.New("share link not found")
+
+// hashShareToken returns the hash a share link token is stored as.
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateShareLink creates a link to a room and returns it with its token,
+// which cannot be recovered later. expiresAt and maxUses are optional.
+func (s *ShareLinkRepository) CreateShareLink(roomID, creatorID uuid.UUID, role ShareRole, expiresAt *time.Time, maxUses *int) (*ShareLink, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("failed to generate share token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	link := &ShareLink{
+		ID:        uuid.New(),
+		RoomID:    roomID,
+		CreatorID: &creatorID,
+		TokenHash: hashShareToken(token),
+		Role:      role,
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses,
+	}
+	if err := s.db.Omit(clause.Associations).Create(link).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to create share link for room %s: %w", roomID, err)
+	}
+	return link, token, nil
+}
+
+// GetShareLinks lists the links of a room, newest first, revoked and expired
+// ones included.
+func (s *ShareLinkRepository) GetShareLinks(roomID uuid.UUID) ([]ShareLink, error) {
+	links := []ShareLink{}
+	if err := s.db.Where("room_id = ?", roomID).Order("created_at DESC").Find(&links).Error; err != nil {
+		return nil, fmt.Errorf("failed to list share links of room %s: %w", roomID, err)
+	}
+	return links, nil
+}
+
+// RevokeShareLink stops a link from being used. Revoking a link twice is not
+// an error.
+func (s *ShareLinkRepository) RevokeShareLink(roomID, linkID uuid.UUID) error {
+	result := s.db.Model(&ShareLink{}).Where("id = ? AND room_id = ?", linkID, roomID).
+		Update("revoked_at", gorm.Expr("COALESCE(revoked_at, now())"))
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke share link %s: %w", linkID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareLinkNotFound
+	}
+	return nil
+}
+
+// liveShareLink scopes a query to the link of a room with the given token,
+// if it is neither revoked nor expired.
+func liveShareLink(db *gorm.DB, roomID uuid.UUID, token string) *gorm.DB {
+	return db.Model(&ShareLink{}).
+		Where("token_hash = ? AND room_id = ? AND revoked_at IS NULL", hashShareToken(token), roomID).
+		Where("expires_at IS NULL OR expires_at > now()")
+}
+
+// usableShareLink scopes a query to the live link of a room with the given
+// token that userID may use: one the user has redeemed before, or one that is
+// not used up.
+func usableShareLink(db *gorm.DB, roomID, userID uuid.UUID, token string) *gorm.DB {
+	return liveShareLink(db, roomID, token).
+		Where("max_uses IS NULL OR uses < max_uses OR EXISTS (SELECT 1 FROM share_link_redemptions WHERE link_id = share_links.id AND user_id = ?)", userID)
+}
+
+// RedeemShareLink lets userID join a room with the link of the given token
+// and returns the ID of the link and the role it gives, or
+// ErrShareLinkNotFound if the token is unknown, revoked, expired or used up.
+// Only a user's first redemption of a link uses it up.
+func (s *ShareLinkRepository) RedeemShareLink(roomID, userID uuid.UUID, token string) (uuid.UUID, ShareRole, error) {
+	var link ShareLink
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var links []ShareLink
+		if err := usableShareLink(tx, roomID, userID, token).Select("id", "role").Limit(1).Find(&links).Error; err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			return ErrShareLinkNotFound
+		}
+		link = links[0]
+
+		redemption := ShareLinkRedemption{LinkID: link.ID, UserID: userID}
+		result := tx.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(&redemption)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		// The link may have been used up since it was read.
+		result = tx.Model(&ShareLink{}).Where("id = ? AND (max_uses IS NULL OR uses < max_uses)", link.ID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error == nil && result.RowsAffected == 0 {
+			return ErrShareLinkNotFound
+		}
+		return result.Error
+	})
+	if errors.Is(err, ErrShareLinkNotFound) {
+		return uuid.Nil, "", err
+	}
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("failed to redeem share link for room %s: %w", roomID, err)
+	}
+	return link.ID, link.Role, nil
+}
+
+// CheckShareLink returns the role the link of a room with the given token
+// gives userID without using it up, or ErrShareLinkNotFound if userID can't
+// use it.
+func (s *ShareLinkRepository) CheckShareLink(roomID, userID uuid.UUID, token string) (ShareRole, error) {
+	var links []ShareLink
+	if err := usableShareLink(s.db, roomID, userID, token).Select("role").Limit(1).Find(&links).Error; err != nil {
+		return "", fmt.Errorf("failed to check share link for room %s: %w", roomID, err)
+	}
+	if len(links) == 0 {
+		return "", ErrShareLinkNotFound
+	}
+	return links[0].Role, nil
+}
+
+type JoinRequestRepository struct {
+	db *gorm.DB
+}
+
+func NewJoinRequestRepository(db *gorm.DB) *JoinRequestRepository {
+	return &JoinRequestRepository{db: db}
+}
+
+// MaxJoinRequestMessageLength is the longest note a join request can carry,
+// in characters.
+const MaxJoinRequestMessageLength = 200
+
+var (
+	// ErrJoinRequestPending is returned when the user already has a pending
+	// request for the room.
+	ErrJoinRequestPending = errors.New("a join request is already pending")
+	// ErrJoinRequestNotFound is returned for a request that doesn't exist in
+	// the room or was already decided.
+	ErrJoinRequestNotFound = errors.New("join request not found")
+)
+
+// CreateJoinRequest records a pending request of a user to join a room.
+func (j *JoinRequestRepository) CreateJoinRequest(roomID, userID uuid.UUID, message string) (*JoinRequest, error) {
+	request := &JoinRequest{ID: uuid.New(), RoomID: roomID, UserID: userID, Message: message, Status: JoinRequestPending}
+	result := j.db.Omit(clause.Associations).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "room_id"}, {Name: "user_id"}},
+		// The predicate of a partial index must be spelled out, not bound.
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "status = 'pending'"}}},
+		DoNothing:   true,
+	}).Create(request)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to create join request for room %s: %w", roomID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrJoinRequestPending
+	}
+	return request, nil
+}
+
+// GetPendingJoinRequests lists the pending requests to join a room, oldest
+// first, with the users who made them.
+func (j *JoinRequestRepository) GetPendingJoinRequests(roomID uuid.UUID) ([]JoinRequest, error) {
+	requests := []JoinRequest{}
+	err := j.db.Preload("User").Where("room_id = ? AND status = ?", roomID, JoinRequestPending).
+		Order("created_at ASC").Find(&requests).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list join requests of room %s: %w", roomID, err)
+	}
+	return requests, nil
+}
+
+// DecideJoinRequest approves or denies a pending request on behalf of
+// deciderID. Approving it makes the user a member of the room.
+func (j *JoinRequestRepository) DecideJoinRequest(roomID, requestID, deciderID uuid.UUID, approve bool) (*JoinRequest, error) {
+	status := JoinRequestDenied
+	if approve {
+		status = JoinRequestApproved
+	}
+	var requests []JoinRequest
+	err := j.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&requests).Clauses(clause.Returning{}).
+			Where("id = ? AND room_id = ? AND status = ?", requestID, roomID, JoinRequestPending).
+			Updates(map[string]interface{}{"status": status, "decider_id": deciderID, "decided_at": time.Now()})
+		if result.Error != nil {
+			return fmt.Errorf("failed to decide join request %s: %w", requestID, result.Error)
+		}
+		if len(requests) == 0 {
+			return ErrJoinRequestNotFound
+		}
+		if !approve {
+			return nil
+		}
+		member := UserRoom{UserID: requests[0].UserID, RoomID: roomID, Role: string(Member)}
+		if err := tx.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+			return fmt.Errorf("failed to add user %s to room %s: %w", member.UserID, roomID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &requests[0], nil
+}
+
+// InitDB connects to the database, migrates it and sets up the repository
+// instances. The servers call it first thing in main; it exits the process if
+// the database can't be reached or migrated.
+func InitDB() {
+	var err error
+	dsn := "host=postgres user=anant password=supersecret dbname=mydb port=5432 sslmode=disable"
+
+	// Add retry logic for database connection
+	var db *gorm.DB
+	for i := 0; i < 10; i++ {
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err == nil {
+			break
+		}
+		log.Println("Failed to connect to DB, retrying...")
+		time.Sleep(5 * time.Second)
+	}
+
+	if err != nil {
+		log.Fatal("Failed to connect to database after retries:", err)
+	}
+
+	// Enable SQL logging
+	db.Logger = logger.Default.LogMode(logger.Info)
+
+	// Migrate with error checking
+	err = db.AutoMigrate(&User{}, &Room{}, &Message{}, &UserRoom{}, &Layer{}, &Asset{}, &Shape{}, &TextEdit{}, &RoomSnapshot{}, &CanvasVersion{}, &VersionAsset{}, &ShapeEvent{}, &RoomTemplate{}, &TemplateAsset{}, &ShareLink{}, &ShareLinkRedemption{}, &JoinRequest{})
+	if err != nil {
+		log.Fatal("Failed to auto-migrate tables:", err)
+	}
+
+	// Spatial index for viewport queries, see GetShapesInBounds
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_shapes_bounds ON shapes USING gist (" + shapeBoundsExpr + ")").Error
+	if err != nil {
+		log.Fatal("Failed to create shape bounds index:", err)
+	}
+
+	// Assets drawn in the room history, see DeleteUnusedAssets
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_shape_events_asset ON shape_events (" + shapeEventAssetExpr +
+		") WHERE " + shapeEventAssetExpr + " IS NOT NULL").Error
+	if err != nil {
+		log.Fatal("Failed to create shape event asset index:", err)
+	}
+
+	// Trigram similarity makes room search forgiving of typos. Without the
+	// extension, search falls back to substring matches.
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm is not available, room search will only match substrings: %v", err)
+	} else {
+		trigramSearch = true
+	}
+
+	// Rooms created before activity was tracked start from their latest
+	// shape or message.
+	if err := db.Exec(`UPDATE rooms SET last_activity_at = GREATEST(
+		(SELECT max(updated_at) FROM shapes WHERE shapes.room_id = rooms.id),
+		(SELECT max(created_at) FROM messages WHERE messages.room_id = rooms.id))
+		WHERE last_activity_at IS NULL`).Error; err != nil {
+		log.Printf("Failed to backfill room activity: %v", err)
+	}
+
+	if err := NewShapeRepository(db).BackfillBounds(); err != nil {
+		log.Fatal("Failed to backfill shape bounds:", err)
+	}
+	if err := NewShapeRepository(db).BackfillZIndexes(); err != nil {
+		log.Fatal("Failed to backfill shape z-index:", err)
+	}
+
+	// Verify tables exist
+	if !db.Migrator().HasTable(&Message{}) {
+		log.Fatal("Messages table was not created")
+	}
+	if !db.Migrator().HasTable(&UserRoom{}) {
+		log.Fatal("UserRooms table was not created")
+	}
+	if !db.Migrator().HasTable(&Shape{}) {
+		log.Fatal("Shapes table was not created")
+	}
+
+	Db = db
+	UserRepositoryInstance = NewUserRepository(Db)
+	ChatRepositoryInstance = NewChatRepository(Db)
+	// highlight-start
+	ShapeRepositoryInstance = NewShapeRepository(Db)
+	// highlight-end
+	SnapshotRepositoryInstance = NewSnapshotRepository(Db)
+	LayerRepositoryInstance = NewLayerRepository(Db)
+	AssetRepositoryInstance = NewAssetRepository(Db)
+	VersionRepositoryInstance = NewVersionRepository(Db)
+	HistoryRepositoryInstance = NewHistoryRepository(Db)
+	TemplateRepositoryInstance = NewTemplateRepository(Db)
+	ShareLinkRepositoryInstance = NewShareLinkRepository(Db)
+	JoinRequestRepositoryInstance = NewJoinRequestRepository(Db)
+
+	fmt.Println("Database initialized successfully!")
+}
@@ -0,0 +1,663 @@
+package lib
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxDrawioDiagramSize bounds a compressed diagram once inflated.
+const maxDrawioDiagramSize = 64 << 20
+
+// drawioFile is a .drawio file: one diagram per page, each holding its model
+// either as XML or compressed.
+type drawioFile struct {
+	XMLName  xml.Name        `xml:"mxfile"`
+	Host     string          `xml:"host,attr,omitempty"`
+	Diagrams []drawioDiagram `xml:"diagram"`
+}
+
+// drawioDiagram is a page. A compressed page keeps its model in Data as
+// base64 of the raw deflated, URI-encoded model XML.
+type drawioDiagram struct {
+	ID    string       `xml:"id,attr,omitempty"`
+	Name  string       `xml:"name,attr,omitempty"`
+	Model *drawioModel `xml:"mxGraphModel"`
+	Data  string       `xml:",chardata"`
+}
+
+type drawioModel struct {
+	XMLName xml.Name     `xml:"mxGraphModel"`
+	Cells   []drawioCell `xml:"root>mxCell"`
+}
+
+// drawioCell is a vertex, an edge, or one of the root and layer cells the
+// others hang from. Cells with custom properties are wrapped in an object or
+// UserObject element that carries the ID; Inner is the wrapped cell.
+type drawioCell struct {
+	XMLName  xml.Name
+	ID       string          `xml:"id,attr"`
+	Value    string          `xml:"value,attr,omitempty"`
+	Style    string          `xml:"style,attr,omitempty"`
+	Vertex   string          `xml:"vertex,attr,omitempty"`
+	Edge     string          `xml:"edge,attr,omitempty"`
+	Parent   string          `xml:"parent,attr,omitempty"`
+	Source   string          `xml:"source,attr,omitempty"`
+	Target   string          `xml:"target,attr,omitempty"`
+	Geometry *drawioGeometry `xml:"mxGeometry"`
+	Inner    *drawioCell     `xml:"mxCell"`
+}
+
+type drawioGeometry struct {
+	X         float64       `xml:"x,attr,omitempty"`
+	Y         float64       `xml:"y,attr,omitempty"`
+	Width     float64       `xml:"width,attr,omitempty"`
+	Height    float64       `xml:"height,attr,omitempty"`
+	Relative  string        `xml:"relative,attr,omitempty"`
+	As        string        `xml:"as,attr"`
+	Points    []drawioPoint `xml:"mxPoint"`
+	Waypoints *drawioArray  `xml:"Array"`
+}
+
+type drawioArray struct {
+	As     string        `xml:"as,attr"`
+	Points []drawioPoint `xml:"mxPoint"`
+}
+
+type drawioPoint struct {
+	X  float64 `xml:"x,attr"`
+	Y  float64 `xml:"y,attr"`
+	As string  `xml:"as,attr,omitempty"`
+}
+
+// drawioModelRoot parses the root element of a model on its own, since
+// cells may be wrapped in object elements that the mxCell path misses.
+type drawioModelRoot struct {
+	Cells []drawioCell `xml:",any"`
+}
+
+// drawioArrowheads maps draw.io markers to arrowheads. Unknown markers are
+// drawn as triangles.
+var drawioArrowheads = map[string]Arrowhead{
+	"none":        ArrowheadNone,
+	"open":        ArrowheadArrow,
+	"openThin":    ArrowheadArrow,
+	"openAsync":   ArrowheadArrow,
+	"classic":     ArrowheadTriangle,
+	"classicThin": ArrowheadTriangle,
+	"block":       ArrowheadTriangle,
+	"blockThin":   ArrowheadTriangle,
+	"oval":        ArrowheadCircle,
+	"dot":         ArrowheadCircle,
+	"dash":        ArrowheadBar,
+}
+
+var drawioMarkers = map[Arrowhead]string{
+	ArrowheadNone:     "none",
+	ArrowheadArrow:    "open",
+	ArrowheadTriangle: "block",
+	ArrowheadCircle:   "oval",
+	ArrowheadBar:      "dash",
+}
+
+// ExportDrawio encodes shapes, in the given order, as a single page .drawio
+// file, compressing the page when compressed is set. Rectangles and ellipses
+// become vertices; lines, arrows and pencil strokes become edges, with the
+// arrows' bound ends attached to their shapes. Other shapes are returned as
+// unsupported.
+func ExportDrawio(shapes []Shape, compressed bool) ([]byte, []UnsupportedElement, error) {
+	model := drawioModel{Cells: []drawioCell{{ID: "0"}, {ID: "1", Parent: "0"}}}
+	exported := make(map[uuid.UUID]bool, len(shapes))
+	for i := range shapes {
+		exported[shapes[i].ID] = true
+	}
+	var unsupported []UnsupportedElement
+	for i := range shapes {
+		cell, err := drawioFromShape(&shapes[i], exported)
+		if err != nil {
+			unsupported = append(unsupported, UnsupportedElement{ID: shapes[i].ID.String(), Type: string(shapes[i].Type), Reason: err.Error()})
+			continue
+		}
+		model.Cells = append(model.Cells, cell)
+	}
+	for i := range model.Cells {
+		model.Cells[i].XMLName = xml.Name{Local: "mxCell"}
+	}
+
+	diagram := drawioDiagram{ID: uuid.NewString(), Name: "Page-1"}
+	if compressed {
+		data, err := xml.Marshal(model)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode draw.io diagram: %w", err)
+		}
+		// Match encodeURIComponent, which draw.io decodes the page with.
+		encoded := strings.ReplaceAll(url.QueryEscape(string(data)), "+", "%20")
+		var buf bytes.Buffer
+		writer, _ := flate.NewWriter(&buf, flate.BestCompression)
+		writer.Write([]byte(encoded))
+		writer.Close()
+		diagram.Data = base64.StdEncoding.EncodeToString(buf.Bytes())
+	} else {
+		diagram.Model = &model
+	}
+	file := drawioFile{Host: "exclidaw", Diagrams: []drawioDiagram{diagram}}
+	data, err := xml.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode draw.io file: %w", err)
+	}
+	return append(data, '\n'), unsupported, nil
+}
+
+func drawioFromShape(s *Shape, exported map[uuid.UUID]bool) (drawioCell, error) {
+	cell := drawioCell{ID: s.ID.String(), Parent: "1"}
+	style := []string{"html=1"}
+	style = append(style, drawioColorStyle("strokeColor", "strokeOpacity", s.Color)...)
+	style = append(style, "strokeWidth="+drawioNum(s.StrokeWidth))
+	switch s.StrokeStyle {
+	case StrokeDashed:
+		style = append(style, "dashed=1")
+	case StrokeDotted:
+		style = append(style, "dashed=1", "dashPattern=1 2")
+	}
+	if s.Opacity > 0 && s.Opacity < 1 {
+		style = append(style, "opacity="+drawioNum(s.Opacity*100))
+	}
+
+	switch s.Type {
+	case ShapeRectangle, ShapeEllipse:
+		cell.Vertex = "1"
+		if s.Type == ShapeEllipse {
+			style = append([]string{"ellipse"}, style...)
+		} else {
+			style = append([]string{"rounded=0"}, style...)
+		}
+		if s.FillColor == "" || s.FillStyle == FillNone {
+			style = append(style, "fillColor=none")
+		} else {
+			style = append(style, drawioColorStyle("fillColor", "fillOpacity", s.FillColor)...)
+			if s.FillStyle == FillHachure || s.FillStyle == FillCrossHatch {
+				style = append(style, "fillStyle="+string(s.FillStyle))
+			}
+		}
+		if s.Rotation != 0 {
+			style = append(style, "rotation="+drawioNum(s.Rotation*180/math.Pi))
+		}
+		x, y, w, h := normalizedBox(s)
+		cell.Geometry = &drawioGeometry{X: x, Y: y, Width: w, Height: h, As: "geometry"}
+	case ShapeLine, ShapeArrow, ShapePencil:
+		points := [][2]float64{{s.X, s.Y}}
+		if s.Type == ShapePencil {
+			rest, err := s.PointList()
+			if err != nil {
+				return cell, err
+			}
+			points = append(points, rest...)
+		} else {
+			points = append(points, [2]float64{s.EndX, s.EndY})
+		}
+		// Edges cannot be rotated, so rotated strokes are exported as placed.
+		if s.Rotation != 0 {
+			b, err := s.unrotatedBounds()
+			if err != nil {
+				return cell, err
+			}
+			cx, cy := (b.MinX+b.MaxX)/2, (b.MinY+b.MaxY)/2
+			for i, p := range points {
+				points[i][0], points[i][1] = rotatePoint(p[0], p[1], cx, cy, s.Rotation)
+			}
+		}
+		if len(points) < 2 {
+			points = append(points, points[0])
+		}
+
+		cell.Edge = "1"
+		startArrow, endArrow := ArrowheadNone, ArrowheadNone
+		if s.Type == ShapeArrow {
+			startArrow, endArrow = s.StartArrowhead, s.EndArrowhead
+			if s.StartShapeID != nil && exported[*s.StartShapeID] {
+				cell.Source = s.StartShapeID.String()
+			}
+			if s.EndShapeID != nil && exported[*s.EndShapeID] {
+				cell.Target = s.EndShapeID.String()
+			}
+		}
+		style = append(style, "startArrow="+drawioMarker(startArrow), "endArrow="+drawioMarker(endArrow), "rounded=0")
+		last := len(points) - 1
+		cell.Geometry = &drawioGeometry{Relative: "1", As: "geometry", Points: []drawioPoint{
+			{X: points[0][0], Y: points[0][1], As: "sourcePoint"},
+			{X: points[last][0], Y: points[last][1], As: "targetPoint"},
+		}}
+		if last > 1 {
+			cell.Geometry.Waypoints = &drawioArray{As: "points"}
+			for _, p := range points[1:last] {
+				cell.Geometry.Waypoints.Points = append(cell.Geometry.Waypoints.Points, drawioPoint{X: p[0], Y: p[1]})
+			}
+		}
+	default:
+		return cell, fmt.Errorf("%s shapes are not supported by the draw.io export", s.Type)
+	}
+	cell.Style = strings.Join(style, ";") + ";"
+	return cell, nil
+}
+
+func drawioMarker(arrowhead Arrowhead) string {
+	if marker, ok := drawioMarkers[arrowhead]; ok {
+		return marker
+	}
+	return "none"
+}
+
+// drawioColorStyle splits a "#RRGGBB[AA]" color into a draw.io color and,
+// when it is translucent, an opacity from 0 to 100.
+func drawioColorStyle(colorKey, opacityKey, hex string) []string {
+	c, err := ParseColor(hex)
+	if err != nil {
+		c, _ = ParseColor(DefaultColor)
+	}
+	style := []string{fmt.Sprintf("%s=#%02X%02X%02X", colorKey, c.R, c.G, c.B)}
+	if c.A < 255 {
+		style = append(style, opacityKey+"="+drawioNum(float64(c.A)*100/255))
+	}
+	return style
+}
+
+// drawioNum formats a style value with at most four decimals.
+func drawioNum(v float64) string {
+	return strconv.FormatFloat(math.Round(v*10000)/10000, 'f', -1, 64)
+}
+
+// ImportDrawio decodes a .drawio file, compressed or not, or a bare
+// mxGraphModel into shapes in paint order. Only the first page is read.
+// Rectangles and ellipses become shapes of their own kind, labels are
+// dropped, and edges become lines, arrows when they have a marker at either
+// end, or pencil strokes when they bend. Shapes get fresh IDs and are
+// validated, but have no room or creator yet. Cells that cannot be converted
+// are left out and returned as unsupported; an error means the file itself
+// could not be read.
+func ImportDrawio(data []byte) ([]Shape, []UnsupportedElement, error) {
+	model, err := decodeDrawio(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	cells := make(map[string]*drawioCell, len(model.Cells))
+	for i := range model.Cells {
+		cell := &model.Cells[i]
+		if cell.Inner != nil {
+			// Wrapped cells take their ID from the wrapper.
+			inner := *cell.Inner
+			inner.ID = cell.ID
+			*cell = inner
+		}
+		cells[cell.ID] = cell
+	}
+
+	// Vertices are converted first so edges can attach to them, then all
+	// shapes are returned in document order.
+	converted := make(map[string]*Shape)
+	groups := make(map[string]uuid.UUID)
+	var unsupported []UnsupportedElement
+	for _, pass := range []string{"vertex", "edge"} {
+		for i := range model.Cells {
+			cell := &model.Cells[i]
+			if (pass == "vertex" && cell.Vertex != "1") || (pass == "edge" && cell.Edge != "1") {
+				continue
+			}
+			shape, err := shapeFromDrawio(cell, cells, converted)
+			if errors.Is(err, errDrawioGroup) {
+				continue
+			}
+			if err == nil {
+				err = shape.Validate()
+			}
+			if err == nil {
+				err = shape.ComputeBounds()
+			}
+			if err != nil {
+				kind, _ := parseDrawioStyle(cell.Style)
+				if kind == "" {
+					kind = pass
+				}
+				unsupported = append(unsupported, UnsupportedElement{ID: cell.ID, Type: kind, Reason: err.Error()})
+				continue
+			}
+			if group := drawioGroup(cell, cells); group != "" {
+				groupID, ok := groups[group]
+				if !ok {
+					groupID = uuid.New()
+					groups[group] = groupID
+				}
+				shape.GroupID = &groupID
+			}
+			converted[cell.ID] = shape
+		}
+	}
+
+	var shapes []Shape
+	now := time.Now()
+	for _, cell := range model.Cells {
+		if shape, ok := converted[cell.ID]; ok {
+			shape.CreatedAt, shape.UpdatedAt = now, now
+			shapes = append(shapes, *shape)
+		}
+	}
+	return shapes, unsupported, nil
+}
+
+// decodeDrawio reads the model of the first page of a file.
+func decodeDrawio(data []byte) (*drawioModel, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid draw.io file: %w", err)
+	}
+	var modelXML []byte
+	switch root.XMLName.Local {
+	case "mxGraphModel":
+		modelXML = data
+	case "mxfile":
+		var file drawioFile
+		if err := xml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid draw.io file: %w", err)
+		}
+		if len(file.Diagrams) == 0 {
+			return nil, fmt.Errorf("draw.io file has no pages")
+		}
+		if file.Diagrams[0].Model != nil {
+			// The page is read again on its own so wrapped cells are kept.
+			modelXML = extractDrawioModel(data)
+			break
+		}
+		var err error
+		if modelXML, err = inflateDrawio(strings.TrimSpace(file.Diagrams[0].Data)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("not a draw.io file")
+	}
+
+	var model struct {
+		Root drawioModelRoot `xml:"root"`
+	}
+	if err := xml.Unmarshal(modelXML, &model); err != nil {
+		return nil, fmt.Errorf("invalid draw.io diagram: %w", err)
+	}
+	return &drawioModel{Cells: model.Root.Cells}, nil
+}
+
+// extractDrawioModel returns the XML of the first mxGraphModel element in
+// data.
+func extractDrawioModel(data []byte) []byte {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "mxGraphModel" {
+			if err := decoder.Skip(); err != nil {
+				return nil
+			}
+			return data[offset:decoder.InputOffset()]
+		}
+	}
+}
+
+// inflateDrawio decodes a compressed page into its model XML.
+func inflateDrawio(data string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed draw.io page: %w", err)
+	}
+	inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxDrawioDiagramSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed draw.io page: %w", err)
+	}
+	if len(inflated) > maxDrawioDiagramSize {
+		return nil, fmt.Errorf("draw.io page is too large")
+	}
+	if bytes.HasPrefix(inflated, []byte("<")) {
+		return inflated, nil
+	}
+	decoded, err := url.PathUnescape(string(inflated))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed draw.io page: %w", err)
+	}
+	return []byte(decoded), nil
+}
+
+// errDrawioGroup marks a group cell, which has no shape of its own.
+var errDrawioGroup = errors.New("group")
+
+func shapeFromDrawio(cell *drawioCell, cells map[string]*drawioCell, converted map[string]*Shape) (*Shape, error) {
+	kind, style := parseDrawioStyle(cell.Style)
+	if cell.Geometry == nil {
+		return nil, fmt.Errorf("cell has no geometry")
+	}
+	shape := &Shape{
+		ID:          uuid.New(),
+		Color:       drawioColor(style, "strokeColor", "strokeOpacity", DefaultColor),
+		StrokeWidth: 1,
+		Opacity:     1,
+		StrokeStyle: StrokeSolid,
+	}
+	if width, err := strconv.ParseFloat(style["strokeWidth"], 64); err == nil {
+		shape.StrokeWidth = width
+	}
+	if opacity, err := strconv.ParseFloat(style["opacity"], 64); err == nil {
+		shape.Opacity = math.Max(opacity/100, 0.01)
+	}
+	if style["dashed"] == "1" {
+		shape.StrokeStyle = StrokeDashed
+		if strings.HasPrefix(style["dashPattern"], "1 ") {
+			shape.StrokeStyle = StrokeDotted
+		}
+	}
+	offsetX, offsetY := drawioOffset(cell.Parent, cells)
+
+	if cell.Vertex == "1" {
+		switch kind {
+		case "group":
+			return nil, errDrawioGroup
+		case "", "rect", "rectangle", "label":
+			shape.Type = ShapeRectangle
+		case "ellipse":
+			shape.Type = ShapeEllipse
+		default:
+			return nil, fmt.Errorf("draw.io %s shapes are not supported", kind)
+		}
+		g := cell.Geometry
+		shape.X, shape.Y = g.X+offsetX, g.Y+offsetY
+		shape.Width, shape.Height = g.Width, g.Height
+		// Vertices are filled white unless they say otherwise.
+		if shape.FillColor = drawioColor(style, "fillColor", "fillOpacity", "#ffffff"); shape.FillColor != "" {
+			switch style["fillStyle"] {
+			case "hachure", "zigzag":
+				shape.FillStyle = FillHachure
+			case "cross-hatch":
+				shape.FillStyle = FillCrossHatch
+			default:
+				shape.FillStyle = FillSolid
+			}
+		}
+		if rotation, err := strconv.ParseFloat(style["rotation"], 64); err == nil {
+			shape.Rotation = rotation * math.Pi / 180
+		}
+		return shape, nil
+	}
+
+	// Edge ends are explicit points or, when attached, the centers of the
+	// shapes they attach to. Either way they are then moved onto the outline
+	// of attached shapes.
+	var source, target *Shape
+	points := make([][2]float64, 2)
+	var hasSource, hasTarget bool
+	for _, p := range cell.Geometry.Points {
+		switch p.As {
+		case "sourcePoint":
+			points[0], hasSource = [2]float64{p.X + offsetX, p.Y + offsetY}, true
+		case "targetPoint":
+			points[1], hasTarget = [2]float64{p.X + offsetX, p.Y + offsetY}, true
+		}
+	}
+	if source = converted[cell.Source]; source != nil {
+		points[0][0], points[0][1] = source.center()
+		hasSource = true
+	} else if x, y, ok := drawioCenter(cell.Source, cells); ok {
+		points[0], hasSource = [2]float64{x, y}, true
+	}
+	if target = converted[cell.Target]; target != nil {
+		points[1][0], points[1][1] = target.center()
+		hasTarget = true
+	} else if x, y, ok := drawioCenter(cell.Target, cells); ok {
+		points[1], hasTarget = [2]float64{x, y}, true
+	}
+	if !hasSource || !hasTarget {
+		return nil, fmt.Errorf("edge is not attached at both ends")
+	}
+	if cell.Geometry.Waypoints != nil {
+		var waypoints [][2]float64
+		for _, p := range cell.Geometry.Waypoints.Points {
+			waypoints = append(waypoints, [2]float64{p.X + offsetX, p.Y + offsetY})
+		}
+		points = append(append([][2]float64{points[0]}, waypoints...), points[1])
+	}
+
+	shape.StartArrowhead = drawioArrowhead(style, "startArrow", "none")
+	shape.EndArrowhead = drawioArrowhead(style, "endArrow", "classic")
+	last := len(points) - 1
+	switch {
+	case shape.StartArrowhead != ArrowheadNone || shape.EndArrowhead != ArrowheadNone:
+		// Arrows are straight, so their bends are dropped.
+		shape.Type = ShapeArrow
+		if source != nil {
+			shape.StartShapeID = &source.ID
+		}
+		if target != nil {
+			shape.EndShapeID = &target.ID
+		}
+	case last > 1:
+		shape.Type = ShapePencil
+		var err error
+		if shape.Points, err = json.Marshal(points[1:]); err != nil {
+			return nil, err
+		}
+	default:
+		shape.Type = ShapeLine
+	}
+	shape.X, shape.Y = points[0][0], points[0][1]
+	if shape.Type != ShapePencil {
+		shape.EndX, shape.EndY = points[last][0], points[last][1]
+		shape.BindArrow(source, target)
+	}
+	return shape, nil
+}
+
+// parseDrawioStyle splits a style into its shape name, the one entry without
+// a value, and its key=value entries.
+func parseDrawioStyle(style string) (string, map[string]string) {
+	kind := ""
+	values := make(map[string]string)
+	for _, entry := range strings.Split(style, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			if key != "" && kind == "" {
+				kind = key
+			}
+			continue
+		}
+		values[key] = value
+	}
+	if shape := values["shape"]; shape != "" {
+		kind = shape
+	}
+	return kind, values
+}
+
+// drawioColor reads a color and its opacity from a style as "#RRGGBB[AA]".
+// "none" is "" for fills and transparent for strokes; missing, "default" and
+// unreadable colors give fallback.
+func drawioColor(style map[string]string, colorKey, opacityKey, fallback string) string {
+	value := strings.TrimSpace(style[colorKey])
+	if value == "none" {
+		if colorKey == "fillColor" {
+			return ""
+		}
+		return "#00000000"
+	}
+	c := excalidrawColor(value)
+	if c == "" {
+		c = fallback
+	}
+	if opacity, err := strconv.ParseFloat(style[opacityKey], 64); err == nil && opacity < 100 && len(c) == 7 {
+		c += fmt.Sprintf("%02x", int(math.Round(math.Max(opacity, 0)*255/100)))
+	}
+	return c
+}
+
+func drawioArrowhead(style map[string]string, key, fallback string) Arrowhead {
+	marker := style[key]
+	if marker == "" {
+		marker = fallback
+	}
+	if arrowhead, ok := drawioArrowheads[marker]; ok {
+		return arrowhead
+	}
+	return ArrowheadTriangle
+}
+
+// drawioOffset returns the position of a cell's parent on the page. Children
+// of vertices, such as shapes inside a group, are placed relative to it.
+func drawioOffset(parentID string, cells map[string]*drawioCell) (float64, float64) {
+	var x, y float64
+	for depth := 0; depth < 100; depth++ {
+		parent := cells[parentID]
+		if parent == nil || parent.Vertex != "1" || parent.Geometry == nil {
+			break
+		}
+		x, y = x+parent.Geometry.X, y+parent.Geometry.Y
+		parentID = parent.Parent
+	}
+	return x, y
+}
+
+// drawioCenter returns the center of a vertex that was not converted, such
+// as a shape of an unsupported kind, so edges attached to it keep their place.
+func drawioCenter(id string, cells map[string]*drawioCell) (float64, float64, bool) {
+	cell := cells[id]
+	if id == "" || cell == nil || cell.Vertex != "1" || cell.Geometry == nil {
+		return 0, 0, false
+	}
+	x, y := drawioOffset(cell.Parent, cells)
+	return x + cell.Geometry.X + cell.Geometry.Width/2, y + cell.Geometry.Y + cell.Geometry.Height/2, true
+}
+
+// drawioGroup returns the ID of the outermost group a cell is in, or "".
+func drawioGroup(cell *drawioCell, cells map[string]*drawioCell) string {
+	group := ""
+	parentID := cell.Parent
+	for depth := 0; depth < 100; depth++ {
+		parent := cells[parentID]
+		if parent == nil || parent.Vertex != "1" {
+			break
+		}
+		if kind, _ := parseDrawioStyle(parent.Style); kind == "group" {
+			group = parent.ID
+		}
+		parentID = parent.Parent
+	}
+	return group
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDrawioRoundTrip(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		name := "plain"
+		if compressed {
+			name = "deflated"
+		}
+		t.Run(name, func(t *testing.T) {
+			shapes := roundTripShapes(t)
+			text := Shape{ID: uuid.New(), Type: ShapeText, Text: "hi", FontSize: 16}
+			data, unsupported, err := ExportDrawio(append(shapes, text), compressed)
+			if err != nil {
+				t.Fatalf("ExportDrawio: %v", err)
+			}
+			if len(unsupported) != 1 || unsupported[0].ID != text.ID.String() {
+				t.Errorf("unsupported = %v, want only the text shape", unsupported)
+			}
+			got, unsupported, err := ImportDrawio(data)
+			if err != nil {
+				t.Fatalf("ImportDrawio: %v", err)
+			}
+			if len(unsupported) != 0 {
+				t.Errorf("import left out %v", unsupported)
+			}
+			checkRoundTrip(t, shapes, got)
+		})
+	}
+}
+
+func TestDrawioArrowRoundTrip(t *testing.T) {
+	box := Shape{ID: uuid.New(), Type: ShapeRectangle, X: 0, Y: 0, Width: 40, Height: 40, Color: DefaultColor, StrokeWidth: 1, Opacity: 1}
+	arrow := Shape{ID: uuid.New(), Type: ShapeArrow, X: 20, Y: 20, EndX: 120, EndY: 20, Color: DefaultColor, StrokeWidth: 1, Opacity: 1,
+		StartShapeID: &box.ID, StartArrowhead: ArrowheadNone, EndArrowhead: ArrowheadTriangle}
+	data, _, err := ExportDrawio([]Shape{box, arrow}, false)
+	if err != nil {
+		t.Fatalf("ExportDrawio: %v", err)
+	}
+	got, unsupported, err := ImportDrawio(data)
+	if err != nil {
+		t.Fatalf("ImportDrawio: %v", err)
+	}
+	if len(got) != 2 || len(unsupported) != 0 {
+		t.Fatalf("got %d shapes and %v unsupported, want 2 and none", len(got), unsupported)
+	}
+	if got[1].Type != ShapeArrow || got[1].StartShapeID == nil || *got[1].StartShapeID != got[0].ID {
+		t.Errorf("arrow came back as %s bound to %v, want an arrow bound to %s", got[1].Type, got[1].StartShapeID, got[0].ID)
+	}
+	if got[1].EndShapeID != nil || got[1].EndArrowhead != ArrowheadTriangle {
+		t.Errorf("arrow end came back bound to %v with %s, want free with %s", got[1].EndShapeID, got[1].EndArrowhead, ArrowheadTriangle)
+	}
+}
+
+func TestImportDrawio(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		shapes      int
+		unsupported int
+		wantErr     bool
+	}{
+		{name: "not xml", data: `<mxfile`, wantErr: true},
+		{name: "other root", data: `<svg></svg>`, wantErr: true},
+		{name: "no pages", data: `<mxfile></mxfile>`, wantErr: true},
+		{name: "bad compressed page", data: `<mxfile><diagram>not base64!</diagram></mxfile>`, wantErr: true},
+		{
+			name: "bare model",
+			data: `<mxGraphModel><root><mxCell id="0"/><mxCell id="1" parent="0"/>` +
+				`<mxCell id="2" parent="1" vertex="1" style="ellipse;"><mxGeometry x="1" y="2" width="30" height="20" as="geometry"/></mxCell>` +
+				`</root></mxGraphModel>`,
+			shapes: 1,
+		},
+		{
+			name: "unknown vertex",
+			data: `<mxGraphModel><root><mxCell id="0"/><mxCell id="1" parent="0"/>` +
+				`<mxCell id="2" parent="1" vertex="1" style="shape=cloud;"><mxGeometry x="1" y="2" width="30" height="20" as="geometry"/></mxCell>` +
+				`</root></mxGraphModel>`,
+			unsupported: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shapes, unsupported, err := ImportDrawio([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ImportDrawio accepted the file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ImportDrawio: %v", err)
+			}
+			if len(shapes) != tt.shapes || len(unsupported) != tt.unsupported {
+				t.Errorf("got %d shapes and %v unsupported, want %d and %d", len(shapes), unsupported, tt.shapes, tt.unsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UnsupportedElement is an element of a file that an import or export had to
+// leave out, and why.
+type UnsupportedElement struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// excalidrawFile is the top level of a .excalidraw file. Clipboard contents
+// have the same shape with type "excalidraw/clipboard".
+type excalidrawFile struct {
+	Type     string                 `json:"type"`
+	Version  int                    `json:"version"`
+	Source   string                 `json:"source,omitempty"`
+	Elements []excalidrawElement    `json:"elements"`
+	AppState map[string]interface{} `json:"appState,omitempty"`
+	Files    map[string]interface{} `json:"files"`
+}
+
+// excalidrawElement holds the fields of the Excalidraw element schema this
+// project understands. Excalidraw fills in any other field when it loads a
+// file, so exports leave them out.
+type excalidrawElement struct {
+	ID              string   `json:"id"`
+	Type            string   `json:"type"`
+	X               float64  `json:"x"`
+	Y               float64  `json:"y"`
+	Width           float64  `json:"width"`
+	Height          float64  `json:"height"`
+	Angle           float64  `json:"angle"`
+	StrokeColor     string   `json:"strokeColor"`
+	BackgroundColor string   `json:"backgroundColor"`
+	FillStyle       string   `json:"fillStyle"`
+	StrokeWidth     float64  `json:"strokeWidth"`
+	StrokeStyle     string   `json:"strokeStyle"`
+	Roughness       int      `json:"roughness"`
+	Opacity         float64  `json:"opacity"` // 0 to 100
+	GroupIDs        []string `json:"groupIds"`
+	Seed            int      `json:"seed"`
+	Version         int      `json:"version"`
+	VersionNonce    int      `json:"versionNonce"`
+	IsDeleted       bool     `json:"isDeleted"`
+	Updated         int64    `json:"updated"`
+	Locked          bool     `json:"locked"`
+	// Lines and freedraw only, relative to X/Y.
+	Points           [][2]float64 `json:"points,omitempty"`
+	SimulatePressure bool         `json:"simulatePressure,omitempty"`
+}
+
+// ExportExcalidraw encodes shapes, in the given order, as a .excalidraw file
+// with the given "#RRGGBB[AA]" background. Rectangles, ellipses, lines and
+// pencil strokes are converted; other shapes are returned as unsupported.
+func ExportExcalidraw(shapes []Shape, background string) ([]byte, []UnsupportedElement, error) {
+	if background == "" {
+		background = "#ffffff"
+	}
+	file := excalidrawFile{
+		Type:     "excalidraw",
+		Version:  2,
+		Source:   "exclidaw",
+		Elements: []excalidrawElement{},
+		AppState: map[string]interface{}{"viewBackgroundColor": background},
+		Files:    map[string]interface{}{},
+	}
+	var unsupported []UnsupportedElement
+	for i := range shapes {
+		element, err := excalidrawFromShape(&shapes[i])
+		if err != nil {
+			unsupported = append(unsupported, UnsupportedElement{ID: shapes[i].ID.String(), Type: string(shapes[i].Type), Reason: err.Error()})
+			continue
+		}
+		file.Elements = append(file.Elements, element)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode Excalidraw file: %w", err)
+	}
+	return data, unsupported, nil
+}
+
+// UnmarshalJSON fills in Excalidraw's defaults for fields a file leaves out.
+func (e *excalidrawElement) UnmarshalJSON(data []byte) error {
+	type plain excalidrawElement
+	element := plain{Opacity: 100, StrokeWidth: 2}
+	if err := json.Unmarshal(data, &element); err != nil {
+		return err
+	}
+	*e = excalidrawElement(element)
+	return nil
+}
+
+func excalidrawFromShape(s *Shape) (excalidrawElement, error) {
+	element := excalidrawElement{
+		ID:              s.ID.String(),
+		X:               s.X,
+		Y:               s.Y,
+		Angle:           s.Rotation,
+		StrokeColor:     s.Color,
+		BackgroundColor: "transparent",
+		FillStyle:       "solid",
+		StrokeWidth:     s.StrokeWidth,
+		StrokeStyle:     string(StrokeSolid),
+		Opacity:         math.Round(s.Opacity * 100),
+		GroupIDs:        []string{},
+		Seed:            rand.Intn(1 << 31),
+		Version:         1,
+		VersionNonce:    rand.Intn(1 << 31),
+		Updated:         s.UpdatedAt.UnixMilli(),
+	}
+	if element.StrokeColor == "" {
+		element.StrokeColor = DefaultColor
+	}
+	if s.StrokeStyle == StrokeDashed || s.StrokeStyle == StrokeDotted {
+		element.StrokeStyle = string(s.StrokeStyle)
+	}
+	if s.Opacity == 0 {
+		element.Opacity = 100
+	}
+	if s.UpdatedAt.IsZero() {
+		element.Updated = time.Now().UnixMilli()
+	}
+	if s.GroupID != nil {
+		element.GroupIDs = []string{s.GroupID.String()}
+	}
+
+	switch s.Type {
+	case ShapeRectangle, ShapeEllipse:
+		element.Type = string(s.Type)
+		element.X, element.Y, element.Width, element.Height = normalizedBox(s)
+		if s.FillColor != "" && s.FillStyle != FillNone {
+			element.BackgroundColor = s.FillColor
+			if s.FillStyle != "" {
+				element.FillStyle = string(s.FillStyle)
+			}
+		}
+	case ShapeLine:
+		element.Type = "line"
+		element.Points = [][2]float64{{0, 0}, {s.EndX - s.X, s.EndY - s.Y}}
+		element.Width, element.Height = math.Abs(s.EndX-s.X), math.Abs(s.EndY-s.Y)
+	case ShapePencil:
+		points, err := s.PointList()
+		if err != nil {
+			return element, err
+		}
+		element.Type = "freedraw"
+		element.SimulatePressure = true
+		element.Points = [][2]float64{{0, 0}}
+		b := Bounds{MinX: s.X, MinY: s.Y, MaxX: s.X, MaxY: s.Y}
+		for _, p := range points {
+			element.Points = append(element.Points, [2]float64{p[0] - s.X, p[1] - s.Y})
+			b.include(p[0], p[1])
+		}
+		element.Width, element.Height = b.MaxX-b.MinX, b.MaxY-b.MinY
+	default:
+		return element, fmt.Errorf("%s shapes are not supported by the Excalidraw export", s.Type)
+	}
+	return element, nil
+}
+
+// ImportExcalidraw decodes a .excalidraw file, or Excalidraw clipboard
+// contents, into shapes in paint order. Shapes get fresh IDs and are
+// validated, but have no room or creator yet. Elements that cannot be
+// converted are left out and returned as unsupported; an error means the
+// file itself could not be read.
+func ImportExcalidraw(data []byte) ([]Shape, []UnsupportedElement, error) {
+	var file excalidrawFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("invalid Excalidraw file: %w", err)
+	}
+	if file.Type != "excalidraw" && file.Type != "excalidraw/clipboard" {
+		return nil, nil, fmt.Errorf("not an Excalidraw file")
+	}
+
+	var shapes []Shape
+	var unsupported []UnsupportedElement
+	// Excalidraw nests groups innermost first. Shapes belong to one group, so
+	// the outermost one is kept.
+	groups := make(map[string]uuid.UUID)
+	now := time.Now()
+	for _, element := range file.Elements {
+		if element.IsDeleted {
+			continue
+		}
+		shape, err := shapeFromExcalidraw(&element)
+		if err == nil {
+			err = shape.Validate()
+		}
+		if err == nil {
+			err = shape.ComputeBounds()
+		}
+		if err != nil {
+			unsupported = append(unsupported, UnsupportedElement{ID: element.ID, Type: element.Type, Reason: err.Error()})
+			continue
+		}
+		if n := len(element.GroupIDs); n > 0 {
+			groupID, ok := groups[element.GroupIDs[n-1]]
+			if !ok {
+				groupID = uuid.New()
+				groups[element.GroupIDs[n-1]] = groupID
+			}
+			shape.GroupID = &groupID
+		}
+		shape.CreatedAt, shape.UpdatedAt = now, now
+		shapes = append(shapes, shape)
+	}
+	return shapes, unsupported, nil
+}
+
+func shapeFromExcalidraw(element *excalidrawElement) (Shape, error) {
+	shape := Shape{
+		ID:          uuid.New(),
+		X:           element.X,
+		Y:           element.Y,
+		Color:       excalidrawColor(element.StrokeColor),
+		StrokeWidth: element.StrokeWidth,
+		Opacity:     element.Opacity / 100,
+		Rotation:    element.Angle,
+	}
+	if shape.Color == "" {
+		shape.Color = DefaultColor
+	}
+	switch element.StrokeStyle {
+	case "dashed":
+		shape.StrokeStyle = StrokeDashed
+	case "dotted":
+		shape.StrokeStyle = StrokeDotted
+	default:
+		shape.StrokeStyle = StrokeSolid
+	}
+	// Excalidraw allows fully transparent elements, which shapes cannot be.
+	if shape.Opacity <= 0 {
+		shape.Opacity = 0.01
+	}
+
+	switch element.Type {
+	case "rectangle", "ellipse":
+		shape.Type = ShapeType(element.Type)
+		shape.Width, shape.Height = element.Width, element.Height
+		if fill := excalidrawColor(element.BackgroundColor); fill != "" {
+			shape.FillColor = fill
+			switch element.FillStyle {
+			case "hachure", "zigzag":
+				shape.FillStyle = FillHachure
+			case "cross-hatch":
+				shape.FillStyle = FillCrossHatch
+			default:
+				shape.FillStyle = FillSolid
+			}
+		}
+	case "line", "freedraw":
+		if len(element.Points) == 0 || (element.Type == "line" && len(element.Points) < 2) {
+			return shape, fmt.Errorf("%s has too few points", element.Type)
+		}
+		points := make([][2]float64, len(element.Points))
+		for i, p := range element.Points {
+			points[i] = [2]float64{element.X + p[0], element.Y + p[1]}
+		}
+		shape.X, shape.Y = points[0][0], points[0][1]
+		// Lines through more than two points become pencil strokes, which
+		// are polylines.
+		if element.Type == "line" && len(points) == 2 {
+			shape.Type = ShapeLine
+			shape.EndX, shape.EndY = points[1][0], points[1][1]
+			break
+		}
+		shape.Type = ShapePencil
+		var err error
+		if shape.Points, err = json.Marshal(points[1:]); err != nil {
+			return shape, err
+		}
+	default:
+		return shape, fmt.Errorf("%s elements are not supported", element.Type)
+	}
+	return shape, nil
+}
+
+// excalidrawColor converts an Excalidraw color to "#RRGGBB[AA]", or returns
+// "" for transparent and for colors other than hex ones.
+func excalidrawColor(c string) string {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if len(c) == 4 && strings.HasPrefix(c, "#") {
+		c = "#" + strings.Repeat(c[1:2], 2) + strings.Repeat(c[2:3], 2) + strings.Repeat(c[3:4], 2)
+	}
+	if !colorPattern.MatchString(c) {
+		return ""
+	}
+	return c
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// roundTripShapes returns the shapes the interchange round-trip tests export
+// and import again: one of each kind the formats hold, two of them grouped.
+func roundTripShapes(t *testing.T) []Shape {
+	t.Helper()
+	group := uuid.New()
+	pencil := Shape{ID: uuid.New(), Type: ShapePencil, X: 5, Y: 5, Color: "#00ff00", StrokeWidth: 3, StrokeStyle: StrokeSolid, Opacity: 1}
+	var err error
+	if pencil.Points, err = json.Marshal([][2]float64{{15, 25}, {40, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	return []Shape{
+		{ID: uuid.New(), Type: ShapeRectangle, X: 10, Y: 20, Width: 100, Height: 50, Color: "#ff0000", StrokeWidth: 2,
+			StrokeStyle: StrokeSolid, FillColor: "#0000ff", FillStyle: FillSolid, Opacity: 1, GroupID: &group},
+		{ID: uuid.New(), Type: ShapeEllipse, X: 200, Y: 100, Width: 80, Height: 40, Color: "#000000", StrokeWidth: 1,
+			StrokeStyle: StrokeDashed, Opacity: 0.5, GroupID: &group},
+		{ID: uuid.New(), Type: ShapeLine, X: 0, Y: 0, EndX: 60, EndY: 30, Color: "#123456", StrokeWidth: 4,
+			StrokeStyle: StrokeDotted, Opacity: 1},
+		pencil,
+	}
+}
+
+// checkRoundTrip compares shapes read back from a file with the originals,
+// on the fields both interchange formats keep. Groups are checked by the
+// formats that keep them.
+func checkRoundTrip(t *testing.T, want, got []Shape) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d shapes back, want %d", len(got), len(want))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Type != w.Type {
+			t.Errorf("shape %d: type %s, want %s", i, g.Type, w.Type)
+			continue
+		}
+		if !near(g.X, w.X) || !near(g.Y, w.Y) || !near(g.Width, w.Width) || !near(g.Height, w.Height) ||
+			!near(g.EndX, w.EndX) || !near(g.EndY, w.EndY) {
+			t.Errorf("shape %d: geometry (%v, %v, %v, %v, %v, %v), want (%v, %v, %v, %v, %v, %v)", i,
+				g.X, g.Y, g.Width, g.Height, g.EndX, g.EndY, w.X, w.Y, w.Width, w.Height, w.EndX, w.EndY)
+		}
+		if g.Color != w.Color || g.FillColor != w.FillColor || g.StrokeStyle != w.StrokeStyle {
+			t.Errorf("shape %d: style %s/%s/%s, want %s/%s/%s", i, g.Color, g.FillColor, g.StrokeStyle, w.Color, w.FillColor, w.StrokeStyle)
+		}
+		if !near(g.StrokeWidth, w.StrokeWidth) || !near(g.Opacity, w.Opacity) {
+			t.Errorf("shape %d: stroke width %v and opacity %v, want %v and %v", i, g.StrokeWidth, g.Opacity, w.StrokeWidth, w.Opacity)
+		}
+		wantPoints, err := w.PointList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotPoints, err := g.PointList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotPoints) != len(wantPoints) {
+			t.Errorf("shape %d: %d points, want %d", i, len(gotPoints), len(wantPoints))
+			continue
+		}
+		for j := range wantPoints {
+			if !near(gotPoints[j][0], wantPoints[j][0]) || !near(gotPoints[j][1], wantPoints[j][1]) {
+				t.Errorf("shape %d: point %d is %v, want %v", i, j, gotPoints[j], wantPoints[j])
+			}
+		}
+	}
+}
+
+func TestExcalidrawRoundTrip(t *testing.T) {
+	shapes := roundTripShapes(t)
+	text := Shape{ID: uuid.New(), Type: ShapeText, Text: "hi", FontSize: 16}
+	data, unsupported, err := ExportExcalidraw(append(shapes, text), "")
+	if err != nil {
+		t.Fatalf("ExportExcalidraw: %v", err)
+	}
+	if len(unsupported) != 1 || unsupported[0].ID != text.ID.String() {
+		t.Errorf("unsupported = %v, want only the text shape", unsupported)
+	}
+	got, unsupported, err := ImportExcalidraw(data)
+	if err != nil {
+		t.Fatalf("ImportExcalidraw: %v", err)
+	}
+	if len(unsupported) != 0 {
+		t.Errorf("import left out %v", unsupported)
+	}
+	checkRoundTrip(t, shapes, got)
+	// Grouped shapes come back in one new group, the others in none.
+	if got[0].GroupID == nil || got[1].GroupID == nil || *got[0].GroupID != *got[1].GroupID {
+		t.Errorf("grouped shapes came back as groups %v and %v", got[0].GroupID, got[1].GroupID)
+	}
+	if got[2].GroupID != nil || got[3].GroupID != nil {
+		t.Errorf("ungrouped shapes came back in groups %v and %v", got[2].GroupID, got[3].GroupID)
+	}
+}
+
+func TestImportExcalidraw(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		shapes      int
+		unsupported int
+		wantErr     bool
+	}{
+		{name: "not json", data: `{`, wantErr: true},
+		{name: "other type", data: `{"type": "tldraw", "elements": []}`, wantErr: true},
+		{name: "clipboard", data: `{"type": "excalidraw/clipboard", "elements": [{"id": "a", "type": "rectangle", "width": 10, "height": 10}]}`, shapes: 1},
+		{name: "deleted element", data: `{"type": "excalidraw", "elements": [{"id": "a", "type": "ellipse", "isDeleted": true}]}`},
+		{name: "unknown element", data: `{"type": "excalidraw", "elements": [{"id": "a", "type": "embeddable"}]}`, unsupported: 1},
+		{name: "line without points", data: `{"type": "excalidraw", "elements": [{"id": "a", "type": "line", "points": [[0, 0]]}]}`, unsupported: 1},
+		{name: "polyline", data: `{"type": "excalidraw", "elements": [{"id": "a", "type": "line", "points": [[0, 0], [5, 5], [10, 0]]}]}`, shapes: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shapes, unsupported, err := ImportExcalidraw([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ImportExcalidraw accepted the file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ImportExcalidraw: %v", err)
+			}
+			if len(shapes) != tt.shapes || len(unsupported) != tt.unsupported {
+				t.Errorf("got %d shapes and %d unsupported, want %d and %d", len(shapes), len(unsupported), tt.shapes, tt.unsupported)
+			}
+		})
+	}
+}
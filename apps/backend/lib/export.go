@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// ExportOptions controls how shapes are exported to an image.
+type ExportOptions struct {
+	// Bounds crops the export to an area of the canvas. When nil the export
+	// fits all exported shapes.
+	Bounds *Bounds
+	// Padding is added around the exported area on every side.
+	Padding float64
+	// Background fills the exported area with a "#RRGGBB[AA]" color. Empty
+	// leaves it transparent.
+	Background string
+	// LoadAsset returns the content type and contents of an image's asset.
+	// Images are drawn as empty frames when it is nil or fails.
+	LoadAsset func(assetID uuid.UUID) (string, []byte, error)
+}
+
+// ExportArea returns the canvas area an export of shapes covers.
+func ExportArea(shapes []Shape, opts ExportOptions) Bounds {
+	var area Bounds
+	switch {
+	case opts.Bounds != nil:
+		area = *opts.Bounds
+	case len(shapes) > 0:
+		area = shapes[0].Bounds()
+		for i := range shapes[1:] {
+			area = area.Union(shapes[i+1].Bounds())
+		}
+	}
+	return area.Expand(opts.Padding)
+}
+
+// ParseColor parses a "#RRGGBB" or "#RRGGBBAA" color.
+func ParseColor(hex string) (color.NRGBA, error) {
+	if !colorPattern.MatchString(hex) {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", hex)
+	}
+	value, _ := strconv.ParseUint(hex[1:], 16, 32)
+	if len(hex) == 7 {
+		value = value<<8 | 0xff
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// dashPattern returns the lengths of alternating dashes and gaps for a
+// stroke style, scaled to the stroke width, or nil for a solid stroke.
+func dashPattern(style StrokeStyle, width float64) []float64 {
+	width = math.Max(width, 1)
+	switch style {
+	case StrokeDashed:
+		return []float64{4 * width, 4 * width}
+	case StrokeDotted:
+		return []float64{width, 2 * width}
+	default:
+		return nil
+	}
+}
+
+// arrowheadMark is the outline of an arrowhead. Closed marks are filled
+// with the stroke color.
+type arrowheadMark struct {
+	points [][2]float64
+	closed bool
+}
+
+// arrowheadMarks returns the arrowheads of an arrow in canvas coordinates.
+func (s *Shape) arrowheadMarks() []arrowheadMark {
+	var marks []arrowheadMark
+	size := 4*s.StrokeWidth + 6
+	// Each head points away from the other end of the arrow.
+	ends := []struct {
+		style        Arrowhead
+		tipX, tipY   float64
+		fromX, fromY float64
+	}{
+		{s.StartArrowhead, s.X, s.Y, s.EndX, s.EndY},
+		{s.EndArrowhead, s.EndX, s.EndY, s.X, s.Y},
+	}
+	for _, end := range ends {
+		length := math.Hypot(end.tipX-end.fromX, end.tipY-end.fromY)
+		if length == 0 || end.style == "" || end.style == ArrowheadNone {
+			continue
+		}
+		ux, uy := (end.tipX-end.fromX)/length, (end.tipY-end.fromY)/length
+		// back and side are a point size behind the tip, and size/2 beside it.
+		back := func(side float64) [2]float64 {
+			return [2]float64{end.tipX - ux*size - uy*side, end.tipY - uy*size + ux*side}
+		}
+		switch end.style {
+		case ArrowheadArrow:
+			marks = append(marks, arrowheadMark{points: [][2]float64{back(size / 2), {end.tipX, end.tipY}, back(-size / 2)}})
+		case ArrowheadTriangle:
+			marks = append(marks, arrowheadMark{points: [][2]float64{back(size / 2), {end.tipX, end.tipY}, back(-size / 2)}, closed: true})
+		case ArrowheadBar:
+			marks = append(marks, arrowheadMark{points: [][2]float64{
+				{end.tipX - uy*size/2, end.tipY + ux*size/2}, {end.tipX + uy*size/2, end.tipY - ux*size/2},
+			}})
+		case ArrowheadCircle:
+			r := size / 3
+			marks = append(marks, arrowheadMark{points: ellipseOutline(end.tipX-ux*r, end.tipY-uy*r, r, r), closed: true})
+		}
+	}
+	return marks
+}
@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Bounds is an axis-aligned bounding box in canvas coordinates.
+type Bounds struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+// Valid reports whether the box has finite, correctly ordered corners.
+func (b Bounds) Valid() bool {
+	for _, v := range []float64{b.MinX, b.MinY, b.MaxX, b.MaxY} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return b.MinX <= b.MaxX && b.MinY <= b.MaxY
+}
+
+// Expand grows the box by margin on every side.
+func (b Bounds) Expand(margin float64) Bounds {
+	return Bounds{
+		MinX: b.MinX - margin,
+		MinY: b.MinY - margin,
+		MaxX: b.MaxX + margin,
+		MaxY: b.MaxY + margin,
+	}
+}
+
+// Intersects reports whether two boxes overlap, touching edges included.
+func (b Bounds) Intersects(other Bounds) bool {
+	return b.MinX <= other.MaxX && other.MinX <= b.MaxX &&
+		b.MinY <= other.MaxY && other.MinY <= b.MaxY
+}
+
+// Union returns the smallest box containing both boxes.
+func (b Bounds) Union(other Bounds) Bounds {
+	b.include(other.MinX, other.MinY)
+	b.include(other.MaxX, other.MaxY)
+	return b
+}
+
+// include grows the box to contain the point.
+func (b *Bounds) include(x, y float64) {
+	b.MinX = math.Min(b.MinX, x)
+	b.MinY = math.Min(b.MinY, y)
+	b.MaxX = math.Max(b.MaxX, x)
+	b.MaxY = math.Max(b.MaxY, y)
+}
+
+// Bounds returns the stored bounding box of the shape.
+func (s *Shape) Bounds() Bounds {
+	return Bounds{MinX: s.MinX, MinY: s.MinY, MaxX: s.MaxX, MaxY: s.MaxY}
+}
+
+// PointList decodes the pencil points of a shape. The first point of a
+// pencil stroke is stored in X/Y and is not part of the list.
+func (s *Shape) PointList() ([][2]float64, error) {
+	if len(s.Points) == 0 || string(s.Points) == "null" {
+		return nil, nil
+	}
+	var raw [][]float64
+	if err := json.Unmarshal(s.Points, &raw); err != nil {
+		return nil, fmt.Errorf("invalid points for shape %s: %w", s.ID, err)
+	}
+	points := make([][2]float64, 0, len(raw))
+	for _, p := range raw {
+		if len(p) < 2 {
+			return nil, fmt.Errorf("invalid point %v for shape %s", p, s.ID)
+		}
+		points = append(points, [2]float64{p[0], p[1]})
+	}
+	return points, nil
+}
+
+// ComputeBounds derives MinX/MinY/MaxX/MaxY from the shape geometry, rotated
+// and padded by half the stroke width. It must be called before a shape is
+// stored.
+func (s *Shape) ComputeBounds() error {
+	b, err := s.unrotatedBounds()
+	if err != nil {
+		return err
+	}
+	if s.Rotation != 0 {
+		cx, cy := (b.MinX+b.MaxX)/2, (b.MinY+b.MaxY)/2
+		corners := [][2]float64{{b.MinX, b.MinY}, {b.MaxX, b.MinY}, {b.MaxX, b.MaxY}, {b.MinX, b.MaxY}}
+		x, y := rotatePoint(corners[0][0], corners[0][1], cx, cy, s.Rotation)
+		b = Bounds{MinX: x, MinY: y, MaxX: x, MaxY: y}
+		for _, c := range corners[1:] {
+			b.include(rotatePoint(c[0], c[1], cx, cy, s.Rotation))
+		}
+	}
+	b = b.Expand(s.StrokeWidth / 2)
+	if !b.Valid() {
+		return fmt.Errorf("shape %s has invalid coordinates", s.ID)
+	}
+	s.MinX, s.MinY, s.MaxX, s.MaxY = b.MinX, b.MinY, b.MaxX, b.MaxY
+	return nil
+}
+
+// unrotatedBounds returns the box of the shape's geometry before rotation
+// and without the stroke. Its center is the center of rotation.
+func (s *Shape) unrotatedBounds() (Bounds, error) {
+	b := Bounds{MinX: s.X, MinY: s.Y, MaxX: s.X, MaxY: s.Y}
+	switch s.Type {
+	case ShapeRectangle, ShapeEllipse, ShapeImage:
+		// Width and height are negative when drawn up or to the left.
+		b.include(s.X+s.Width, s.Y+s.Height)
+	case ShapeLine, ShapeArrow:
+		b.include(s.EndX, s.EndY)
+	case ShapePencil:
+		points, err := s.PointList()
+		if err != nil {
+			return b, err
+		}
+		for _, p := range points {
+			b.include(p[0], p[1])
+		}
+	case ShapeText:
+		width, height := s.TextSize()
+		b.include(s.X+width, s.Y+height)
+	}
+	return b, nil
+}
+
+// rotatePoint rotates (x, y) clockwise by angle radians around (cx, cy), in
+// canvas coordinates where y grows downwards.
+func rotatePoint(x, y, cx, cy, angle float64) (float64, float64) {
+	sin, cos := math.Sincos(angle)
+	dx, dy := x-cx, y-cy
+	return cx + dx*cos - dy*sin, cy + dx*sin + dy*cos
+}
+
+// HitByPath reports whether an eraser dragged along path with the given radius
+// touches the shape. A single point is a path of length one. Rectangles and
+// ellipses are hit anywhere inside, as on the client; lines and pencil
+// strokes only near the stroke. Rotated shapes are tested in their own
+// unrotated frame.
+func (s *Shape) HitByPath(path [][2]float64, radius float64) (bool, error) {
+	if len(path) == 0 {
+		return false, nil
+	}
+	tolerance := radius + s.StrokeWidth/2
+
+	if s.Rotation != 0 {
+		b, err := s.unrotatedBounds()
+		if err != nil {
+			return false, err
+		}
+		cx, cy := (b.MinX+b.MaxX)/2, (b.MinY+b.MaxY)/2
+		local := make([][2]float64, len(path))
+		for i, p := range path {
+			local[i][0], local[i][1] = rotatePoint(p[0], p[1], cx, cy, -s.Rotation)
+		}
+		path = local
+	}
+
+	var outline [][2]float64
+	switch s.Type {
+	case ShapeRectangle, ShapeImage, ShapeText:
+		width, height := s.Width, s.Height
+		if s.Type == ShapeText {
+			width, height = s.TextSize()
+		}
+		x2, y2 := s.X+width, s.Y+height
+		outline = [][2]float64{{s.X, s.Y}, {x2, s.Y}, {x2, y2}, {s.X, y2}, {s.X, s.Y}}
+		minX, maxX := math.Min(s.X, x2), math.Max(s.X, x2)
+		minY, maxY := math.Min(s.Y, y2), math.Max(s.Y, y2)
+		for _, p := range path {
+			if p[0] >= minX && p[0] <= maxX && p[1] >= minY && p[1] <= maxY {
+				return true, nil
+			}
+		}
+	case ShapeEllipse:
+		rx, ry := math.Abs(s.Width/2), math.Abs(s.Height/2)
+		cx, cy := s.X+s.Width/2, s.Y+s.Height/2
+		outline = ellipseOutline(cx, cy, rx, ry)
+		for _, p := range path {
+			if rx > 0 && ry > 0 && math.Pow((p[0]-cx)/rx, 2)+math.Pow((p[1]-cy)/ry, 2) <= 1 {
+				return true, nil
+			}
+		}
+	case ShapeLine, ShapeArrow:
+		outline = [][2]float64{{s.X, s.Y}, {s.EndX, s.EndY}}
+	case ShapePencil:
+		points, err := s.PointList()
+		if err != nil {
+			return false, err
+		}
+		outline = append([][2]float64{{s.X, s.Y}}, points...)
+	default:
+		return s.Bounds().Intersects(PathBounds(path, radius)), nil
+	}
+	return polylineDistance(path, outline) <= tolerance, nil
+}
+
+// ellipseOutline approximates an ellipse by a closed polygon.
+func ellipseOutline(cx, cy, rx, ry float64) [][2]float64 {
+	const segments = 64
+	outline := make([][2]float64, 0, segments+1)
+	for i := 0; i <= segments; i++ {
+		angle := 2 * math.Pi * float64(i) / segments
+		outline = append(outline, [2]float64{cx + rx*math.Cos(angle), cy + ry*math.Sin(angle)})
+	}
+	return outline
+}
+
+// PathBounds returns the area a non-empty eraser path with the given radius
+// can touch.
+func PathBounds(path [][2]float64, radius float64) Bounds {
+	b := Bounds{MinX: path[0][0], MinY: path[0][1], MaxX: path[0][0], MaxY: path[0][1]}
+	for _, p := range path[1:] {
+		b.include(p[0], p[1])
+	}
+	return b.Expand(radius)
+}
+
+// polylineDistance returns the smallest distance between two polylines. A
+// polyline of a single point is treated as a zero-length segment.
+func polylineDistance(a, b [][2]float64) float64 {
+	segments := func(line [][2]float64) [][2][2]float64 {
+		if len(line) == 1 {
+			return [][2][2]float64{{line[0], line[0]}}
+		}
+		out := make([][2][2]float64, 0, len(line)-1)
+		for i := 1; i < len(line); i++ {
+			out = append(out, [2][2]float64{line[i-1], line[i]})
+		}
+		return out
+	}
+	best := math.Inf(1)
+	for _, sa := range segments(a) {
+		for _, sb := range segments(b) {
+			best = math.Min(best, segmentDistance(sa[0], sa[1], sb[0], sb[1]))
+		}
+	}
+	return best
+}
+
+// segmentDistance returns the distance between segments p1-p2 and q1-q2.
+func segmentDistance(p1, p2, q1, q2 [2]float64) float64 {
+	if segmentsIntersect(p1, p2, q1, q2) {
+		return 0
+	}
+	return math.Min(
+		math.Min(pointSegmentDistance(p1, q1, q2), pointSegmentDistance(p2, q1, q2)),
+		math.Min(pointSegmentDistance(q1, p1, p2), pointSegmentDistance(q2, p1, p2)),
+	)
+}
+
+// pointSegmentDistance returns the distance from p to the segment a-b.
+func pointSegmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	lengthSq := dx*dx + dy*dy
+	if lengthSq == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+// segmentsIntersect reports whether segments p1-p2 and q1-q2 properly cross.
+// Touching and collinear cases are covered by the distance checks instead.
+func segmentsIntersect(p1, p2, q1, q2 [2]float64) bool {
+	cross := func(o, a, b [2]float64) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+	d1, d2 := cross(q1, q2, p1), cross(q1, q2, p2)
+	d3, d4 := cross(p1, p2, q1), cross(p1, p2, q2)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestSegmentDistance(t *testing.T) {
+	tests := []struct {
+		name           string
+		p1, p2, q1, q2 [2]float64
+		want           float64
+	}{
+		{name: "crossing", p1: [2]float64{0, 0}, p2: [2]float64{10, 10}, q1: [2]float64{0, 10}, q2: [2]float64{10, 0}, want: 0},
+		{name: "parallel", p1: [2]float64{0, 0}, p2: [2]float64{10, 0}, q1: [2]float64{0, 3}, q2: [2]float64{10, 3}, want: 3},
+		{name: "end to end", p1: [2]float64{0, 0}, p2: [2]float64{1, 0}, q1: [2]float64{4, 4}, q2: [2]float64{8, 8}, want: 5},
+		{name: "collinear apart", p1: [2]float64{0, 0}, p2: [2]float64{1, 0}, q1: [2]float64{3, 0}, q2: [2]float64{5, 0}, want: 2},
+		{name: "point on segment", p1: [2]float64{5, 0}, p2: [2]float64{5, 0}, q1: [2]float64{0, 0}, q2: [2]float64{10, 0}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := segmentDistance(tt.p1, tt.p2, tt.q1, tt.q2); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("segmentDistance = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHitByPath(t *testing.T) {
+	pencil := Shape{Type: ShapePencil, X: 0, Y: 0, StrokeWidth: 2}
+	pencil.Points, _ = json.Marshal([][2]float64{{10, 0}, {10, 10}})
+	tests := []struct {
+		name   string
+		shape  Shape
+		path   [][2]float64
+		radius float64
+		want   bool
+	}{
+		{
+			name:  "line near the stroke",
+			shape: Shape{Type: ShapeLine, X: 0, Y: 0, EndX: 100, EndY: 0, StrokeWidth: 2},
+			path:  [][2]float64{{50, 4}}, radius: 3, want: true,
+		},
+		{
+			name:  "line too far",
+			shape: Shape{Type: ShapeLine, X: 0, Y: 0, EndX: 100, EndY: 0, StrokeWidth: 2},
+			path:  [][2]float64{{50, 5}}, radius: 3, want: false,
+		},
+		{
+			name:  "path crossing a line",
+			shape: Shape{Type: ShapeLine, X: 0, Y: 0, EndX: 100, EndY: 0},
+			path:  [][2]float64{{50, -20}, {50, 20}}, radius: 1, want: true,
+		},
+		{
+			name:  "inside a rectangle",
+			shape: Shape{Type: ShapeRectangle, X: 0, Y: 0, Width: 100, Height: 50},
+			path:  [][2]float64{{50, 25}}, radius: 1, want: true,
+		},
+		{
+			name:  "inside a rectangle drawn backwards",
+			shape: Shape{Type: ShapeRectangle, X: 100, Y: 50, Width: -100, Height: -50},
+			path:  [][2]float64{{50, 25}}, radius: 1, want: true,
+		},
+		{
+			name:  "inside an ellipse",
+			shape: Shape{Type: ShapeEllipse, X: 0, Y: 0, Width: 100, Height: 50},
+			path:  [][2]float64{{50, 25}}, radius: 1, want: true,
+		},
+		{
+			name:  "ellipse box corner",
+			shape: Shape{Type: ShapeEllipse, X: 0, Y: 0, Width: 100, Height: 50},
+			path:  [][2]float64{{5, 5}}, radius: 1, want: false,
+		},
+		{
+			name:  "ellipse outline",
+			shape: Shape{Type: ShapeEllipse, X: 0, Y: 0, Width: 100, Height: 50},
+			path:  [][2]float64{{102, 25}}, radius: 3, want: true,
+		},
+		{
+			name:  "pencil corner",
+			shape: pencil,
+			path:  [][2]float64{{12, 5}}, radius: 1.5, want: true,
+		},
+		{
+			name:  "pencil inside the turn",
+			shape: pencil,
+			path:  [][2]float64{{5, 5}}, radius: 1, want: false,
+		},
+		{
+			name:  "rotated line",
+			shape: Shape{Type: ShapeLine, X: 0, Y: 0, EndX: 100, EndY: 0, Rotation: math.Pi / 2},
+			path:  [][2]float64{{50, 40}}, radius: 1, want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.shape.HitByPath(tt.path, tt.radius)
+			if err != nil {
+				t.Fatalf("HitByPath: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("HitByPath(%v, %v) = %v, want %v", tt.path, tt.radius, got, tt.want)
+			}
+		})
+	}
+}
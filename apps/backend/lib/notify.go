@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// roomEventsChannel is the Postgres notification channel room events travel
+// on from the HTTP server to the WebSocket server.
+const roomEventsChannel = "room_events"
+
+// RoomEvent is something that happened to a room outside of the WebSocket
+// server that the users connected to it should hear about.
+type RoomEvent struct {
+	RoomID   uuid.UUID              `json:"roomId"`
+	Type     MessageType            `json:"type"`
+	UserID   uuid.UUID              `json:"userId"` // Who caused the event
+	UserName string                 `json:"userName"`
+	Content  map[string]interface{} `json:"content"`
+	// AdminsOnly limits the event to the creator and admins of the room.
+	AdminsOnly bool `json:"adminsOnly,omitempty"`
+}
+
+// NotifyRoom sends a room event to the WebSocket server. Postgres limits
+// notifications to 8000 bytes, so events should carry IDs rather than data.
+func NotifyRoom(event RoomEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event for room %s: %w", event.Type, event.RoomID, err)
+	}
+	if err := Db.Exec("SELECT pg_notify(?, ?)", roomEventsChannel, string(payload)).Error; err != nil {
+		return fmt.Errorf("failed to send %s event for room %s: %w", event.Type, event.RoomID, err)
+	}
+	return nil
+}
+
+// ListenRoomEvents calls handle with every room event sent until ctx is
+// done. It holds a database connection of its own and reconnects after
+// errors; events sent while it reconnects are lost.
+func ListenRoomEvents(ctx context.Context, handle func(RoomEvent)) {
+	for ctx.Err() == nil {
+		err := listenRoomEvents(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Room event listener stopped, reconnecting: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func listenRoomEvents(ctx context.Context, handle func(RoomEvent)) error {
+	sqlDB, err := Db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("database connection does not support notifications")
+		}
+		pgConn := stdConn.Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+roomEventsChannel); err != nil {
+			return errors.Join(err, driver.ErrBadConn)
+		}
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				// The connection is still listening, so it must not go back
+				// to the pool.
+				return errors.Join(err, driver.ErrBadConn)
+			}
+			var event RoomEvent
+			if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+				log.Printf("Ignoring invalid room event: %v", err)
+				continue
+			}
+			handle(event)
+		}
+	})
+}
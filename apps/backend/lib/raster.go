@@ -0,0 +1,566 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"sort"
+)
+
+// Limits on rasterized images, to bound the memory one export can use.
+const (
+	MaxRasterSide   = 8192
+	MaxRasterPixels = 16 << 20
+	MinRasterScale  = 0.01
+	MaxRasterScale  = 8
+)
+
+// rasterSubsamples is the number of sample rows per pixel row. Coverage
+// along a row is computed exactly, so this is enough for smooth edges.
+const rasterSubsamples = 5
+
+// ErrRasterTooLarge is returned when an image would exceed the raster limits.
+var ErrRasterTooLarge = errors.New("image is too large")
+
+// RenderPNG rasterizes shapes, in the given order, into a PNG with scale
+// pixels per canvas unit. Text is not rasterized since no fonts are
+// available on the server; use the SVG export for text.
+func RenderPNG(shapes []Shape, opts ExportOptions, scale float64) ([]byte, error) {
+	img, err := Rasterize(shapes, opts, scale)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Rasterize draws shapes, in the given order, into an image with scale
+// pixels per canvas unit. See RenderPNG.
+func Rasterize(shapes []Shape, opts ExportOptions, scale float64) (*image.RGBA, error) {
+	if !(scale >= MinRasterScale && scale <= MaxRasterScale) {
+		return nil, fmt.Errorf("scale must be between %v and %v", MinRasterScale, MaxRasterScale)
+	}
+	area := ExportArea(shapes, opts)
+	if !area.Valid() {
+		return nil, fmt.Errorf("invalid export area %+v", area)
+	}
+	width := max(1, int(math.Ceil((area.MaxX-area.MinX)*scale)))
+	height := max(1, int(math.Ceil((area.MaxY-area.MinY)*scale)))
+	if width > MaxRasterSide || height > MaxRasterSide || width*height > MaxRasterPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrRasterTooLarge, width, height)
+	}
+
+	r := &raster{img: image.NewRGBA(image.Rect(0, 0, width, height)), area: area, scale: scale}
+	if opts.Background != "" {
+		c, err := ParseColor(opts.Background)
+		if err != nil {
+			return nil, err
+		}
+		r.fillMask(rectMask(r.img.Bounds()), c, 1)
+	}
+	for i := range shapes {
+		if err := r.drawShape(&shapes[i], opts); err != nil {
+			return nil, err
+		}
+	}
+	return r.img, nil
+}
+
+// ThumbnailScale returns the scale at which an export of shapes fits in a
+// square of maxSize pixels, never enlarging beyond one pixel per unit.
+func ThumbnailScale(shapes []Shape, opts ExportOptions, maxSize int) float64 {
+	area := ExportArea(shapes, opts)
+	side := math.Max(area.MaxX-area.MinX, area.MaxY-area.MinY)
+	if side <= 0 {
+		return 1
+	}
+	return math.Max(MinRasterScale, math.Min(1, float64(maxSize)/side))
+}
+
+type raster struct {
+	img   *image.RGBA
+	area  Bounds
+	scale float64
+}
+
+// mask is the coverage, from 0 to 1, of each pixel in rect.
+type mask struct {
+	rect  image.Rectangle
+	cover []float32
+}
+
+func rectMask(rect image.Rectangle) *mask {
+	m := &mask{rect: rect, cover: make([]float32, rect.Dx()*rect.Dy())}
+	for i := range m.cover {
+		m.cover[i] = 1
+	}
+	return m
+}
+
+func (r *raster) drawShape(s *Shape, opts ExportOptions) error {
+	// toPixels maps canvas coordinates to pixels, rotating boxes around
+	// their center first.
+	var cx, cy float64
+	if s.Rotation != 0 {
+		b, err := s.unrotatedBounds()
+		if err != nil {
+			return err
+		}
+		cx, cy = (b.MinX+b.MaxX)/2, (b.MinY+b.MaxY)/2
+	}
+	toPixels := func(points [][2]float64) [][2]float64 {
+		out := make([][2]float64, len(points))
+		for i, p := range points {
+			x, y := p[0], p[1]
+			if s.Rotation != 0 {
+				x, y = rotatePoint(x, y, cx, cy, s.Rotation)
+			}
+			out[i] = [2]float64{(x - r.area.MinX) * r.scale, (y - r.area.MinY) * r.scale}
+		}
+		return out
+	}
+
+	stroke, err := ParseColor(s.Color)
+	if err != nil {
+		return err
+	}
+	opacity := s.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	width := s.StrokeWidth * r.scale
+	dashes := dashPattern(s.StrokeStyle, s.StrokeWidth)
+	for i := range dashes {
+		dashes[i] *= r.scale
+	}
+
+	switch s.Type {
+	case ShapeRectangle, ShapeEllipse:
+		var outline [][2]float64
+		if s.Type == ShapeRectangle {
+			x, y, w, h := normalizedBox(s)
+			outline = [][2]float64{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}, {x, y}}
+		} else {
+			outline = ellipseOutline(s.X+s.Width/2, s.Y+s.Height/2, math.Abs(s.Width/2), math.Abs(s.Height/2))
+		}
+		outline = toPixels(outline)
+		if err := r.drawFill(s, outline, opacity); err != nil {
+			return err
+		}
+		r.drawStroke(outline, width, dashes, stroke, opacity)
+	case ShapeLine:
+		r.drawStroke(toPixels([][2]float64{{s.X, s.Y}, {s.EndX, s.EndY}}), width, dashes, stroke, opacity)
+	case ShapeArrow:
+		r.drawStroke(toPixels([][2]float64{{s.X, s.Y}, {s.EndX, s.EndY}}), width, dashes, stroke, opacity)
+		for _, mark := range s.arrowheadMarks() {
+			points := toPixels(mark.points)
+			if mark.closed {
+				r.fillMask(r.coverage([][][2]float64{points}, polygonsRect([][][2]float64{points}, r.img.Bounds())), stroke, opacity)
+				points = append(points, points[0])
+			}
+			r.drawStroke(points, width, nil, stroke, opacity)
+		}
+	case ShapePencil:
+		points, err := s.PointList()
+		if err != nil {
+			return err
+		}
+		r.drawStroke(toPixels(append([][2]float64{{s.X, s.Y}}, points...)), width, dashes, stroke, opacity)
+	case ShapeImage:
+		r.drawImage(s, opts, toPixels, opacity)
+	}
+	return nil
+}
+
+// drawFill fills a closed outline in pixel coordinates with the shape's
+// fill color and style.
+func (r *raster) drawFill(s *Shape, outline [][2]float64, opacity float64) error {
+	if s.FillColor == "" || s.FillStyle == FillNone || s.FillStyle == "" {
+		return nil
+	}
+	fill, err := ParseColor(s.FillColor)
+	if err != nil {
+		return err
+	}
+	polygons := [][][2]float64{outline}
+	rect := polygonsRect(polygons, r.img.Bounds())
+	m := r.coverage(polygons, rect)
+	if s.FillStyle == FillHachure || s.FillStyle == FillCrossHatch {
+		// Keep only the parts of the fill under diagonal hatch lines.
+		gap := math.Max(s.StrokeWidth, 1) * 4 * r.scale
+		lineWidth := math.Max(s.StrokeWidth/2, 1) * r.scale
+		var lines [][][2]float64
+		span := float64(rect.Dx() + rect.Dy())
+		x0, y0 := float64(rect.Min.X), float64(rect.Min.Y)
+		for offset := 0.0; offset <= span; offset += gap {
+			lines = append(lines, strokePolygons([][2]float64{{x0 + offset, y0}, {x0 + offset - span, y0 + span}}, lineWidth)...)
+			if s.FillStyle == FillCrossHatch {
+				lines = append(lines, strokePolygons([][2]float64{{x0 + offset - span, y0}, {x0 + offset, y0 + span}}, lineWidth)...)
+			}
+		}
+		hatch := r.coverage(lines, rect)
+		for i := range m.cover {
+			m.cover[i] *= hatch.cover[i]
+		}
+	}
+	r.fillMask(m, fill, opacity)
+	return nil
+}
+
+// drawStroke strokes a polyline in pixel coordinates with round joins and
+// caps, optionally dashed.
+func (r *raster) drawStroke(points [][2]float64, width float64, dashes []float64, c color.NRGBA, opacity float64) {
+	if len(points) == 0 || width <= 0 {
+		return
+	}
+	bounds := r.img.Bounds()
+	clip := [4]float64{
+		float64(bounds.Min.X) - width, float64(bounds.Min.Y) - width,
+		float64(bounds.Max.X) + width, float64(bounds.Max.Y) + width,
+	}
+	var polygons [][][2]float64
+	for _, piece := range dashPolyline(points, dashes, clip) {
+		polygons = append(polygons, strokePolygons(piece, width)...)
+	}
+	if len(polygons) == 0 {
+		return
+	}
+	r.fillMask(r.coverage(polygons, polygonsRect(polygons, r.img.Bounds())), c, opacity)
+}
+
+// drawImage draws an image shape's asset into its box, or an empty frame
+// when the asset cannot be loaded.
+func (r *raster) drawImage(s *Shape, opts ExportOptions, toPixels func([][2]float64) [][2]float64, opacity float64) {
+	x, y, w, h := normalizedBox(s)
+	frame := toPixels([][2]float64{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}, {x, y}})
+	var src image.Image
+	if opts.LoadAsset != nil && s.AssetID != nil && w > 0 && h > 0 {
+		if _, data, err := opts.LoadAsset(*s.AssetID); err == nil {
+			src, _, _ = image.Decode(bytes.NewReader(data))
+		}
+	}
+	if src == nil {
+		r.drawStroke(frame, math.Max(r.scale, 1), []float64{4 * r.scale, 4 * r.scale}, color.NRGBA{R: 0x99, G: 0x99, B: 0x99, A: 0xff}, opacity)
+		return
+	}
+
+	// Map each pixel center back into the box and sample the asset there.
+	origin, right, down := frame[0], frame[1], frame[3]
+	ux, uy := right[0]-origin[0], right[1]-origin[1]
+	vx, vy := down[0]-origin[0], down[1]-origin[1]
+	det := ux*vy - uy*vx
+	if det == 0 {
+		return
+	}
+	bounds := src.Bounds()
+	rect := polygonsRect([][][2]float64{frame}, r.img.Bounds())
+	for py := rect.Min.Y; py < rect.Max.Y; py++ {
+		for px := rect.Min.X; px < rect.Max.X; px++ {
+			dx, dy := float64(px)+0.5-origin[0], float64(py)+0.5-origin[1]
+			u := (dx*vy - dy*vx) / det
+			v := (ux*dy - uy*dx) / det
+			if u < 0 || u >= 1 || v < 0 || v >= 1 {
+				continue
+			}
+			sx := bounds.Min.X + int(u*float64(bounds.Dx()))
+			sy := bounds.Min.Y + int(v*float64(bounds.Dy()))
+			r.blend(px, py, color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA), opacity)
+		}
+	}
+}
+
+// fillMask paints color c through a coverage mask.
+func (r *raster) fillMask(m *mask, c color.NRGBA, opacity float64) {
+	for y := m.rect.Min.Y; y < m.rect.Max.Y; y++ {
+		row := (y - m.rect.Min.Y) * m.rect.Dx()
+		for x := m.rect.Min.X; x < m.rect.Max.X; x++ {
+			if cover := m.cover[row+x-m.rect.Min.X]; cover > 0 {
+				r.blend(x, y, c, opacity*math.Min(1, float64(cover)))
+			}
+		}
+	}
+}
+
+// blend composites c over the pixel at (x, y) with the given extra alpha.
+func (r *raster) blend(x, y int, c color.NRGBA, alpha float64) {
+	a := float64(c.A) / 255 * alpha
+	if a <= 0 {
+		return
+	}
+	i := r.img.PixOffset(x, y)
+	pix := r.img.Pix[i : i+4 : i+4]
+	for k, v := range []uint8{c.R, c.G, c.B} {
+		pix[k] = uint8(math.Round(float64(v)*a + float64(pix[k])*(1-a)))
+	}
+	pix[3] = uint8(math.Round(255*a + float64(pix[3])*(1-a)))
+}
+
+type rasterEdge struct {
+	x0, y0, x1, y1 float64
+	dir            int
+}
+
+type rasterCrossing struct {
+	x   float64
+	dir int
+}
+
+// coverage computes how much of each pixel in rect the union of polygons
+// covers, using the nonzero winding rule. Polygons must all wind the same
+// way, which strokePolygons and ellipseOutline guarantee.
+func (r *raster) coverage(polygons [][][2]float64, rect image.Rectangle) *mask {
+	m := &mask{rect: rect, cover: make([]float32, rect.Dx()*rect.Dy())}
+	var edges []rasterEdge
+	for _, polygon := range polygons {
+		for i := range polygon {
+			p, q := polygon[i], polygon[(i+1)%len(polygon)]
+			switch {
+			case p[1] < q[1]:
+				edges = append(edges, rasterEdge{p[0], p[1], q[0], q[1], 1})
+			case p[1] > q[1]:
+				edges = append(edges, rasterEdge{q[0], q[1], p[0], p[1], -1})
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].y0 < edges[j].y0 })
+
+	var active []rasterEdge
+	var crossings []rasterCrossing
+	next := 0
+	const weight = 1.0 / rasterSubsamples
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := m.cover[(y-rect.Min.Y)*rect.Dx() : (y-rect.Min.Y+1)*rect.Dx()]
+		for k := 0; k < rasterSubsamples; k++ {
+			sy := float64(y) + (float64(k)+0.5)/rasterSubsamples
+			for next < len(edges) && edges[next].y0 <= sy {
+				active = append(active, edges[next])
+				next++
+			}
+			crossings = crossings[:0]
+			kept := active[:0]
+			for _, e := range active {
+				if e.y1 <= sy {
+					continue
+				}
+				kept = append(kept, e)
+				if e.y0 <= sy {
+					crossings = append(crossings, rasterCrossing{e.x0 + (sy-e.y0)*(e.x1-e.x0)/(e.y1-e.y0), e.dir})
+				}
+			}
+			active = kept
+			sort.Slice(crossings, func(i, j int) bool { return crossings[i].x < crossings[j].x })
+
+			winding := 0
+			var start float64
+			for _, c := range crossings {
+				before := winding
+				winding += c.dir
+				if before == 0 && winding != 0 {
+					start = c.x
+				} else if before != 0 && winding == 0 {
+					addSpan(row, rect.Min.X, start, c.x, weight)
+				}
+			}
+		}
+	}
+	return m
+}
+
+// addSpan adds weight times the horizontal coverage of [x0, x1) to a row of
+// pixels starting at pixel minX.
+func addSpan(row []float32, minX int, x0, x1, weight float64) {
+	x0 = math.Max(x0, float64(minX))
+	x1 = math.Min(x1, float64(minX+len(row)))
+	for x0 < x1 {
+		px := math.Floor(x0)
+		end := math.Min(x1, px+1)
+		row[int(px)-minX] += float32((end - x0) * weight)
+		x0 = end
+	}
+}
+
+// strokePolygons outlines a polyline of the given width as a quad per
+// segment and a disc per point, all wound the same way.
+func strokePolygons(points [][2]float64, width float64) [][][2]float64 {
+	radius := width / 2
+	var polygons [][][2]float64
+	for i, p := range points {
+		polygons = append(polygons, discPolygon(p[0], p[1], radius))
+		if i == 0 {
+			continue
+		}
+		q := points[i-1]
+		length := math.Hypot(p[0]-q[0], p[1]-q[1])
+		if length == 0 {
+			continue
+		}
+		nx, ny := -(p[1]-q[1])/length*radius, (p[0]-q[0])/length*radius
+		polygons = append(polygons, windClockwise([][2]float64{
+			{q[0] + nx, q[1] + ny}, {p[0] + nx, p[1] + ny}, {p[0] - nx, p[1] - ny}, {q[0] - nx, q[1] - ny},
+		}))
+	}
+	return polygons
+}
+
+// discPolygon approximates a disc with enough sides to look round at its
+// size in pixels.
+func discPolygon(cx, cy, radius float64) [][2]float64 {
+	sides := int(math.Min(64, math.Max(8, math.Ceil(radius*2))))
+	points := make([][2]float64, sides)
+	for i := range points {
+		angle := 2 * math.Pi * float64(i) / float64(sides)
+		points[i] = [2]float64{cx + radius*math.Cos(angle), cy + radius*math.Sin(angle)}
+	}
+	return windClockwise(points)
+}
+
+// windClockwise reverses a polygon that winds the other way, in pixel
+// coordinates.
+func windClockwise(points [][2]float64) [][2]float64 {
+	area := 0.0
+	for i := range points {
+		p, q := points[i], points[(i+1)%len(points)]
+		area += p[0]*q[1] - q[0]*p[1]
+	}
+	if area < 0 {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	return points
+}
+
+// maxDashes caps the dashes of one stroke. A stroke that would need more is
+// drawn solid instead.
+const maxDashes = 100000
+
+// dashPolyline cuts a polyline into its dashes. Without dashes it returns the
+// polyline itself. Only the parts of the polyline inside clip are dashed; the
+// parts outside still advance the dash pattern so the visible dashes do not
+// shift.
+func dashPolyline(points [][2]float64, dashes []float64, clip [4]float64) [][][2]float64 {
+	if len(dashes) < 2 || dashes[0] <= 0 || dashes[1] <= 0 {
+		return [][][2]float64{points}
+	}
+	period := dashes[0] + dashes[1]
+	var pieces [][][2]float64
+	var current [][2]float64
+	flush := func() {
+		if len(current) > 1 {
+			pieces = append(pieces, current)
+		}
+		current = nil
+	}
+	// phase is the distance travelled into the current dash period.
+	phase := 0.0
+	for i := 1; i < len(points); i++ {
+		from, to := points[i-1], points[i]
+		length := math.Hypot(to[0]-from[0], to[1]-from[1])
+		t0, t1, visible := clipSegment(from, to, clip)
+		if !visible || length == 0 {
+			if !visible {
+				flush()
+			}
+			phase = math.Mod(phase+length, period)
+			continue
+		}
+		if t0 > 0 {
+			flush()
+		}
+		at := func(d float64) [2]float64 {
+			t := d / length
+			return [2]float64{from[0] + (to[0]-from[0])*t, from[1] + (to[1]-from[1])*t}
+		}
+		phase = math.Mod(phase+t0*length, period)
+		pos, end := t0*length, t1*length
+		for pos < end {
+			if phase < dashes[0] {
+				if len(current) == 0 {
+					current = append(current, at(pos))
+				}
+				if step := dashes[0] - phase; pos+step <= end {
+					pos, phase = pos+step, dashes[0]
+					current = append(current, at(pos))
+					flush()
+					if len(pieces) > maxDashes {
+						return [][][2]float64{points}
+					}
+				} else {
+					phase += end - pos
+					pos = end
+					current = append(current, at(pos))
+				}
+			} else if step := period - phase; pos+step <= end {
+				pos, phase = pos+step, 0
+			} else {
+				phase += end - pos
+				pos = end
+			}
+		}
+		if t1 < 1 {
+			flush()
+			phase = math.Mod(phase+(1-t1)*length, period)
+		}
+	}
+	flush()
+	return pieces
+}
+
+// clipSegment clips the segment from a to b to the rectangle clip
+// (minX, minY, maxX, maxY) and returns the parameters of the visible part.
+func clipSegment(a, b [2]float64, clip [4]float64) (t0, t1 float64, visible bool) {
+	t0, t1 = 0, 1
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	edges := [4][2]float64{
+		{-dx, a[0] - clip[0]},
+		{dx, clip[2] - a[0]},
+		{-dy, a[1] - clip[1]},
+		{dy, clip[3] - a[1]},
+	}
+	for _, e := range edges {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return 0, 0, false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return 0, 0, false
+		}
+	}
+	return t0, t1, true
+}
+
+// polygonsRect returns the pixels the polygons may touch, within limit.
+func polygonsRect(polygons [][][2]float64, limit image.Rectangle) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, polygon := range polygons {
+		for _, p := range polygon {
+			minX, minY = math.Min(minX, p[0]), math.Min(minY, p[1])
+			maxX, maxY = math.Max(maxX, p[0]), math.Max(maxY, p[1])
+		}
+	}
+	if minX > maxX || math.IsNaN(minX) || math.IsNaN(maxX) {
+		return image.Rectangle{}
+	}
+	rect := image.Rect(int(math.Floor(math.Max(minX, -1))), int(math.Floor(math.Max(minY, -1))),
+		int(math.Ceil(math.Min(maxX, float64(limit.Max.X+1)))), int(math.Ceil(math.Min(maxY, float64(limit.Max.Y+1)))))
+	return rect.Intersect(limit)
+}
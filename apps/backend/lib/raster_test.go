@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestClipSegment(t *testing.T) {
+	clip := [4]float64{0, 0, 10, 10}
+	tests := []struct {
+		name    string
+		a, b    [2]float64
+		t0, t1  float64
+		visible bool
+	}{
+		{name: "inside", a: [2]float64{1, 1}, b: [2]float64{9, 9}, t0: 0, t1: 1, visible: true},
+		{name: "crossing", a: [2]float64{-10, 5}, b: [2]float64{20, 5}, t0: 1.0 / 3, t1: 2.0 / 3, visible: true},
+		{name: "outside", a: [2]float64{-10, -10}, b: [2]float64{-1, 20}, visible: false},
+		{name: "parallel outside", a: [2]float64{-5, 20}, b: [2]float64{15, 20}, visible: false},
+		{name: "huge", a: [2]float64{-1e12, 5}, b: [2]float64{1e12, 5}, t0: 0.5, t1: 0.5 + 5e-12, visible: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t0, t1, visible := clipSegment(tt.a, tt.b, clip)
+			if visible != tt.visible {
+				t.Fatalf("visible = %v, want %v", visible, tt.visible)
+			}
+			if visible && (math.Abs(t0-tt.t0) > 1e-9 || math.Abs(t1-tt.t1) > 1e-9) {
+				t.Errorf("clipSegment = (%v, %v), want (%v, %v)", t0, t1, tt.t0, tt.t1)
+			}
+		})
+	}
+}
+
+func TestDashPolyline(t *testing.T) {
+	clip := [4]float64{0, 0, 100, 100}
+	tests := []struct {
+		name   string
+		points [][2]float64
+		dashes []float64
+		want   [][][2]float64
+	}{
+		{
+			name:   "solid",
+			points: [][2]float64{{0, 0}, {10, 0}},
+			want:   [][][2]float64{{{0, 0}, {10, 0}}},
+		},
+		{
+			name:   "dashed",
+			points: [][2]float64{{0, 0}, {10, 0}},
+			dashes: []float64{2, 3},
+			want:   [][][2]float64{{{0, 0}, {2, 0}}, {{5, 0}, {7, 0}}},
+		},
+		{
+			name:   "dash across a corner",
+			points: [][2]float64{{0, 0}, {1, 0}, {1, 2}},
+			dashes: []float64{2, 1},
+			want:   [][][2]float64{{{0, 0}, {1, 0}, {1, 1}}},
+		},
+		{
+			name:   "clipped keeps the phase",
+			points: [][2]float64{{-9, 50}, {6, 50}},
+			dashes: []float64{2, 3},
+			want:   [][][2]float64{{{1, 50}, {3, 50}}},
+		},
+		{
+			name:   "outside",
+			points: [][2]float64{{-50, -50}, {-10, -10}},
+			dashes: []float64{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dashPolyline(tt.points, tt.dashes, clip)
+			if !samePieces(got, tt.want) {
+				t.Errorf("dashPolyline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDashPolylineHugeStroke(t *testing.T) {
+	// A line far longer than the image must only be dashed where visible.
+	points := [][2]float64{{-1e6, 50}, {1e6, 50}}
+	pieces := dashPolyline(points, []float64{1, 1}, [4]float64{0, 0, 100, 100})
+	if len(pieces) > 51 {
+		t.Errorf("got %d dashes for a 100 pixel wide image", len(pieces))
+	}
+	for _, piece := range pieces {
+		for _, p := range piece {
+			if p[0] < 0 || p[0] > 100 {
+				t.Fatalf("dash point %v lies outside the image", p)
+			}
+		}
+	}
+}
+
+func samePieces(a, b [][][2]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if math.Abs(a[i][j][0]-b[i][j][0]) > 1e-9 || math.Abs(a[i][j][1]-b[i][j][1]) > 1e-9 {
+				return false
+			}
+		}
+	}
+	return true
+}
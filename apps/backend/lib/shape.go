@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Limits on text shapes.
+const (
+	MaxTextLength = 10000
+	MaxFontSize   = 1000
+)
+
+// Limits on shape geometry. Coordinates and sizes are bounded so that
+// exports never have to walk absurdly long outlines.
+const (
+	MaxCoordinate  = 1000000
+	MaxStrokeWidth = 500
+)
+
+// DefaultColor is the stroke color of shapes drawn without one.
+const DefaultColor = "#000000"
+
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+var fillStyles = map[FillStyle]bool{
+	FillNone:       true,
+	FillSolid:      true,
+	FillHachure:    true,
+	FillCrossHatch: true,
+}
+
+var strokeStyles = map[StrokeStyle]bool{
+	StrokeSolid:  true,
+	StrokeDashed: true,
+	StrokeDotted: true,
+}
+
+var arrowheads = map[Arrowhead]bool{
+	ArrowheadNone:     true,
+	ArrowheadArrow:    true,
+	ArrowheadTriangle: true,
+	ArrowheadCircle:   true,
+	ArrowheadBar:      true,
+}
+
+var textAligns = map[TextAlign]bool{
+	TextAlignLeft:   true,
+	TextAlignCenter: true,
+	TextAlignRight:  true,
+}
+
+// Validate checks the fields a client controls before a shape is stored and
+// fills in defaults for optional ones.
+func (s *Shape) Validate() error {
+	if s.Type != ShapeArrow {
+		s.StartShapeID, s.EndShapeID = nil, nil
+	}
+	if s.Type != ShapeImage {
+		s.AssetID = nil
+	}
+	switch s.Type {
+	case ShapeLine, ShapeRectangle, ShapePencil, ShapeEllipse:
+	case ShapeText:
+		if utf8.RuneCountInString(s.Text) > MaxTextLength {
+			return fmt.Errorf("text is longer than %d characters", MaxTextLength)
+		}
+		if !utf8.ValidString(s.Text) {
+			return fmt.Errorf("text is not valid UTF-8")
+		}
+		if s.FontSize <= 0 || s.FontSize > MaxFontSize || math.IsNaN(s.FontSize) {
+			return fmt.Errorf("font size must be between 0 and %d", MaxFontSize)
+		}
+		if s.TextAlign == "" {
+			s.TextAlign = TextAlignLeft
+		}
+		if !textAligns[s.TextAlign] {
+			return fmt.Errorf("unknown text alignment %q", s.TextAlign)
+		}
+		if s.WrapWidth < 0 || math.IsNaN(s.WrapWidth) || math.IsInf(s.WrapWidth, 0) {
+			return fmt.Errorf("wrap width must not be negative")
+		}
+	case ShapeArrow:
+		if s.StartArrowhead == "" {
+			s.StartArrowhead = ArrowheadNone
+		}
+		if s.EndArrowhead == "" {
+			s.EndArrowhead = ArrowheadArrow
+		}
+		if !arrowheads[s.StartArrowhead] || !arrowheads[s.EndArrowhead] {
+			return fmt.Errorf("unknown arrowhead %q or %q", s.StartArrowhead, s.EndArrowhead)
+		}
+		if (s.StartShapeID != nil && *s.StartShapeID == s.ID) || (s.EndShapeID != nil && *s.EndShapeID == s.ID) {
+			return fmt.Errorf("arrow %s cannot be bound to itself", s.ID)
+		}
+	case ShapeImage:
+		if s.AssetID == nil {
+			return fmt.Errorf("image %s has no asset", s.ID)
+		}
+	default:
+		return fmt.Errorf("unknown shape type %q", s.Type)
+	}
+	if s.StrokeWidth < 0 || s.StrokeWidth > MaxStrokeWidth || math.IsNaN(s.StrokeWidth) {
+		return fmt.Errorf("stroke width must be between 0 and %d", MaxStrokeWidth)
+	}
+	if err := s.validateGeometry(); err != nil {
+		return err
+	}
+	return s.validateStyle()
+}
+
+// validateGeometry checks that every coordinate and size of the shape is a
+// finite number within MaxCoordinate.
+func (s *Shape) validateGeometry() error {
+	values := []float64{s.X, s.Y, s.Width, s.Height, s.Radius, s.EndX, s.EndY, s.WrapWidth}
+	points, err := s.PointList()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		values = append(values, p[0], p[1])
+	}
+	for _, v := range values {
+		if math.IsNaN(v) || math.Abs(v) > MaxCoordinate {
+			return fmt.Errorf("coordinates of shape %s must be within ±%d", s.ID, MaxCoordinate)
+		}
+	}
+	return nil
+}
+
+// validateStyle checks the colors, dash pattern, opacity and rotation of a
+// shape. Unset fields get their defaults: a black solid stroke, a solid fill
+// when a fill color is given, full opacity and no rotation.
+func (s *Shape) validateStyle() error {
+	if s.Color == "" {
+		s.Color = DefaultColor
+	}
+	if !colorPattern.MatchString(s.Color) {
+		return fmt.Errorf("invalid color %q", s.Color)
+	}
+	if s.FillColor != "" && !colorPattern.MatchString(s.FillColor) {
+		return fmt.Errorf("invalid fill color %q", s.FillColor)
+	}
+	if s.FillStyle == "" {
+		s.FillStyle = FillNone
+		if s.FillColor != "" {
+			s.FillStyle = FillSolid
+		}
+	}
+	if !fillStyles[s.FillStyle] {
+		return fmt.Errorf("unknown fill style %q", s.FillStyle)
+	}
+	if s.StrokeStyle == "" {
+		s.StrokeStyle = StrokeSolid
+	}
+	if !strokeStyles[s.StrokeStyle] {
+		return fmt.Errorf("unknown stroke style %q", s.StrokeStyle)
+	}
+	// A shape nobody can see is never wanted, so 0 means "not set".
+	if s.Opacity == 0 {
+		s.Opacity = 1
+	}
+	if !(s.Opacity > 0 && s.Opacity <= 1) {
+		return fmt.Errorf("opacity must be between 0 and 1")
+	}
+	if math.IsNaN(s.Rotation) || math.IsInf(s.Rotation, 0) {
+		return fmt.Errorf("rotation must be a finite angle")
+	}
+	if s.Type == ShapeArrow {
+		s.Rotation = 0
+	}
+	s.Rotation = math.Mod(s.Rotation, 2*math.Pi)
+	if s.Rotation < 0 {
+		s.Rotation += 2 * math.Pi
+	}
+	return nil
+}
+
+// CopyCanvas copies shapes and layers into the room given by roomID. Every
+// shape, layer and group gets a fresh ID, and arrows, layers and images point
+// at the copies. assets maps asset IDs to the IDs of their copies; images
+// whose asset has no copy are left out, and arrows bound to a shape left out
+// are unbound. Text edit history is not copied.
+func CopyCanvas(roomID uuid.UUID, shapes []Shape, layers []Layer, assets map[uuid.UUID]uuid.UUID) ([]Shape, []Layer) {
+	layerIDs := make(map[uuid.UUID]uuid.UUID, len(layers))
+	copiedLayers := make([]Layer, len(layers))
+	for i, layer := range layers {
+		layerIDs[layer.ID] = uuid.New()
+		layer.ID, layer.RoomID = layerIDs[layer.ID], roomID
+		copiedLayers[i] = layer
+	}
+
+	shapeIDs := make(map[uuid.UUID]uuid.UUID, len(shapes))
+	groupIDs := make(map[uuid.UUID]uuid.UUID)
+	copied := make([]Shape, 0, len(shapes))
+	for _, shape := range shapes {
+		if shape.Type == ShapeImage {
+			if shape.AssetID == nil {
+				continue
+			}
+			assetID, ok := assets[*shape.AssetID]
+			if !ok {
+				continue
+			}
+			shape.AssetID = &assetID
+		}
+		shapeIDs[shape.ID] = uuid.New()
+		shape.ID, shape.RoomID = shapeIDs[shape.ID], roomID
+		if shape.GroupID != nil {
+			groupID, ok := groupIDs[*shape.GroupID]
+			if !ok {
+				groupID = uuid.New()
+				groupIDs[*shape.GroupID] = groupID
+			}
+			shape.GroupID = &groupID
+		}
+		if shape.LayerID != nil {
+			if layerID, ok := layerIDs[*shape.LayerID]; ok {
+				shape.LayerID = &layerID
+			} else {
+				shape.LayerID = nil
+			}
+		}
+		shape.TextRevision = 0
+		copied = append(copied, shape)
+	}
+
+	// Arrows can be bound to shapes that come after them.
+	for i := range copied {
+		copied[i].StartShapeID = copiedShapeID(shapeIDs, copied[i].StartShapeID)
+		copied[i].EndShapeID = copiedShapeID(shapeIDs, copied[i].EndShapeID)
+	}
+	return copied, copiedLayers
+}
+
+func copiedShapeID(shapeIDs map[uuid.UUID]uuid.UUID, shapeID *uuid.UUID) *uuid.UUID {
+	if shapeID == nil {
+		return nil
+	}
+	copied, ok := shapeIDs[*shapeID]
+	if !ok {
+		return nil
+	}
+	return &copied
+}
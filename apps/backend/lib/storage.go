@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AssetStorage stores the files of uploaded assets under opaque keys.
+type AssetStorage interface {
+	// Put stores the contents of r under key, replacing any previous file.
+	Put(key string, r io.Reader) error
+	// Open returns the file stored under key.
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the file stored under key. Deleting a missing file is
+	// not an error.
+	Delete(key string) error
+}
+
+// LocalStorage is an AssetStorage keeping files in a directory.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create asset directory %s: %w", dir, err)
+	}
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (l *LocalStorage) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid asset key %q", key)
+	}
+	return filepath.Join(l.dir, key), nil
+}
+
+// Put writes to a temporary file first so a reader never sees a partial file.
+func (l *LocalStorage) Put(key string, r io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to store asset %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to store asset %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store asset %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store asset %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *LocalStorage) Open(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (l *LocalStorage) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete asset %s: %w", key, err)
+	}
+	return nil
+}
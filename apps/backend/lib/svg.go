@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RenderSVG draws shapes, in the given order, as a standalone SVG document.
+func RenderSVG(shapes []Shape, opts ExportOptions) ([]byte, error) {
+	area := ExportArea(shapes, opts)
+	if !area.Valid() {
+		return nil, fmt.Errorf("invalid export area %+v", area)
+	}
+	width, height := area.MaxX-area.MinX, area.MaxY-area.MinY
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="%s %s %s %s">`,
+		svgNum(width), svgNum(height), svgNum(area.MinX), svgNum(area.MinY), svgNum(width), svgNum(height))
+	buf.WriteByte('\n')
+	if opts.Background != "" {
+		fill, opacity, err := svgColor(opts.Background)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, `<rect x="%s" y="%s" width="%s" height="%s" fill="%s" fill-opacity="%s"/>`+"\n",
+			svgNum(area.MinX), svgNum(area.MinY), svgNum(width), svgNum(height), fill, opacity)
+	}
+	for i := range shapes {
+		if err := writeSVGShape(&buf, &shapes[i], i, opts); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes(), nil
+}
+
+func writeSVGShape(buf *bytes.Buffer, s *Shape, index int, opts ExportOptions) error {
+	stroke, strokeOpacity, err := svgColor(s.Color)
+	if err != nil {
+		return err
+	}
+	strokeAttrs := fmt.Sprintf(`stroke="%s" stroke-opacity="%s" stroke-width="%s" stroke-linecap="round" stroke-linejoin="round"`,
+		stroke, strokeOpacity, svgNum(s.StrokeWidth))
+	if dashes := dashPattern(s.StrokeStyle, s.StrokeWidth); dashes != nil {
+		strokeAttrs += fmt.Sprintf(` stroke-dasharray="%s %s"`, svgNum(dashes[0]), svgNum(dashes[1]))
+	}
+	fillAttrs, err := writeSVGFill(buf, s, index)
+	if err != nil {
+		return err
+	}
+
+	group := `<g`
+	if s.Opacity > 0 && s.Opacity < 1 {
+		group += fmt.Sprintf(` opacity="%s"`, svgNum(s.Opacity))
+	}
+	if s.Rotation != 0 {
+		b, err := s.unrotatedBounds()
+		if err != nil {
+			return err
+		}
+		group += fmt.Sprintf(` transform="rotate(%s %s %s)"`, svgNum(s.Rotation*180/math.Pi),
+			svgNum((b.MinX+b.MaxX)/2), svgNum((b.MinY+b.MaxY)/2))
+	}
+	buf.WriteString(group + ">")
+
+	switch s.Type {
+	case ShapeRectangle:
+		x, y, w, h := normalizedBox(s)
+		fmt.Fprintf(buf, `<rect x="%s" y="%s" width="%s" height="%s" %s %s/>`,
+			svgNum(x), svgNum(y), svgNum(w), svgNum(h), fillAttrs, strokeAttrs)
+	case ShapeEllipse:
+		fmt.Fprintf(buf, `<ellipse cx="%s" cy="%s" rx="%s" ry="%s" %s %s/>`,
+			svgNum(s.X+s.Width/2), svgNum(s.Y+s.Height/2), svgNum(math.Abs(s.Width/2)), svgNum(math.Abs(s.Height/2)), fillAttrs, strokeAttrs)
+	case ShapeLine:
+		fmt.Fprintf(buf, `<line x1="%s" y1="%s" x2="%s" y2="%s" %s/>`,
+			svgNum(s.X), svgNum(s.Y), svgNum(s.EndX), svgNum(s.EndY), strokeAttrs)
+	case ShapeArrow:
+		fmt.Fprintf(buf, `<line x1="%s" y1="%s" x2="%s" y2="%s" %s/>`,
+			svgNum(s.X), svgNum(s.Y), svgNum(s.EndX), svgNum(s.EndY), strokeAttrs)
+		for _, mark := range s.arrowheadMarks() {
+			markFill := "none"
+			if mark.closed {
+				markFill = stroke
+			}
+			fmt.Fprintf(buf, `<path d="%s" fill="%s" fill-opacity="%s" stroke="%s" stroke-opacity="%s" stroke-width="%s" stroke-linecap="round" stroke-linejoin="round"/>`,
+				svgPath(mark.points, mark.closed), markFill, strokeOpacity, stroke, strokeOpacity, svgNum(s.StrokeWidth))
+		}
+	case ShapePencil:
+		points, err := s.PointList()
+		if err != nil {
+			return err
+		}
+		points = append([][2]float64{{s.X, s.Y}}, points...)
+		fmt.Fprintf(buf, `<path d="%s" fill="none" %s/>`, svgPath(points, false), strokeAttrs)
+	case ShapeText:
+		writeSVGText(buf, s, stroke, strokeOpacity)
+	case ShapeImage:
+		x, y, w, h := normalizedBox(s)
+		href := ""
+		if opts.LoadAsset != nil && s.AssetID != nil {
+			if contentType, data, err := opts.LoadAsset(*s.AssetID); err == nil {
+				href = "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+			}
+		}
+		if href != "" {
+			fmt.Fprintf(buf, `<image x="%s" y="%s" width="%s" height="%s" preserveAspectRatio="none" href="%s"/>`,
+				svgNum(x), svgNum(y), svgNum(w), svgNum(h), href)
+		} else {
+			fmt.Fprintf(buf, `<rect x="%s" y="%s" width="%s" height="%s" fill="none" stroke="#999999" stroke-dasharray="4 4"/>`,
+				svgNum(x), svgNum(y), svgNum(w), svgNum(h))
+		}
+	}
+	buf.WriteString("</g>\n")
+	return nil
+}
+
+// writeSVGFill writes any pattern a shape's fill needs and returns the fill
+// attributes for the shape. Only closed shapes are filled.
+func writeSVGFill(buf *bytes.Buffer, s *Shape, index int) (string, error) {
+	if s.FillColor == "" || s.FillStyle == FillNone || s.FillStyle == "" ||
+		(s.Type != ShapeRectangle && s.Type != ShapeEllipse) {
+		return `fill="none"`, nil
+	}
+	fill, opacity, err := svgColor(s.FillColor)
+	if err != nil {
+		return "", err
+	}
+	if s.FillStyle == FillSolid {
+		return fmt.Sprintf(`fill="%s" fill-opacity="%s"`, fill, opacity), nil
+	}
+
+	id := fmt.Sprintf("fill-%d", index)
+	gap := math.Max(s.StrokeWidth, 1) * 4
+	fmt.Fprintf(buf, `<defs><pattern id="%s" patternUnits="userSpaceOnUse" width="%s" height="%s" patternTransform="rotate(45)">`,
+		id, svgNum(gap), svgNum(gap))
+	line := `<line x1="0" y1="0" x2="%s" y2="%s" stroke="%s" stroke-opacity="%s" stroke-width="%s"/>`
+	fmt.Fprintf(buf, line, "0", svgNum(gap), fill, opacity, svgNum(math.Max(s.StrokeWidth/2, 1)))
+	if s.FillStyle == FillCrossHatch {
+		fmt.Fprintf(buf, line, svgNum(gap), "0", fill, opacity, svgNum(math.Max(s.StrokeWidth/2, 1)))
+	}
+	buf.WriteString("</pattern></defs>\n")
+	return fmt.Sprintf(`fill="url(#%s)"`, id), nil
+}
+
+func writeSVGText(buf *bytes.Buffer, s *Shape, fill, opacity string) {
+	width, _ := s.TextSize()
+	x, anchor := s.X, "start"
+	switch s.TextAlign {
+	case TextAlignCenter:
+		x, anchor = s.X+width/2, "middle"
+	case TextAlignRight:
+		x, anchor = s.X+width, "end"
+	}
+	fmt.Fprintf(buf, `<text font-family="sans-serif" font-size="%s" text-anchor="%s" fill="%s" fill-opacity="%s" xml:space="preserve">`,
+		svgNum(s.FontSize), anchor, fill, opacity)
+	for i, line := range s.TextLines() {
+		baseline := s.Y + float64(i)*s.FontSize*textLineHeight + s.FontSize
+		fmt.Fprintf(buf, `<tspan x="%s" y="%s">`, svgNum(x), svgNum(baseline))
+		xml.EscapeText(buf, []byte(line))
+		buf.WriteString("</tspan>")
+	}
+	buf.WriteString("</text>")
+}
+
+// normalizedBox returns the box of a rectangle-like shape with a positive
+// width and height.
+func normalizedBox(s *Shape) (x, y, w, h float64) {
+	x, y, w, h = s.X, s.Y, s.Width, s.Height
+	if w < 0 {
+		x, w = x+w, -w
+	}
+	if h < 0 {
+		y, h = y+h, -h
+	}
+	return x, y, w, h
+}
+
+// svgColor splits a "#RRGGBB[AA]" color into an SVG color and opacity.
+func svgColor(hex string) (string, string, error) {
+	c, err := ParseColor(hex)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B), svgNum(float64(c.A) / 255), nil
+}
+
+func svgPath(points [][2]float64, closed bool) string {
+	var b strings.Builder
+	for i, p := range points {
+		if i == 0 {
+			b.WriteString("M")
+		} else {
+			b.WriteString(" L")
+		}
+		b.WriteString(svgNum(p[0]) + " " + svgNum(p[1]))
+	}
+	if closed {
+		b.WriteString(" Z")
+	}
+	return b.String()
+}
+
+// svgNum formats a coordinate with at most two decimals.
+func svgNum(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextOperation is a character-level edit of a text shape, in the format used
+// by ot.js: a list where a positive number retains that many characters, a
+// negative number deletes that many and a string inserts it. Lengths count
+// Unicode code points. An operation must cover the whole text it applies to.
+//
+// Concurrent edits are merged with operational transformation: an edit based
+// on an older revision is transformed against every edit applied since, so
+// no user's typing overwrites another's.
+type TextOperation struct {
+	components []textComponent
+	// BaseLength is the length of the text the operation applies to and
+	// TargetLength the length of the result.
+	BaseLength   int
+	TargetLength int
+}
+
+type textComponent struct {
+	retain int
+	insert string
+	delete int
+}
+
+func (o *TextOperation) Retain(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	o.TargetLength += n
+	if last := o.last(); last != nil && last.retain > 0 {
+		last.retain += n
+	} else {
+		o.components = append(o.components, textComponent{retain: n})
+	}
+	return o
+}
+
+func (o *TextOperation) Insert(s string) *TextOperation {
+	if s == "" {
+		return o
+	}
+	o.TargetLength += utf8.RuneCountInString(s)
+	last := o.last()
+	switch {
+	case last != nil && last.insert != "":
+		last.insert += s
+	case last != nil && last.delete > 0:
+		// Keep inserts before deletes so equal operations look the same.
+		if n := len(o.components); n > 1 && o.components[n-2].insert != "" {
+			o.components[n-2].insert += s
+		} else {
+			o.components = append(o.components[:n-1], textComponent{insert: s}, *last)
+		}
+	default:
+		o.components = append(o.components, textComponent{insert: s})
+	}
+	return o
+}
+
+func (o *TextOperation) Delete(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLength += n
+	if last := o.last(); last != nil && last.delete > 0 {
+		last.delete += n
+	} else {
+		o.components = append(o.components, textComponent{delete: n})
+	}
+	return o
+}
+
+func (o *TextOperation) last() *textComponent {
+	if len(o.components) == 0 {
+		return nil
+	}
+	return &o.components[len(o.components)-1]
+}
+
+// Apply returns text with the operation applied.
+func (o *TextOperation) Apply(text string) (string, error) {
+	runes := []rune(text)
+	if len(runes) != o.BaseLength {
+		return "", fmt.Errorf("operation expects %d characters, text has %d", o.BaseLength, len(runes))
+	}
+	result := make([]rune, 0, o.TargetLength)
+	index := 0
+	for _, c := range o.components {
+		switch {
+		case c.retain > 0:
+			if c.retain > len(runes)-index {
+				return "", errors.New("operation retains past the end of the text")
+			}
+			result = append(result, runes[index:index+c.retain]...)
+			index += c.retain
+		case c.insert != "":
+			result = append(result, []rune(c.insert)...)
+		default:
+			if c.delete > len(runes)-index {
+				return "", errors.New("operation deletes past the end of the text")
+			}
+			index += c.delete
+		}
+	}
+	if index != len(runes) {
+		return "", fmt.Errorf("operation covers %d of %d characters", index, len(runes))
+	}
+	return string(result), nil
+}
+
+// TransformText transforms two operations a and b that apply to the same
+// text into a' and b' such that applying a then b' equals applying b then a'.
+// When both insert at the same place, a's insert comes first.
+func TransformText(a, b *TextOperation) (*TextOperation, *TextOperation, error) {
+	if a.BaseLength != b.BaseLength {
+		return nil, nil, errors.New("both operations must apply to the same text")
+	}
+	aPrime, bPrime := &TextOperation{}, &TextOperation{}
+	ops1, ops2 := a.components, b.components
+	i1, i2 := 0, 0
+	next := func(ops []textComponent, i *int) *textComponent {
+		if *i >= len(ops) {
+			return nil
+		}
+		c := ops[*i]
+		*i++
+		return &c
+	}
+	o1, o2 := next(ops1, &i1), next(ops2, &i2)
+
+	for o1 != nil || o2 != nil {
+		if o1 != nil && o1.insert != "" {
+			aPrime.Insert(o1.insert)
+			bPrime.Retain(utf8.RuneCountInString(o1.insert))
+			o1 = next(ops1, &i1)
+			continue
+		}
+		if o2 != nil && o2.insert != "" {
+			aPrime.Retain(utf8.RuneCountInString(o2.insert))
+			bPrime.Insert(o2.insert)
+			o2 = next(ops2, &i2)
+			continue
+		}
+		if o1 == nil || o2 == nil {
+			return nil, nil, errors.New("operations have different lengths")
+		}
+
+		switch {
+		case o1.retain > 0 && o2.retain > 0:
+			n := min(o1.retain, o2.retain)
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+			o1.retain -= n
+			o2.retain -= n
+		case o1.delete > 0 && o2.delete > 0:
+			// Both deleted the same characters; nothing left to do.
+			n := min(o1.delete, o2.delete)
+			o1.delete -= n
+			o2.delete -= n
+		case o1.delete > 0 && o2.retain > 0:
+			n := min(o1.delete, o2.retain)
+			aPrime.Delete(n)
+			o1.delete -= n
+			o2.retain -= n
+		case o1.retain > 0 && o2.delete > 0:
+			n := min(o1.retain, o2.delete)
+			bPrime.Delete(n)
+			o1.retain -= n
+			o2.delete -= n
+		}
+		if o1.retain == 0 && o1.delete == 0 {
+			o1 = next(ops1, &i1)
+		}
+		if o2.retain == 0 && o2.delete == 0 {
+			o2 = next(ops2, &i2)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+func (o TextOperation) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, 0, len(o.components))
+	for _, c := range o.components {
+		switch {
+		case c.retain > 0:
+			out = append(out, c.retain)
+		case c.insert != "":
+			out = append(out, c.insert)
+		default:
+			out = append(out, -c.delete)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (o *TextOperation) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*o = TextOperation{}
+	for _, value := range raw {
+		// Components are bounded one by one so lengths can't overflow, and
+		// the totals so no operation outgrows a text shape.
+		switch v := value.(type) {
+		case string:
+			if utf8.RuneCountInString(v) > MaxTextLength {
+				return fmt.Errorf("text operation inserts more than %d characters", MaxTextLength)
+			}
+			o.Insert(v)
+		case float64:
+			if v != math.Trunc(v) || v == 0 || math.Abs(v) > MaxTextLength {
+				return fmt.Errorf("invalid text operation component %v", v)
+			}
+			if v > 0 {
+				o.Retain(int(v))
+			} else {
+				o.Delete(int(-v))
+			}
+		default:
+			return fmt.Errorf("invalid text operation component %v", v)
+		}
+		if o.BaseLength > MaxTextLength || o.TargetLength > MaxTextLength {
+			return fmt.Errorf("text operation covers more than %d characters", MaxTextLength)
+		}
+	}
+	return nil
+}
+
+// Approximate glyph metrics, relative to the font size, used to size text
+// shapes on the server where no fonts are available.
+const (
+	textCharWidth  = 0.6
+	textLineHeight = 1.25
+)
+
+// TextLines splits the text of a text shape into the lines it is drawn as,
+// wrapping at WrapWidth when it is set.
+func (s *Shape) TextLines() []string {
+	var lines []string
+	perLine := 0
+	if s.WrapWidth > 0 && s.FontSize > 0 {
+		perLine = max(1, int(s.WrapWidth/(s.FontSize*textCharWidth)))
+	}
+	for _, paragraph := range strings.Split(s.Text, "\n") {
+		runes := []rune(paragraph)
+		for perLine > 0 && len(runes) > perLine {
+			// Break at the last space that fits, or mid-word if there is none.
+			cut := perLine
+			for i := perLine; i > 0; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			lines = append(lines, string(runes[:cut]))
+			runes = runes[cut:]
+			if runes[0] == ' ' {
+				runes = runes[1:]
+			}
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+// TextSize estimates the width and height of a text shape's box.
+func (s *Shape) TextSize() (float64, float64) {
+	lines := s.TextLines()
+	width := s.WrapWidth
+	if width <= 0 {
+		for _, line := range lines {
+			width = max(width, float64(utf8.RuneCountInString(line))*s.FontSize*textCharWidth)
+		}
+	}
+	return width, float64(len(lines)) * s.FontSize * textLineHeight
+}
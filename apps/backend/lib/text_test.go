@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func textOp(t *testing.T, raw string) *TextOperation {
+	t.Helper()
+	var op TextOperation
+	if err := json.Unmarshal([]byte(raw), &op); err != nil {
+		t.Fatalf("unmarshal %s: %v", raw, err)
+	}
+	return &op
+}
+
+func TestTextOperationApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		op      string
+		want    string
+		wantErr bool
+	}{
+		{name: "retain", text: "hello", op: `[5]`, want: "hello"},
+		{name: "insert", text: "hello", op: `[5, " world"]`, want: "hello world"},
+		{name: "delete", text: "hello world", op: `[5, -6]`, want: "hello"},
+		{name: "replace", text: "hello", op: `["j", -1, 4]`, want: "jello"},
+		{name: "code points", text: "héllo", op: `[1, -1, "e", 3]`, want: "hello"},
+		{name: "empty text", text: "", op: `["abc"]`, want: "abc"},
+		{name: "too short", text: "hello", op: `[4]`, wantErr: true},
+		{name: "too long", text: "hello", op: `[6]`, wantErr: true},
+		{name: "delete past end", text: "hello", op: `[3, -3]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := textOp(t, tt.op).Apply(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Apply(%q) = %q, want error", tt.text, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply(%q): %v", tt.text, err)
+			}
+			if got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		a, b string
+		want string
+	}{
+		{name: "inserts at different places", text: "abc", a: `["x", 3]`, b: `[3, "y"]`, want: "xabcy"},
+		{name: "inserts at the same place", text: "abc", a: `[1, "x", 2]`, b: `[1, "y", 2]`, want: "axybc"},
+		{name: "same delete", text: "abc", a: `[1, -1, 1]`, b: `[1, -1, 1]`, want: "ac"},
+		{name: "overlapping deletes", text: "abcdef", a: `[1, -3, 2]`, b: `[2, -3, 1]`, want: "af"},
+		{name: "insert inside delete", text: "abcdef", a: `[-6]`, b: `[3, "x", 3]`, want: "x"},
+		{name: "delete and retain", text: "abc", a: `[-1, 2]`, b: `[3, "!"]`, want: "bc!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := textOp(t, tt.a), textOp(t, tt.b)
+			aPrime, bPrime, err := TransformText(a, b)
+			if err != nil {
+				t.Fatalf("TransformText: %v", err)
+			}
+			// Both orders must converge on the same text.
+			for _, pair := range [][2]*TextOperation{{a, bPrime}, {b, aPrime}} {
+				mid, err := pair[0].Apply(tt.text)
+				if err != nil {
+					t.Fatalf("Apply first: %v", err)
+				}
+				got, err := pair[1].Apply(mid)
+				if err != nil {
+					t.Fatalf("Apply transformed: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformTextLengthMismatch(t *testing.T) {
+	if _, _, err := TransformText(textOp(t, `[3]`), textOp(t, `[4]`)); err == nil {
+		t.Fatal("TransformText accepted operations on different texts")
+	}
+}
+
+func TestTextOperationUnmarshalJSON(t *testing.T) {
+	long := strings.Repeat("a", MaxTextLength+1)
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{name: "valid", raw: `[2, "x", -1]`},
+		{name: "zero", raw: `[0]`, wantErr: true},
+		{name: "fraction", raw: `[1.5]`, wantErr: true},
+		{name: "huge retain", raw: `[1e300]`, wantErr: true},
+		{name: "huge delete", raw: `[-9223372036854775807]`, wantErr: true},
+		{name: "long insert", raw: `["` + long + `"]`, wantErr: true},
+		{name: "total too long", raw: `[10000, 10000]`, wantErr: true},
+		{name: "not a component", raw: `[true]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var op TextOperation
+			err := json.Unmarshal([]byte(tt.raw), &op)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Unmarshal error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -18,17 +18,51 @@ const (
 type MessageType string
 
 const (
-	MessageTypeJoin        MessageType = "join"
-	MessageTypeChat        MessageType = "chat"
-	MessageTypePing        MessageType = "ping"
-	MessageTypePong        MessageType = "pong"
-	MessageTypeStatus      MessageType = "status"
-	MessageTypeUserLeft    MessageType = "user_left"
-	MessageTypeDraw        MessageType = "draw"
-	MessageTypeUndo        MessageType = "undo"
-	MessageTypePencilChunk MessageType = "pencil_chunk"
-	MessageTypeErase       MessageType = "erase"
-	MessageTypeCursorMove  MessageType = "cursor_move"
+	MessageTypeJoin           MessageType = "join"
+	MessageTypeChat           MessageType = "chat"
+	MessageTypePing           MessageType = "ping"
+	MessageTypePong           MessageType = "pong"
+	MessageTypeStatus         MessageType = "status"
+	MessageTypeUserLeft       MessageType = "user_left"
+	MessageTypeDraw           MessageType = "draw"
+	MessageTypeUndo           MessageType = "undo"
+	MessageTypePencilChunk    MessageType = "pencil_chunk"
+	MessageTypeErase          MessageType = "erase"
+	MessageTypeEraseAt        MessageType = "erase_at"
+	MessageTypeCursorMove     MessageType = "cursor_move"
+	MessageTypeChatHistory    MessageType = "chat_history"
+	MessageTypeViewport       MessageType = "viewport"
+	MessageTypeViewportShapes MessageType = "viewport_shapes"
+	MessageTypeGroup          MessageType = "group"
+	MessageTypeUngroup        MessageType = "ungroup"
+	MessageTypeBatch          MessageType = "batch"
+	MessageTypeBringForward   MessageType = "bring_forward"
+	MessageTypeSendBackward   MessageType = "send_backward"
+	MessageTypeToFront        MessageType = "to_front"
+	MessageTypeToBack         MessageType = "to_back"
+	MessageTypeLayerCreate    MessageType = "layer_create"
+	MessageTypeLayerUpdate    MessageType = "layer_update"
+	MessageTypeLayerDelete    MessageType = "layer_delete"
+	MessageTypeLayerAssign    MessageType = "layer_assign"
+	MessageTypeTextEdit       MessageType = "text_edit"
+	MessageTypeArrowsUpdate   MessageType = "arrows_update"
+	MessageTypeVersionRestore MessageType = "version_restore"
+	MessageTypeStateReplace   MessageType = "state_replace"
+	MessageTypeReplayStart    MessageType = "replay_start"
+	MessageTypeReplayStop     MessageType = "replay_stop"
+	MessageTypeJoinRequest    MessageType = "join_request"
+	MessageTypeRoomUpdate     MessageType = "room_update"
+	MessageTypeRoomDelete     MessageType = "room_delete"
+	MessageTypeMemberRole     MessageType = "member_role"
+	MessageTypeMemberRemove   MessageType = "member_remove"
+	MessageTypeShapesImport   MessageType = "shapes_import"
+	MessageTypeShareRevoke    MessageType = "share_revoke"
+
+	MessageTypeInitialStateChunk MessageType = "initial_state_chunk"
+	MessageTypeInitialStateDone  MessageType = "initial_state_done"
+	MessageTypeReplayState       MessageType = "replay_state"
+	MessageTypeReplayOps         MessageType = "replay_ops"
+	MessageTypeReplayDone        MessageType = "replay_done"
 )
 
 type IncomingSignupPayload struct {
@@ -48,13 +82,44 @@ type IncomingRoomPayload struct {
 	IsPrivate   bool   `json:"IsPrivate" validate:"boolean_required"`
 }
 
+// IncomingRoomForkPayload overrides the settings a fork takes from its room;
+// fields left out are copied.
+type IncomingRoomForkPayload struct {
+	Name        *string `json:"Name" validate:"omitempty,min=5,max=30"`
+	Description *string `json:"Description" validate:"omitempty,min=10,max=100"`
+	IsPrivate   *bool   `json:"IsPrivate"`
+	CopyMembers bool    `json:"CopyMembers"`
+}
+
+// IncomingRoomSettingsPayload changes the settings of a room; fields left
+// out are kept.
+type IncomingRoomSettingsPayload struct {
+	Name        *string `json:"Name" validate:"omitempty,min=5,max=30"`
+	Description *string `json:"Description" validate:"omitempty,min=10,max=100"`
+	IsPrivate   *bool   `json:"IsPrivate"`
+}
+
 type IncomingRoomJoinPayload struct {
 	UserName string    `json:"UserName" validate:"required"`
 	RoomID   uuid.UUID `json:"RoomID" validate:"required,uuid"`
+	Role     Role      `json:"Role" validate:"omitempty,oneof=Admin Member"` // Member by default
+}
+
+// IncomingMemberRolePayload changes the role of a room member.
+type IncomingMemberRolePayload struct {
+	Role Role `json:"Role" validate:"required,oneof=Admin Member"`
+}
+
+// RoomMember is a member of a room with their role in it.
+type RoomMember struct {
+	ID       uuid.UUID `json:"id"`
+	UserName string    `json:"username"`
+	Role     Role      `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
 }
 
 type IncomingRoomNamePayload struct {
-	RoomName string `json:"RoomName" validate:"required",min=5,max=30`
+	RoomName string `json:"RoomName" validate:"required,min=5,max=30"`
 }
 
 type ReturnRoomsFormat struct {
@@ -63,6 +128,42 @@ type ReturnRoomsFormat struct {
 	UserName string    `json:"UserName"`
 }
 
+// RoomSummary describes a room in room listings.
+type RoomSummary struct {
+	ID             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	IsPrivate      bool      `json:"isPrivate"`
+	CreatorID      uuid.UUID `json:"creatorId"`
+	CreatorName    string    `json:"creatorName"`
+	MemberCount    int64     `json:"memberCount"`
+	LastActivityAt time.Time `json:"lastActivityAt"` // Creation time for rooms without activity
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// UserRoomSummary describes a room the user is a member of.
+type UserRoomSummary struct {
+	RoomSummary
+	Role        string `json:"role"`
+	UnreadCount int64  `json:"unreadCount"` // Chat messages by others the user hasn't seen
+	// OnlineUsers is who is in the room right now, nil when that is unknown.
+	OnlineUsers []OnlineUser `json:"onlineUsers" gorm:"-"`
+}
+
+// OnlineUser is a user connected to a room of the ws service.
+type OnlineUser struct {
+	ID       uuid.UUID `json:"id"`
+	UserName string    `json:"username"`
+}
+
+// RoomSort is the order of a room listing, always most first.
+type RoomSort string
+
+const (
+	RoomSortActivity RoomSort = "activity"
+	RoomSortMembers  RoomSort = "members"
+)
+
 type SenderInfo struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
@@ -73,12 +174,30 @@ type ContentInfo struct {
 }
 
 type ReturnMessageFormat struct {
+	ID        uint        `json:"id"`
 	Type      string      `json:"Type"`
 	Timestamp time.Time   `json:"timestamp"`
 	Sender    SenderInfo  `json:"sender"`
 	Content   ContentInfo `json:"content"`
 }
 
+// Chat history is paged by message ID rather than by offset so that pages stay
+// stable while new messages keep arriving.
+const (
+	DefaultChatPageSize = 50
+	MaxChatPageSize     = 100
+)
+
+// ChatHistoryPage is one page of chat history in chronological order.
+// Before and After are the cursors to pass back to fetch the older and newer
+// neighbouring pages respectively.
+type ChatHistoryPage struct {
+	Chats   []ReturnMessageFormat `json:"chats"`
+	HasMore bool                  `json:"hasMore"`
+	Before  uint                  `json:"before,omitempty"`
+	After   uint                  `json:"after,omitempty"`
+}
+
 type User struct {
 	ID        uuid.UUID `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
 	Email     string    `json:"email" gorm:"unqiue"`
@@ -99,6 +218,12 @@ type Room struct {
 	Description string    `json:"description"`
 	CreatorID   uuid.UUID `json:"creatorId" gorm:"type:uuid;not null"`
 	IsPrivate   bool      `json:"isPrivate" gorm:"default:false"`
+	// Sequence is bumped on every shape create/update/delete in the room, so
+	// it orders canvas operations and tells whether a snapshot is stale.
+	Sequence int64 `json:"sequence" gorm:"not null;default:0"`
+	// LastActivityAt is when a shape or chat message of the room last
+	// changed, nil if nothing happened since it was tracked.
+	LastActivityAt *time.Time `json:"lastActivityAt" gorm:"index"`
 
 	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime;column:created_at"`
 	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime;column:updated_at"`
@@ -114,7 +239,7 @@ type Message struct {
 	Type      MessageType `json:"type" gorm:"not null"`
 	Content   string      `json:"content" gorm:"not null"`
 	UserID    uuid.UUID   `json:"userId" gorm:"type:uuid;not null"`
-	RoomID    uuid.UUID   `json:"roomId" gorm:"type:uuid;not null"`
+	RoomID    uuid.UUID   `json:"roomId" gorm:"type:uuid;not null;index"`
 	CreatedAt time.Time   `json:"createdAt" gorm:"autoCreateTime;column:created_at"`
 	UpdatedAt time.Time   `json:"updatedAt" gorm:"autoUpdateTime;column:updated_at"`
 
@@ -131,6 +256,48 @@ const (
 	ShapeRectangle ShapeType = "rectangle"
 	ShapePencil    ShapeType = "pencil"
 	ShapeEllipse   ShapeType = "ellipse"
+	ShapeText      ShapeType = "text"
+	ShapeArrow     ShapeType = "arrow"
+	ShapeImage     ShapeType = "image"
+)
+
+// FillStyle is how the inside of a closed shape is painted.
+type FillStyle string
+
+const (
+	FillNone       FillStyle = "none"
+	FillSolid      FillStyle = "solid"
+	FillHachure    FillStyle = "hachure"
+	FillCrossHatch FillStyle = "cross-hatch"
+)
+
+// StrokeStyle is the dash pattern of a shape's outline.
+type StrokeStyle string
+
+const (
+	StrokeSolid  StrokeStyle = "solid"
+	StrokeDashed StrokeStyle = "dashed"
+	StrokeDotted StrokeStyle = "dotted"
+)
+
+// Arrowhead is the marker drawn at one end of an arrow.
+type Arrowhead string
+
+const (
+	ArrowheadNone     Arrowhead = "none"
+	ArrowheadArrow    Arrowhead = "arrow"
+	ArrowheadTriangle Arrowhead = "triangle"
+	ArrowheadCircle   Arrowhead = "circle"
+	ArrowheadBar      Arrowhead = "bar"
+)
+
+// TextAlign is the horizontal alignment of a text shape.
+type TextAlign string
+
+const (
+	TextAlignLeft   TextAlign = "left"
+	TextAlignCenter TextAlign = "center"
+	TextAlignRight  TextAlign = "right"
 )
 
 type IncomingShape struct {
@@ -155,8 +322,12 @@ type Shape struct {
 	ID uuid.UUID `json:"id" gorm:"primaryKey;type:uuid"`
 	// ... rest of the fields
 	// highlight-end
-	RoomID    uuid.UUID `json:"roomId" gorm:"type:uuid;not null;index"` // Which canvas it belongs to
-	CreatorID uuid.UUID `json:"creatorId" gorm:"type:uuid;not null"`    // Who drew it
+	RoomID    uuid.UUID  `json:"roomId" gorm:"type:uuid;not null;index"` // Which canvas it belongs to
+	CreatorID uuid.UUID  `json:"creatorId" gorm:"type:uuid;not null"`    // Who drew it
+	GroupID   *uuid.UUID `json:"groupId" gorm:"type:uuid;index"`         // Shapes sharing a group are selected together
+	LayerID   *uuid.UUID `json:"layerId" gorm:"type:uuid;index"`         // Nil for the room's base layer
+	// ZIndex is the fractional paint-order key within the layer, see zorder.go.
+	ZIndex string `json:"zIndex" gorm:"type:varchar(255);not null;default:''"`
 
 	Type ShapeType `json:"type" gorm:"type:varchar(20);not null"`
 	X    float64   `json:"x" gorm:"not null"`
@@ -168,12 +339,260 @@ type Shape struct {
 	EndX        float64        `json:"endX,omitempty"`
 	EndY        float64        `json:"endY,omitempty"`
 	Points      datatypes.JSON `json:"points,omitempty"`
-	Color       string         `json:"color" gorm:"type:varchar(7);default:'#000000'"`
+	Color       string         `json:"color" gorm:"type:varchar(9);default:'#000000'"`
 	StrokeWidth float64        `json:"strokeWidth" gorm:"default:2"`
-	CreatedAt   time.Time      `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt   time.Time      `json:"updatedAt" gorm:"autoUpdateTime"`
-	Room        Room           `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	Creator     User           `json:"-" gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	// Colors are "#RRGGBB" or "#RRGGBBAA". FillColor is empty for no fill.
+	FillColor   string      `json:"fillColor,omitempty" gorm:"type:varchar(9)"`
+	FillStyle   FillStyle   `json:"fillStyle,omitempty" gorm:"type:varchar(20)"`
+	StrokeStyle StrokeStyle `json:"strokeStyle,omitempty" gorm:"type:varchar(20)"`
+	Opacity     float64     `json:"opacity" gorm:"not null;default:1"` // 0 to 1 for the whole shape
+	// Rotation in radians, clockwise around the center of the shape's
+	// unrotated box. Arrows are never rotated; their ends are placed directly.
+	Rotation float64 `json:"rotation,omitempty" gorm:"not null;default:0"`
+	// Text shapes only. Text changes through text_edit messages, each of
+	// which bumps TextRevision; a WrapWidth of 0 means no wrapping.
+	Text         string    `json:"text,omitempty" gorm:"type:text"`
+	FontSize     float64   `json:"fontSize,omitempty"`
+	TextAlign    TextAlign `json:"textAlign,omitempty" gorm:"type:varchar(10)"`
+	WrapWidth    float64   `json:"wrapWidth,omitempty"`
+	TextRevision int64     `json:"textRevision" gorm:"not null;default:0"`
+	// Arrows only. An end bound to a shape follows it: the server keeps the
+	// end on the shape's outline whenever the shape changes, and unbinds it
+	// when the shape is deleted.
+	StartShapeID   *uuid.UUID `json:"startShapeId" gorm:"type:uuid;index"`
+	EndShapeID     *uuid.UUID `json:"endShapeId" gorm:"type:uuid;index"`
+	StartArrowhead Arrowhead  `json:"startArrowhead,omitempty" gorm:"type:varchar(20)"`
+	EndArrowhead   Arrowhead  `json:"endArrowhead,omitempty" gorm:"type:varchar(20)"`
+	// Images only: the uploaded asset drawn in the X/Y/Width/Height box.
+	AssetID *uuid.UUID `json:"assetId" gorm:"type:uuid;index"`
+	// Bounding box maintained by ComputeBounds and covered by a GiST index,
+	// used to load only the shapes near a viewport.
+	MinX      float64   `json:"minX" gorm:"not null;default:0"`
+	MinY      float64   `json:"minY" gorm:"not null;default:0"`
+	MaxX      float64   `json:"maxX" gorm:"not null;default:0"`
+	MaxY      float64   `json:"maxY" gorm:"not null;default:0"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+	Room      Room      `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Creator   User      `json:"-" gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	Layer     *Layer    `json:"-" gorm:"foreignKey:LayerID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	// An asset cannot be deleted while an image still shows it.
+	Asset *Asset `json:"-" gorm:"foreignKey:AssetID;constraint:OnUpdate:CASCADE;"`
+}
+
+// ZMove is a change of a shape's position in the paint order of its layer.
+type ZMove string
+
+const (
+	ZMoveForward  ZMove = "forward"
+	ZMoveBackward ZMove = "backward"
+	ZMoveToFront  ZMove = "front"
+	ZMoveToBack   ZMove = "back"
+)
+
+// Layer is a named, ordered set of shapes in a room whose visibility can be
+// toggled. Shapes without a layer are on the room's base layer, which is
+// painted below every named layer.
+type Layer struct {
+	ID        uuid.UUID `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	RoomID    uuid.UUID `json:"roomId" gorm:"type:uuid;not null;index"`
+	Name      string    `json:"name" gorm:"type:varchar(50);not null"`
+	ZIndex    string    `json:"zIndex" gorm:"type:varchar(255);not null"`
+	Visible   bool      `json:"visible" gorm:"not null;default:true"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+	Room      Room      `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// ShapeOperationType is the kind of change a ShapeOperation makes.
+type ShapeOperationType string
+
+const (
+	ShapeOpCreate ShapeOperationType = "create"
+	ShapeOpUpdate ShapeOperationType = "update"
+	ShapeOpDelete ShapeOperationType = "delete"
+)
+
+// ShapeOperation is one entry of a batch. Create and update carry the full
+// shape, delete only its ID.
+type ShapeOperation struct {
+	Op      ShapeOperationType `json:"op"`
+	Shape   *Shape             `json:"shape,omitempty"`
+	ShapeID uuid.UUID          `json:"shapeID,omitempty"`
+}
+
+// Asset is an uploaded file, such as the picture shown by an image shape. The
+// file itself lives in an AssetStorage under the asset's ID. Assets belong to
+// a room and only its members can use or download them.
+type Asset struct {
+	ID          uuid.UUID `json:"id" gorm:"primaryKey;type:uuid"`
+	RoomID      uuid.UUID `json:"roomId" gorm:"type:uuid;not null;index"`
+	UploaderID  uuid.UUID `json:"uploaderId" gorm:"type:uuid"`
+	ContentType string    `json:"contentType" gorm:"type:varchar(50);not null"`
+	Size        int64     `json:"size" gorm:"not null"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"autoCreateTime;index"`
+	Room        Room      `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Uploader    User      `json:"-" gorm:"foreignKey:UploaderID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+}
+
+// TextEdit is an edit applied to a text shape at Revision. Recent edits are
+// kept so that an edit based on an older revision can be transformed against
+// the ones applied since.
+type TextEdit struct {
+	ShapeID   uuid.UUID      `json:"shapeId" gorm:"primaryKey;type:uuid"`
+	Revision  int64          `json:"revision" gorm:"primaryKey"`
+	AuthorID  uuid.UUID      `json:"authorId" gorm:"type:uuid;not null"`
+	Operation datatypes.JSON `json:"operation" gorm:"not null"` // TextOperation
+	CreatedAt time.Time      `json:"createdAt" gorm:"autoCreateTime"`
+	Shape     Shape          `json:"-" gorm:"foreignKey:ShapeID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// RoomSnapshot is a compacted, serialized copy of every shape in a room as of
+// Sequence. Joins load it with a single read instead of querying every shape.
+type RoomSnapshot struct {
+	RoomID     uuid.UUID      `json:"roomId" gorm:"primaryKey;type:uuid"`
+	Sequence   int64          `json:"sequence" gorm:"not null"`
+	ShapeCount int            `json:"shapeCount" gorm:"not null"`
+	Format     int            `json:"-" gorm:"not null;default:0"` // see snapshotFormat
+	Shapes     datatypes.JSON `json:"shapes" gorm:"not null"`      // JSON array of Shape
+	CreatedAt  time.Time      `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt  time.Time      `json:"updatedAt" gorm:"autoUpdateTime"`
+	Room       Room           `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// CanvasVersion is a named copy of every shape and layer of a room, saved by
+// a user so the room can later be restored to it.
+type CanvasVersion struct {
+	ID         uuid.UUID      `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	RoomID     uuid.UUID      `json:"roomId" gorm:"type:uuid;not null;index"`
+	CreatorID  *uuid.UUID     `json:"creatorId" gorm:"type:uuid"`
+	Name       string         `json:"name" gorm:"type:varchar(100);not null"`
+	Sequence   int64          `json:"sequence" gorm:"not null"` // Room sequence the copy was taken at
+	ShapeCount int            `json:"shapeCount" gorm:"not null"`
+	Format     int            `json:"-" gorm:"not null;default:0"` // see snapshotFormat
+	Shapes     datatypes.JSON `json:"-" gorm:"not null"`           // JSON array of Shape in paint order
+	Layers     datatypes.JSON `json:"-" gorm:"not null"`           // JSON array of Layer
+	CreatedAt  time.Time      `json:"createdAt" gorm:"autoCreateTime;index"`
+	Room       Room           `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Creator    *User          `json:"-" gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+}
+
+// VersionAsset records that a version shows an asset, so the asset is kept
+// for as long as the version exists.
+type VersionAsset struct {
+	VersionID uuid.UUID      `gorm:"primaryKey;type:uuid"`
+	AssetID   uuid.UUID      `gorm:"primaryKey;type:uuid;index"`
+	Version   *CanvasVersion `gorm:"foreignKey:VersionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Asset     *Asset         `gorm:"foreignKey:AssetID;constraint:OnUpdate:CASCADE;"`
+}
+
+// RoomTemplate is a canvas published for reuse: new rooms can start as a copy
+// of its shapes and layers.
+type RoomTemplate struct {
+	ID          uuid.UUID       `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	CreatorID   *uuid.UUID      `json:"creatorId" gorm:"type:uuid"`
+	Name        string          `json:"name" gorm:"type:varchar(100);not null;index"`
+	Description string          `json:"description" gorm:"type:varchar(500);not null;default:''"`
+	ShapeCount  int             `json:"shapeCount" gorm:"not null"`
+	Format      int             `json:"-" gorm:"not null;default:0"` // see snapshotFormat
+	Shapes      datatypes.JSON  `json:"-" gorm:"not null"`           // JSON array of Shape in paint order
+	Layers      datatypes.JSON  `json:"-" gorm:"not null"`           // JSON array of Layer
+	CreatedAt   time.Time       `json:"createdAt" gorm:"autoCreateTime;index"`
+	UpdatedAt   time.Time       `json:"updatedAt" gorm:"autoUpdateTime"`
+	Creator     *User           `json:"-" gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	Assets      []TemplateAsset `json:"-" gorm:"foreignKey:TemplateID"`
+}
+
+// TemplateAsset is an image shown by a template. Templates outlive the rooms
+// they were published from, so they keep their own copy of each file, stored
+// under the template asset ID.
+type TemplateAsset struct {
+	ID          uuid.UUID     `json:"id" gorm:"primaryKey;type:uuid"`
+	TemplateID  uuid.UUID     `json:"templateId" gorm:"type:uuid;not null;index"`
+	ContentType string        `json:"contentType" gorm:"type:varchar(50);not null"`
+	Size        int64         `json:"size" gorm:"not null"`
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	Template    *RoomTemplate `json:"-" gorm:"foreignKey:TemplateID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// ShareRole is the access a share link gives to whoever joins with it.
+type ShareRole string
+
+const (
+	ShareRoleViewer ShareRole = "viewer" // Sees the canvas and chats, cannot edit
+	ShareRoleEditor ShareRole = "editor"
+)
+
+// ShareLink lets anyone holding its token join a room without being a member.
+// Only a hash of the token is stored; the token itself is shown once, when
+// the link is created.
+type ShareLink struct {
+	ID        uuid.UUID  `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	RoomID    uuid.UUID  `json:"roomId" gorm:"type:uuid;not null;index"`
+	CreatorID *uuid.UUID `json:"creatorId" gorm:"type:uuid"`
+	TokenHash string     `json:"-" gorm:"type:char(64);not null;uniqueIndex"`
+	Role      ShareRole  `json:"role" gorm:"type:varchar(10);not null"`
+	ExpiresAt *time.Time `json:"expiresAt"` // Nil for a link that doesn't expire
+	MaxUses   *int       `json:"maxUses"`   // Nil for a link without a limit
+	Uses      int        `json:"uses" gorm:"not null;default:0"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	Room      Room       `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Creator   *User      `json:"-" gorm:"foreignKey:CreatorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+}
+
+// ShareLinkRedemption records that a user has joined with a share link. A
+// link's uses count users, so joining again with the same link is free.
+type ShareLinkRedemption struct {
+	LinkID     uuid.UUID  `gorm:"primaryKey;type:uuid"`
+	UserID     uuid.UUID  `gorm:"primaryKey;type:uuid;index"`
+	RedeemedAt time.Time  `gorm:"autoCreateTime"`
+	Link       *ShareLink `gorm:"foreignKey:LinkID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	User       *User      `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// JoinRequestStatus is where a JoinRequest stands.
+type JoinRequestStatus string
+
+const (
+	JoinRequestPending  JoinRequestStatus = "pending"
+	JoinRequestApproved JoinRequestStatus = "approved"
+	JoinRequestDenied   JoinRequestStatus = "denied"
+)
+
+// JoinRequest asks the admins of a private room to let a user in. A user has
+// at most one pending request per room.
+type JoinRequest struct {
+	ID        uuid.UUID         `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	RoomID    uuid.UUID         `json:"roomId" gorm:"type:uuid;not null;index;uniqueIndex:idx_join_requests_pending,where:status = 'pending'"`
+	UserID    uuid.UUID         `json:"userId" gorm:"type:uuid;not null;uniqueIndex:idx_join_requests_pending,where:status = 'pending'"`
+	Message   string            `json:"message" gorm:"type:varchar(200);not null;default:''"`
+	Status    JoinRequestStatus `json:"status" gorm:"type:varchar(10);not null;default:'pending'"`
+	DeciderID *uuid.UUID        `json:"deciderId" gorm:"type:uuid"`
+	DecidedAt *time.Time        `json:"decidedAt"`
+	CreatedAt time.Time         `json:"createdAt" gorm:"autoCreateTime"`
+	Room      Room              `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	User      User              `json:"-" gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Decider   *User             `json:"-" gorm:"foreignKey:DeciderID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+}
+
+// ShapeEvent records one change to a shape: the shape as it was after a
+// create or update, or just its ID for a delete. Events are kept for the life
+// of the room so its history can be replayed.
+type ShapeEvent struct {
+	ID        int64              `json:"id" gorm:"primaryKey;autoIncrement"`
+	RoomID    uuid.UUID          `json:"roomId" gorm:"type:uuid;not null;index:idx_shape_events_room_sequence,priority:1"`
+	Sequence  int64              `json:"sequence" gorm:"not null;index:idx_shape_events_room_sequence,priority:2"` // Room sequence of the change
+	AuthorID  *uuid.UUID         `json:"authorId" gorm:"type:uuid"`
+	Op        ShapeOperationType `json:"op" gorm:"type:varchar(10);not null"`
+	ShapeID   uuid.UUID          `json:"shapeId" gorm:"type:uuid;not null"`
+	Shape     datatypes.JSON     `json:"shape,omitempty"` // Shape after the change, null for deletes
+	CreatedAt time.Time          `json:"createdAt" gorm:"autoCreateTime"`
+	Room      Room               `json:"-" gorm:"foreignKey:RoomID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Author    *User              `json:"-" gorm:"foreignKey:AuthorID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
 }
 
 // UserRoom - junction table for many-to-many relationship (optional explicit definition)
@@ -182,6 +601,10 @@ type UserRoom struct {
 	RoomID   uuid.UUID `json:"roomId" gorm:"type:uuid;primaryKey"`
 	JoinedAt time.Time `json:"joinedAt" gorm:"autoCreateTime;column:joined_at"`
 	Role     string    `json:"role" gorm:"default:'member'"` // member, admin, moderator
+	// LastReadMessageID is the newest chat message the user has seen, nil
+	// until they first open the room, when messages since JoinedAt count as
+	// unread.
+	LastReadMessageID *uint `json:"lastReadMessageId"`
 
 	// Relationships
 	User User `json:"user" gorm:"foreignKey:UserID"`
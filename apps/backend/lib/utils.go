@@ -10,14 +10,14 @@ import (
 )
 
 type CustomClaims struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
 	UserName string `json:"user_name"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(userID,userName string) (string, error) {
+func GenerateJWT(userID, userName string) (string, error) {
 	claims := CustomClaims{
-		UserID: userID,
+		UserID:   userID,
 		UserName: userName,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
@@ -69,8 +69,8 @@ func ValidatePayload(payload interface{}) error {
 func ValidateBooleanPayload(payload interface{}) error {
 	validate := validator.New()
 	validate.RegisterValidation("boolean_required", func(fl validator.FieldLevel) bool {
-    // This will always pass since the field is already a bool
-    return true
+		// This will always pass since the field is already a bool
+		return true
 	})
 	return validate.Struct(payload)
-}
\ No newline at end of file
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Z-order keys are base-62 fractions written without the leading "0.", using
+// digits whose byte order matches their value. Comparing two keys byte-wise
+// (COLLATE "C" in Postgres) therefore orders shapes, and a key strictly
+// between any two others always exists, so moving one shape never renumbers
+// the rest of the board. Keys never end in '0' and are never empty.
+const zDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// zIndexOrder is the SQL ordering expression for z-order keys.
+const zIndexOrder = `z_index COLLATE "C"`
+
+func zDigit(c byte) int {
+	return strings.IndexByte(zDigits, c)
+}
+
+// ValidZIndex reports whether key is a well-formed z-order key.
+func ValidZIndex(key string) bool {
+	if key == "" || key[len(key)-1] == '0' {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if zDigit(key[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ZIndexBetween returns a key that sorts strictly between a and b. An empty
+// a means "before everything" and an empty b "after everything".
+func ZIndexBetween(a, b string) (string, error) {
+	if (a != "" && !ValidZIndex(a)) || (b != "" && !ValidZIndex(b)) {
+		return "", fmt.Errorf("invalid z-index %q or %q", a, b)
+	}
+	if a != "" && b != "" && a >= b {
+		return "", fmt.Errorf("z-index %q is not below %q", a, b)
+	}
+	switch {
+	case b == "":
+		return zIndexAfter(a), nil
+	case a == "":
+		return zIndexBefore(b), nil
+	default:
+		return zMidpoint(a, b), nil
+	}
+}
+
+// zIndexAfter returns a short key above a. It bumps the first digit that can
+// be bumped, so appending to the top grows keys by one digit only every few
+// dozen moves.
+func zIndexAfter(a string) string {
+	if a == "" {
+		return "V"
+	}
+	if d := zDigit(a[0]); d < len(zDigits)-1 {
+		return string(zDigits[d+1])
+	}
+	return a[:1] + zIndexAfter(a[1:])
+}
+
+// zIndexBefore returns a key below b, the mirror image of zIndexAfter.
+func zIndexBefore(b string) string {
+	switch d := zDigit(b[0]); {
+	case d > 1:
+		return string(zDigits[d-1])
+	case d == 1:
+		return "0z"
+	default:
+		return "0" + zIndexBefore(b[1:])
+	}
+}
+
+// zMidpoint returns a key between a and b, where a < b and both are valid.
+func zMidpoint(a, b string) string {
+	// Skip the common prefix, padding a with zeros.
+	n := 0
+	for n < len(b) && zDigitAt(a, n) == b[n] {
+		n++
+	}
+	if n > 0 {
+		rest := ""
+		if n < len(a) {
+			rest = a[n:]
+		}
+		return b[:n] + zMidpointRest(rest, b[n:])
+	}
+	return zMidpointRest(a, b)
+}
+
+// zMidpointRest is zMidpoint once the keys differ in their first digit. a
+// may be empty (zero) and b may be empty (one).
+func zMidpointRest(a, b string) string {
+	digitA := 0
+	if a != "" {
+		digitA = zDigit(a[0])
+	}
+	digitB := len(zDigits)
+	if b != "" {
+		digitB = zDigit(b[0])
+	}
+	if digitB-digitA > 1 {
+		return string(zDigits[(digitA+digitB+1)/2])
+	}
+	// The first digits are adjacent.
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(zDigits[digitA]) + zMidpointRest(rest, "")
+}
+
+func zDigitAt(key string, i int) byte {
+	if i < len(key) {
+		return key[i]
+	}
+	return '0'
+}
+
+// SpreadZIndexes returns n increasing keys of equal length, evenly spaced.
+// It is used to assign keys to many existing shapes at once.
+func SpreadZIndexes(n int) []string {
+	base := len(zDigits)
+	width, capacity := 1, base
+	for capacity <= n {
+		width++
+		capacity *= base
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		value := (i + 1) * capacity / (n + 1)
+		digits := make([]byte, width)
+		for j := width - 1; j >= 0; j-- {
+			digits[j] = zDigits[value%base]
+			value /= base
+		}
+		keys[i] = strings.TrimRight(string(digits), "0")
+	}
+	return keys
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestZIndexBetween(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{name: "first key", a: "", b: ""},
+		{name: "after", a: "V", b: ""},
+		{name: "after the last digit", a: "z", b: ""},
+		{name: "before", a: "", b: "V"},
+		{name: "before the lowest digit", a: "", b: "1"},
+		{name: "wide gap", a: "A", b: "Z"},
+		{name: "adjacent digits", a: "A", b: "B"},
+		{name: "prefix", a: "A", b: "A1"},
+		{name: "shared prefix", a: "AB", b: "AC"},
+		{name: "longer lower key", a: "Azzz", b: "B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ZIndexBetween(tt.a, tt.b)
+			if err != nil {
+				t.Fatalf("ZIndexBetween(%q, %q): %v", tt.a, tt.b, err)
+			}
+			if !ValidZIndex(got) {
+				t.Fatalf("ZIndexBetween(%q, %q) = %q, not a valid key", tt.a, tt.b, got)
+			}
+			if (tt.a != "" && got <= tt.a) || (tt.b != "" && got >= tt.b) {
+				t.Errorf("ZIndexBetween(%q, %q) = %q, not strictly between", tt.a, tt.b, got)
+			}
+		})
+	}
+}
+
+func TestZIndexBetweenInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{name: "equal", a: "V", b: "V"},
+		{name: "reversed", a: "W", b: "V"},
+		{name: "trailing zero", a: "V0", b: ""},
+		{name: "bad digit", a: "", b: "V-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ZIndexBetween(tt.a, tt.b); err == nil {
+				t.Errorf("ZIndexBetween(%q, %q) = %q, want error", tt.a, tt.b, got)
+			}
+		})
+	}
+}
+
+func TestZIndexRepeatedInserts(t *testing.T) {
+	// Inserting again and again right above the same neighbour must keep
+	// finding room without ever colliding.
+	low, high := "A", "B"
+	for i := 0; i < 200; i++ {
+		mid, err := ZIndexBetween(low, high)
+		if err != nil {
+			t.Fatalf("insert %d between %q and %q: %v", i, low, high, err)
+		}
+		if mid <= low || mid >= high {
+			t.Fatalf("insert %d: %q is not between %q and %q", i, mid, low, high)
+		}
+		high = mid
+	}
+}
+
+func TestSpreadZIndexes(t *testing.T) {
+	for _, n := range []int{0, 1, 61, 62, 1000} {
+		keys := SpreadZIndexes(n)
+		if len(keys) != n {
+			t.Fatalf("SpreadZIndexes(%d) returned %d keys", n, len(keys))
+		}
+		for _, key := range keys {
+			if !ValidZIndex(key) {
+				t.Fatalf("SpreadZIndexes(%d) returned invalid key %q", n, key)
+			}
+		}
+		if !sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] }) {
+			t.Errorf("SpreadZIndexes(%d) is not increasing", n)
+		}
+		for i := 1; i < n; i++ {
+			if keys[i] == keys[i-1] {
+				t.Fatalf("SpreadZIndexes(%d) repeats key %q", n, keys[i])
+			}
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"sync"
 	"time"
@@ -19,6 +22,16 @@ import (
 type BroadcastPayload struct {
 	Type    lib.MessageType
 	Message *UserMessage
+	// Sequence is the room sequence a shape operation was recorded at, or 0
+	// for messages that don't change the canvas.
+	Sequence int64
+	// Bounds, when set, lets users filtering by viewport skip the message.
+	Bounds *lib.Bounds
+	// IncludeSender also delivers the message to the user who caused it, for
+	// results the sender could not have applied optimistically.
+	IncludeSender bool
+	// Recipients, when set, limits delivery to the given users.
+	Recipients map[uuid.UUID]bool
 }
 
 type UserMessage struct {
@@ -42,6 +55,95 @@ type User struct {
 	State    ConnectionState `json:"-"`
 	RoomID   *uuid.UUID      `json:"-"`
 	mu       sync.RWMutex    `json:"-"`
+
+	// While the initial canvas is streamed, broadcasts are buffered in
+	// pending instead of being written to Send.
+	streaming       bool
+	pending         []pendingBroadcast
+	pendingOverflow bool
+	registered      chan struct{}
+
+	// Viewport is the canvas area the client last reported. When
+	// filterByViewport is set, broadcasts outside of it are not delivered.
+	viewport         *lib.Bounds
+	filterByViewport bool
+
+	// replayStop is closed to stop the history replay streaming to the user.
+	replayStop chan struct{}
+
+	// readOnly is set for users who joined with a viewer share link, and
+	// shareLinkID to the link for everyone who joined with one.
+	readOnly    bool
+	shareLinkID *uuid.UUID
+
+	// done is closed when the connection is going away. Send is never
+	// closed, so blocking senders select on done instead.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// disconnect makes the writePump close the connection and unblocks everyone
+// sending to the user.
+func (u *User) disconnect() {
+	u.doneOnce.Do(func() { close(u.done) })
+}
+
+// startReplay stops the user's running replay, if any, and returns the
+// channel that stops the new one.
+func (u *User) startReplay() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.replayStop != nil {
+		close(u.replayStop)
+	}
+	u.replayStop = make(chan struct{})
+	return u.replayStop
+}
+
+// stopReplay stops the user's running replay, if any.
+func (u *User) stopReplay() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.replayStop != nil {
+		close(u.replayStop)
+		u.replayStop = nil
+	}
+}
+
+type pendingBroadcast struct {
+	data     []byte
+	sequence int64
+}
+
+// deliver queues a broadcast for the user, buffering it while the initial
+// state is streamed. It reports false if the user is too slow to keep up.
+func (u *User) deliver(data []byte, sequence int64, bounds *lib.Bounds) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if bounds != nil && u.filterByViewport && u.viewport != nil &&
+		!viewportWithMargin(*u.viewport).Intersects(*bounds) {
+		return true
+	}
+
+	if u.streaming {
+		if len(u.pending) >= maxPendingBroadcasts {
+			// Send can't be closed under a running stream, so the stream
+			// reports the failure once it finishes.
+			u.pending = nil
+			u.pendingOverflow = true
+		} else if !u.pendingOverflow {
+			u.pending = append(u.pending, pendingBroadcast{data: data, sequence: sequence})
+		}
+		return true
+	}
+
+	select {
+	case u.Send <- data:
+		return true
+	default:
+		return false
+	}
 }
 
 type Room struct {
@@ -51,6 +153,17 @@ type Room struct {
 	Register   chan *User
 	Unregister chan *User
 	mu         sync.RWMutex
+
+	// Snapshot compaction state, only touched by the Run goroutine.
+	sequence         int64
+	snapshotSequence int64
+	compacting       bool
+	compacted        chan *lib.RoomSnapshot
+	compactRequests  chan struct{}
+
+	// stop is closed to end the Run goroutine once the room is dropped.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 func NewRoom(ID uuid.UUID) RoomInterface {
@@ -61,6 +174,10 @@ func NewRoom(ID uuid.UUID) RoomInterface {
 		Register:   make(chan *User, 10),
 		Unregister: make(chan *User, 10),
 		mu:         sync.RWMutex{},
+		compacted:  make(chan *lib.RoomSnapshot, 1),
+
+		compactRequests: make(chan struct{}, 1),
+		stop:            make(chan struct{}),
 	}
 }
 
@@ -70,59 +187,128 @@ type RoomInterface interface {
 	logChannelStats()
 	RegisterUser(*User)
 	UnregisterUser(*User)
+	RemoveUser(*User) bool
 	BroadCastMessageChannel() chan *BroadcastPayload
 	GetRoomID() uuid.UUID
 	GetRWMutex() *sync.RWMutex
 	GetUsersN() int
+	OnlineUsers() []lib.OnlineUser
+	ConnectedUsers() []*User
+	RequestCompaction()
+	Stop()
 }
 
 func (r *Room) Run() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
+	snapshotTicker := time.NewTicker(snapshotInterval)
+	defer snapshotTicker.Stop()
 
 	for {
 		select {
 		case user := <-r.Register:
+			user.mu.Lock()
+			registered := user.registered
+			user.registered = nil
+			// A join that was given up on before it got here is dropped.
+			joining := user.RoomID != nil && *user.RoomID == r.ID
+			user.mu.Unlock()
+			if !joining {
+				continue
+			}
 			r.mu.Lock()
 			r.Users[user.ID] = user
 			r.mu.Unlock()
+			if registered != nil {
+				close(registered)
+			}
 			log.Printf("User %s (%s) joined room %s", user.ID, user.UserName, r.ID)
 
 		case user := <-r.Unregister:
-			r.mu.Lock()
-			if _, ok := r.Users[user.ID]; ok {
-				log.Printf("User %s (%s) left room %s", user.ID, user.UserName, r.ID)
-				delete(r.Users, user.ID)
-
-				leftMessage := &UserMessage{
-					UserID:   user.ID.String(),
-					UserName: user.UserName,
-					Message:  map[string]interface{}{"userID": user.ID.String()},
-				}
-				go r.broadcastMessage(&BroadcastPayload{
-					Type:    lib.MessageTypeUserLeft,
-					Message: leftMessage,
-				})
-
-			}
-			r.mu.Unlock()
+			r.RemoveUser(user)
 
 		case payload := <-r.BroadCast:
 			r.broadcastMessage(payload)
+			if payload.Sequence > r.sequence {
+				r.sequence = payload.Sequence
+			}
+			if r.sequence-r.snapshotSequence >= snapshotOpThreshold {
+				r.compactSnapshot()
+			}
+
+		case <-snapshotTicker.C:
+			if r.sequence > r.snapshotSequence {
+				r.compactSnapshot()
+			}
+
+		case <-r.compactRequests:
+			r.compactSnapshot()
+
+		case snapshot := <-r.compacted:
+			r.compacting = false
+			if snapshot != nil && snapshot.Sequence > r.snapshotSequence {
+				r.snapshotSequence = snapshot.Sequence
+			}
 
 		case <-ticker.C:
 			r.logChannelStats()
+
+		case <-r.stop:
+			log.Printf("Stopped room %s", r.ID)
+			return
 		}
 	}
 }
 
+// RequestCompaction asks the Run goroutine to rebuild the room snapshot, for
+// instance because a join had many shape events to apply on top of it.
+func (r *Room) RequestCompaction() {
+	select {
+	case r.compactRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the Run goroutine of a room that is no longer served.
+func (r *Room) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// compactSnapshot rebuilds the room snapshot in the background so that joins
+// don't have to replay every shape. At most one rebuild runs at a time.
+func (r *Room) compactSnapshot() {
+	if r.compacting {
+		return
+	}
+	r.compacting = true
+	go func() {
+		snapshot, err := lib.SnapshotRepositoryInstance.RebuildSnapshot(r.ID)
+		if err != nil {
+			log.Printf("Failed to compact snapshot for room %s: %v", r.ID, err)
+		} else {
+			log.Printf("Compacted %d shapes at sequence %d for room %s", snapshot.ShapeCount, snapshot.Sequence, r.ID)
+		}
+		r.compacted <- snapshot
+	}()
+}
+
 func (r *Room) broadcastMessage(payload *BroadcastPayload) {
+	for _, user := range r.deliverBroadcast(payload) {
+		log.Printf("Removing slow user %s from room %s", user.ID, r.ID)
+		r.RemoveUser(user)
+		user.disconnect()
+	}
+}
+
+// deliverBroadcast delivers a broadcast to the users of the room and returns
+// those too slow to take it.
+func (r *Room) deliverBroadcast(payload *BroadcastPayload) []*User {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	userMsg := payload.Message
 
-	broadcastData, err := json.Marshal(map[string]interface{}{
+	message := map[string]interface{}{
 		"Type": payload.Type, // Use the type from the payload (e.g., "draw", "chat", "undo")
 		"sender": map[string]string{
 			"id":   userMsg.UserID,
@@ -130,28 +316,34 @@ func (r *Room) broadcastMessage(payload *BroadcastPayload) {
 		},
 		"content":   userMsg.Message, // This is the shape, chat content, or undo info
 		"timestamp": time.Now().Unix(),
-	})
+	}
+	if payload.Sequence != 0 {
+		message["sequence"] = payload.Sequence
+	}
+	broadcastData, err := json.Marshal(message)
 	if err != nil {
 		log.Printf("Error marshaling broadcast message: %v", err)
-		return
+		return nil
 	}
 
 	log.Printf("Broadcasting '%s' message from %s to %d users in room %s", payload.Type, userMsg.UserName, len(r.Users)-1, r.ID)
 
+	var slow []*User
+
 	for userID, user := range r.Users {
 		// Don't send the message back to the original sender for actions they initiated
-		if user.ID.String() == userMsg.UserID && payload.Type != lib.MessageTypeUserLeft {
+		if user.ID.String() == userMsg.UserID && payload.Type != lib.MessageTypeUserLeft && !payload.IncludeSender {
+			continue
+		}
+		if payload.Recipients != nil && !payload.Recipients[userID] {
 			continue
 		}
 
-		select {
-		case user.Send <- broadcastData:
-		default:
-			log.Printf("Removing slow user %s from room %s", userID, r.ID)
-			delete(r.Users, userID)
-			close(user.Send)
+		if !user.deliver(broadcastData, payload.Sequence, payload.Bounds) {
+			slow = append(slow, user)
 		}
 	}
+	return slow
 }
 
 func (r *Room) logChannelStats() {
@@ -183,6 +375,29 @@ func (r *Room) UnregisterUser(user *User) {
 	}
 }
 
+// RemoveUser takes a user out of the room right away, unlike UnregisterUser,
+// and reports whether they were in it.
+func (r *Room) RemoveUser(user *User) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.Users[user.ID]; !ok || current != user {
+		return false
+	}
+	log.Printf("User %s (%s) left room %s", user.ID, user.UserName, r.ID)
+	delete(r.Users, user.ID)
+
+	leftMessage := &UserMessage{
+		UserID:   user.ID.String(),
+		UserName: user.UserName,
+		Message:  map[string]interface{}{"userID": user.ID.String()},
+	}
+	go r.broadcastMessage(&BroadcastPayload{
+		Type:    lib.MessageTypeUserLeft,
+		Message: leftMessage,
+	})
+	return true
+}
+
 func (r *Room) BroadCastMessageChannel() chan *BroadcastPayload {
 	return r.BroadCast
 }
@@ -201,6 +416,26 @@ func (r *Room) GetUsersN() int {
 	return len(r.Users)
 }
 
+func (r *Room) OnlineUsers() []lib.OnlineUser {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]lib.OnlineUser, 0, len(r.Users))
+	for _, user := range r.Users {
+		users = append(users, lib.OnlineUser{ID: user.ID, UserName: user.UserName})
+	}
+	return users
+}
+
+func (r *Room) ConnectedUsers() []*User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*User, 0, len(r.Users))
+	for _, user := range r.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
 type ChatServer struct {
 	Rooms map[uuid.UUID]RoomInterface
 	mu    sync.RWMutex
@@ -230,6 +465,7 @@ func (cs *ChatServer) handleConnection(userID uuid.UUID, userName string, conn *
 		Send:     make(chan []byte, 256),
 		State:    StateConnected,
 		RoomID:   nil,
+		done:     make(chan struct{}),
 	}
 
 	log.Printf("New connection established for user %s (%s)", user.ID, user.UserName)
@@ -243,6 +479,7 @@ func (cs *ChatServer) handleConnection(userID uuid.UUID, userName string, conn *
 			}
 			cs.mu.RUnlock()
 		}
+		user.disconnect()
 		conn.Close()
 	}()
 
@@ -253,7 +490,9 @@ func (cs *ChatServer) handleConnection(userID uuid.UUID, userName string, conn *
 func (cs *ChatServer) readPump(user *User) {
 	defer func() {
 		log.Printf("ReadPump closing for user %s", user.ID)
+		user.stopReplay()
 		if user.RoomID != nil {
+			markRoomRead(user.ID, *user.RoomID)
 			cs.mu.RLock()
 			if room, exists := cs.Rooms[*user.RoomID]; exists {
 				room.UnregisterUser(user)
@@ -317,7 +556,38 @@ func (cs *ChatServer) handlePreJoinMessage(user *User, msg *EnhancedMessage) {
 	}
 }
 
+// canvasEdits are the messages that change the canvas, which users with
+// read-only access cannot send.
+var canvasEdits = map[lib.MessageType]bool{
+	lib.MessageTypeDraw:           true,
+	lib.MessageTypePencilChunk:    true,
+	lib.MessageTypeUndo:           true,
+	lib.MessageTypeErase:          true,
+	lib.MessageTypeEraseAt:        true,
+	lib.MessageTypeGroup:          true,
+	lib.MessageTypeUngroup:        true,
+	lib.MessageTypeBatch:          true,
+	lib.MessageTypeBringForward:   true,
+	lib.MessageTypeSendBackward:   true,
+	lib.MessageTypeToFront:        true,
+	lib.MessageTypeToBack:         true,
+	lib.MessageTypeLayerCreate:    true,
+	lib.MessageTypeLayerUpdate:    true,
+	lib.MessageTypeLayerDelete:    true,
+	lib.MessageTypeLayerAssign:    true,
+	lib.MessageTypeTextEdit:       true,
+	lib.MessageTypeVersionRestore: true,
+}
+
 func (cs *ChatServer) handlePostJoinMessage(user *User, msg *EnhancedMessage) {
+	user.mu.RLock()
+	readOnly := user.readOnly
+	user.mu.RUnlock()
+	if readOnly && canvasEdits[msg.Type] {
+		cs.sendErrorToUser(user, "You have read-only access to this room")
+		return
+	}
+
 	switch msg.Type {
 	case lib.MessageTypePing:
 		cs.sendPongToUser(user)
@@ -331,12 +601,42 @@ func (cs *ChatServer) handlePostJoinMessage(user *User, msg *EnhancedMessage) {
 		cs.handleUndoMessage(user, msg)
 	case lib.MessageTypeErase:
 		cs.handleEraseMessage(user, msg)
+	case lib.MessageTypeEraseAt:
+		cs.handleEraseAtMessage(user, msg)
+	case lib.MessageTypeGroup:
+		cs.handleGroupMessage(user, msg)
+	case lib.MessageTypeUngroup:
+		cs.handleUngroupMessage(user, msg)
+	case lib.MessageTypeBatch:
+		cs.handleBatchMessage(user, msg)
+	case lib.MessageTypeBringForward, lib.MessageTypeSendBackward, lib.MessageTypeToFront, lib.MessageTypeToBack:
+		cs.handleZOrderMessage(user, msg)
+	case lib.MessageTypeLayerCreate:
+		cs.handleLayerCreateMessage(user, msg)
+	case lib.MessageTypeLayerUpdate:
+		cs.handleLayerUpdateMessage(user, msg)
+	case lib.MessageTypeLayerDelete:
+		cs.handleLayerDeleteMessage(user, msg)
+	case lib.MessageTypeLayerAssign:
+		cs.handleLayerAssignMessage(user, msg)
+	case lib.MessageTypeTextEdit:
+		cs.handleTextEditMessage(user, msg)
+	case lib.MessageTypeVersionRestore:
+		cs.handleVersionRestoreMessage(user, msg)
+	case lib.MessageTypeReplayStart:
+		cs.handleReplayStartMessage(user, msg)
+	case lib.MessageTypeReplayStop:
+		user.stopReplay()
 	case lib.MessageTypeJoin:
 		cs.sendErrorToUser(user, "Already joined a room")
 	case lib.MessageTypeUserLeft:
 		cs.handleLeaveRoom(user, msg)
 	case lib.MessageTypeCursorMove:
 		cs.handleCursorMoveMessage(user, msg)
+	case lib.MessageTypeChatHistory:
+		cs.handleChatHistoryMessage(user, msg)
+	case lib.MessageTypeViewport:
+		cs.handleViewportMessage(user, msg)
 	default:
 		log.Printf("Unknown message type '%s' from user %s", msg.Type, user.ID)
 	}
@@ -358,60 +658,1264 @@ func (cs *ChatServer) handleJoinRoom(user *User, msg *EnhancedMessage) {
 		cs.sendErrorToUser(user, "Invalid Room ID format")
 		return
 	}
-
-	log.Printf("User %s attempting to join room %s", user.ID, roomID)
-
-	isUserInRoom, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
-	if err != nil || !isUserInRoom {
-		log.Printf("Unauthorized join attempt by user %s to room %s", user.ID, roomID)
-		cs.sendErrorToUser(user, "You are not authorized to join this room.")
-		user.Conn.Close()
+
+	log.Printf("User %s attempting to join room %s", user.ID, roomID)
+
+	// An optional viewport limits the initial state to the visible area.
+	viewport, filter, err := viewportFromMessage(msg.Message["viewport"])
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+
+	// Members join with their membership; anyone else needs a share link
+	// token, which is used up the first time a user joins with it.
+	readOnly := false
+	var shareLinkID *uuid.UUID
+	isUserInRoom, err := lib.ChatRepositoryInstance.IsUserInRoom(user.ID, roomID)
+	if err == nil && !isUserInRoom {
+		token, _ := msg.Message["token"].(string)
+		if token != "" {
+			var linkID uuid.UUID
+			var role lib.ShareRole
+			linkID, role, err = lib.ShareLinkRepositoryInstance.RedeemShareLink(roomID, user.ID, token)
+			isUserInRoom = err == nil
+			readOnly = role == lib.ShareRoleViewer
+			if isUserInRoom {
+				shareLinkID = &linkID
+				log.Printf("User %s joining room %s with a %s share link", user.ID, roomID, role)
+			}
+		}
+	}
+	if err != nil || !isUserInRoom {
+		log.Printf("Unauthorized join attempt by user %s to room %s", user.ID, roomID)
+		cs.sendErrorToUser(user, "You are not authorized to join this room.")
+		user.Conn.Close()
+		return
+	}
+
+	// Live broadcasts are held back until the canvas has been streamed, so the
+	// user must be streaming before it is registered with the room.
+	registered := make(chan struct{})
+	user.mu.Lock()
+	user.State = StateJoined
+	user.RoomID = &roomID
+	user.streaming = true
+	user.pending = nil
+	user.pendingOverflow = false
+	user.registered = registered
+	user.viewport = viewport
+	user.filterByViewport = filter
+	user.readOnly = readOnly
+	user.shareLinkID = shareLinkID
+	user.mu.Unlock()
+
+	room := cs.GetRoom(roomID)
+	room.RegisterUser(user)
+	markRoomRead(user.ID, roomID)
+
+	go cs.streamInitialState(user, roomID, viewport, registered)
+}
+
+// markRoomRead marks the chat of a room as seen by a user joining or leaving
+// it; messages arriving in between are delivered live.
+func markRoomRead(userID, roomID uuid.UUID) {
+	if err := lib.ChatRepositoryInstance.MarkRoomRead(userID, roomID); err != nil {
+		log.Printf("Failed to mark room %s read for user %s: %v", roomID, userID, err)
+	}
+}
+
+// viewportFromMessage parses an optional viewport of the form
+// { "minX", "minY", "maxX", "maxY", "filter" }. filter asks for broadcasts
+// outside of the viewport to be skipped.
+func viewportFromMessage(value interface{}) (*lib.Bounds, bool, error) {
+	if value == nil {
+		return nil, false, nil
+	}
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid viewport format")
+	}
+	var viewport struct {
+		lib.Bounds
+		Filter bool `json:"filter"`
+	}
+	if err := json.Unmarshal(jsonBytes, &viewport); err != nil {
+		return nil, false, fmt.Errorf("Invalid viewport format")
+	}
+	if !viewport.Bounds.Valid() {
+		return nil, false, fmt.Errorf("Viewport must have minX <= maxX and minY <= maxY")
+	}
+	return &viewport.Bounds, viewport.Filter, nil
+}
+
+// viewportWithMargin grows a viewport by half of its larger side, so shapes
+// just off screen are already loaded when the user pans.
+func viewportWithMargin(viewport lib.Bounds) lib.Bounds {
+	size := math.Max(viewport.MaxX-viewport.MinX, viewport.MaxY-viewport.MinY)
+	return viewport.Expand(size * viewportMarginRatio)
+}
+
+// loadShapes returns the serialized shapes a user should receive together
+// with the room sequence they were read at: the whole room snapshot, or only
+// the shapes near the viewport when one is given.
+func (cs *ChatServer) loadShapes(roomID uuid.UUID, viewport *lib.Bounds) ([]json.RawMessage, int64, error) {
+	if viewport == nil {
+		snapshot, applied, err := lib.SnapshotRepositoryInstance.GetSnapshot(roomID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if applied >= snapshotJoinThreshold {
+			cs.mu.RLock()
+			room, exists := cs.Rooms[roomID]
+			cs.mu.RUnlock()
+			if exists {
+				room.RequestCompaction()
+			}
+		}
+		var shapes []json.RawMessage
+		if err := json.Unmarshal(snapshot.Shapes, &shapes); err != nil {
+			return nil, 0, fmt.Errorf("decoding snapshot for room %s: %w", roomID, err)
+		}
+		return shapes, snapshot.Sequence, nil
+	}
+
+	found, sequence, err := lib.ShapeRepositoryInstance.GetShapesInBounds(roomID, viewportWithMargin(*viewport))
+	if err != nil {
+		return nil, 0, err
+	}
+	shapes := make([]json.RawMessage, 0, len(found))
+	for _, shape := range found {
+		data, err := json.Marshal(shape)
+		if err != nil {
+			return nil, 0, fmt.Errorf("encoding shape %s: %w", shape.ID, err)
+		}
+		shapes = append(shapes, data)
+	}
+	return shapes, sequence, nil
+}
+
+// sendShapeChunks sends shapes to a user as bounded-size frames of the given
+// type and returns how many frames were sent.
+func (cs *ChatServer) sendShapeChunks(user *User, msgType lib.MessageType, shapes []json.RawMessage, sequence int64) (int, error) {
+	chunks := chunkShapes(shapes, initialStateChunkSize)
+	for index, chunk := range chunks {
+		chunkMsg := map[string]interface{}{
+			"Type": msgType,
+			"content": map[string]interface{}{
+				"shapes":      chunk,
+				"chunkIndex":  index,
+				"totalChunks": len(chunks),
+				"sequence":    sequence,
+			},
+		}
+		if err := cs.sendMessageToUserBlocking(user, chunkMsg); err != nil {
+			return index, err
+		}
+	}
+	return len(chunks), nil
+}
+
+// handleViewportMessage records the client's new viewport after a pan or zoom
+// and sends the shapes around it as viewport_shapes frames. Clients merge
+// these by shape ID.
+func (cs *ChatServer) handleViewportMessage(user *User, msg *EnhancedMessage) {
+	viewport, filter, err := viewportFromMessage(msg.Message)
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+
+	user.mu.Lock()
+	roomID := user.RoomID
+	user.viewport = viewport
+	user.filterByViewport = filter
+	user.mu.Unlock()
+	if roomID == nil {
+		cs.sendErrorToUser(user, "Not in a room")
+		return
+	}
+
+	go func() {
+		shapes, sequence, err := cs.loadShapes(*roomID, viewport)
+		if err != nil {
+			log.Printf("Error loading viewport shapes for room %s: %v", *roomID, err)
+			cs.sendErrorToUser(user, "Could not load shapes for the viewport.")
+			return
+		}
+		if _, err := cs.sendShapeChunks(user, lib.MessageTypeViewportShapes, shapes, sequence); err != nil {
+			log.Printf("Aborting viewport shapes for user %s: %v", user.ID, err)
+		}
+	}()
+}
+
+// streamInitialState sends the room snapshot to a joining user as a series of
+// bounded-size initial_state_chunk frames followed by initial_state_done.
+//
+// Broadcasts that reach the user while the snapshot is being loaded and sent
+// are buffered (see User.deliver). Once the stream is done the buffer is
+// flushed, skipping shape operations at or below the snapshot sequence since
+// those are already part of the snapshot.
+func (cs *ChatServer) streamInitialState(user *User, roomID uuid.UUID, viewport *lib.Bounds, registered chan struct{}) {
+	// Wait until the room has registered the user: every broadcast processed
+	// from then on is buffered, and everything before it is committed and
+	// therefore part of the snapshot loaded below.
+	select {
+	case <-registered:
+	case <-time.After(writeWait):
+		log.Printf("Timed out waiting for user %s to register with room %s", user.ID, roomID)
+		cs.finishInitialState(user, nil, "Could not join the room, please retry.")
+		cs.abandonJoin(user, roomID)
+		return
+	}
+
+	shapes, sequence, err := cs.loadShapes(roomID, viewport)
+	if err != nil {
+		log.Printf("Error loading shapes for room %s: %v", roomID, err)
+		cs.finishInitialState(user, nil, "Could not load canvas history.")
+		return
+	}
+
+	totalChunks, err := cs.sendShapeChunks(user, lib.MessageTypeInitialStateChunk, shapes, sequence)
+	if err != nil {
+		log.Printf("Aborting initial state stream for user %s: %v", user.ID, err)
+		cs.finishInitialState(user, nil, "Could not load canvas history.")
+		return
+	}
+
+	layers, err := lib.LayerRepositoryInstance.GetLayersByRoomID(roomID)
+	if err != nil {
+		log.Printf("Error fetching layers for room %s: %v", roomID, err)
+		cs.finishInitialState(user, nil, "Could not load canvas history.")
+		return
+	}
+
+	chats, err := lib.ChatRepositoryInstance.GetLatestMessages(roomID, lib.DefaultChatPageSize)
+	if err != nil {
+		// Chat is secondary to the canvas, so join without it.
+		log.Printf("Error fetching recent chats for room %s: %v", roomID, err)
+		chats = &lib.ChatHistoryPage{Chats: []lib.ReturnMessageFormat{}}
+	}
+
+	// The user object sent back should be minimal, only what the client needs
+	// to identify itself.
+	joiningUser := map[string]interface{}{
+		"userID": user.ID.String(),
+		"name":   user.UserName,
+	}
+
+	doneMsg := map[string]interface{}{
+		"Type": lib.MessageTypeInitialStateDone,
+		"content": map[string]interface{}{
+			"sequence":    sequence,
+			"shapeCount":  len(shapes),
+			"totalChunks": totalChunks,
+			"layers":      layers,
+			"chats":       chats,
+			"user":        joiningUser,
+		},
+	}
+	cs.finishInitialState(user, &streamResult{sequence: sequence, done: doneMsg}, "")
+	log.Printf("Streamed %d existing shapes in %d chunks at sequence %d to user %s for room %s", len(shapes), totalChunks, sequence, user.ID, roomID)
+}
+
+type streamResult struct {
+	sequence int64
+	done     map[string]interface{}
+}
+
+// finishInitialState takes the user out of streaming mode. On success it sends
+// the done frame and then the buffered broadcasts newer than the snapshot. The
+// buffer is flushed without holding the user lock, so a slow user doesn't
+// stall broadcasts to the room; the user keeps streaming until the buffer is
+// empty so no live broadcast can overtake it. On failure the buffer is dropped
+// and the user gets errorMsg.
+func (cs *ChatServer) finishInitialState(user *User, result *streamResult, errorMsg string) {
+	if result == nil {
+		stopStreaming(user)
+		cs.sendErrorToUser(user, errorMsg)
+		return
+	}
+
+	sentDone := false
+	for {
+		user.mu.Lock()
+		pending := user.pending
+		overflowed := user.pendingOverflow
+		user.pending = nil
+		if overflowed || (sentDone && len(pending) == 0) {
+			user.streaming = false
+			user.pendingOverflow = false
+		}
+		user.mu.Unlock()
+
+		if overflowed {
+			log.Printf("User %s fell too far behind while joining", user.ID)
+			cs.sendErrorToUser(user, "The canvas changed too quickly while loading, please rejoin.")
+			return
+		}
+		if !sentDone {
+			if err := cs.sendMessageToUserBlocking(user, result.done); err != nil {
+				log.Printf("Could not finish initial state for user %s: %v", user.ID, err)
+				stopStreaming(user)
+				return
+			}
+			sentDone = true
+		} else if len(pending) == 0 {
+			return
+		}
+		for _, broadcast := range pending {
+			if broadcast.sequence != 0 && broadcast.sequence <= result.sequence {
+				continue // Already part of the snapshot
+			}
+			if err := cs.sendBytesToUserBlocking(user, broadcast.data); err != nil {
+				log.Printf("Could not flush buffered broadcasts to user %s: %v", user.ID, err)
+				stopStreaming(user)
+				return
+			}
+		}
+	}
+}
+
+// stopStreaming takes the user out of streaming mode, dropping the buffer.
+func stopStreaming(user *User) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.streaming = false
+	user.pending = nil
+	user.pendingOverflow = false
+}
+
+// abandonJoin takes a user whose join failed back out of the room, unless
+// they have moved on to another room since.
+func (cs *ChatServer) abandonJoin(user *User, roomID uuid.UUID) {
+	user.mu.Lock()
+	if user.RoomID == nil || *user.RoomID != roomID {
+		user.mu.Unlock()
+		return
+	}
+	user.State = StateConnected
+	user.RoomID = nil
+	user.readOnly = false
+	user.shareLinkID = nil
+	user.registered = nil
+	user.mu.Unlock()
+
+	cs.mu.RLock()
+	room, exists := cs.Rooms[roomID]
+	cs.mu.RUnlock()
+	if exists {
+		room.RemoveUser(user)
+	}
+}
+
+// chunkShapes splits serialized shapes into chunks of roughly at most
+// maxBytes each. A single shape larger than maxBytes gets a chunk of its own.
+func chunkShapes(shapes []json.RawMessage, maxBytes int) [][]json.RawMessage {
+	chunks := [][]json.RawMessage{}
+	var current []json.RawMessage
+	size := 0
+	for _, shape := range shapes {
+		if len(current) > 0 && size+len(shape) > maxBytes {
+			chunks = append(chunks, current)
+			current = nil
+			size = 0
+		}
+		current = append(current, shape)
+		size += len(shape) + 1 // Separating comma
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+func (cs *ChatServer) handleEraseMessage(user *User, msg *EnhancedMessage) {
+	user.mu.RLock()
+	roomID := user.RoomID
+	user.mu.RUnlock()
+	if roomID == nil {
+		cs.sendErrorToUser(user, "Cannot erase, not in a room")
+		return
+	}
+
+	cs.mu.RLock()
+	room, exists := cs.Rooms[*roomID]
+	cs.mu.RUnlock()
+	if !exists {
+		cs.sendErrorToUser(user, "Room no longer exists")
+		return
+	}
+
+	shapeIDInterface, ok := msg.Message["shapeID"]
+	if !ok {
+		cs.sendErrorToUser(user, "shapeID is required for erase message")
+		return
+	}
+	shapeIDStr, ok := shapeIDInterface.(string)
+	if !ok {
+		cs.sendErrorToUser(user, "shapeID must be a string")
+		return
+	}
+
+	shapeID, err := uuid.Parse(shapeIDStr)
+	if err != nil {
+		cs.sendErrorToUser(user, "Invalid Shape ID format for erase")
+		return
+	}
+
+	// Delete the shape from the database
+	arrows, sequence, err := lib.ShapeRepositoryInstance.DeleteShape(*roomID, shapeID, user.ID)
+	if err != nil {
+		log.Printf("Failed to delete shape %s for erase: %v", shapeID, err)
+		// Don't send an error to the user, as the shape might have already been deleted.
+		// The client already performed the action optimistically.
+		return
+	}
+
+	// Broadcast the erase action to the room so other clients can remove the shape
+	userMessage := &UserMessage{
+		UserID:   user.ID.String(),
+		UserName: user.UserName,
+		Message: map[string]interface{}{
+			"shapeID": shapeID.String(),
+		},
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type:     lib.MessageTypeErase, // Use the new type
+		Message:  userMessage,
+		Sequence: sequence,
+	}
+	cs.broadcastArrows(user, room, arrows, sequence)
+}
+
+// handleEraseAtMessage erases every shape touched by an eraser, so clients
+// don't need to hit-test themselves. The client sends
+// { "point": [x, y] } or { "path": [[x, y], ...] } along with a "radius".
+// Candidates come from the bounds index and are then hit-tested exactly; all
+// hits are deleted together and announced in a single erase_at broadcast,
+// which the sender receives as well.
+func (cs *ChatServer) handleEraseAtMessage(user *User, msg *EnhancedMessage) {
+	user.mu.RLock()
+	roomID := user.RoomID
+	user.mu.RUnlock()
+	if roomID == nil {
+		cs.sendErrorToUser(user, "Cannot erase, not in a room")
+		return
+	}
+
+	cs.mu.RLock()
+	room, exists := cs.Rooms[*roomID]
+	cs.mu.RUnlock()
+	if !exists {
+		cs.sendErrorToUser(user, "Room no longer exists")
+		return
+	}
+
+	jsonBytes, err := json.Marshal(msg.Message)
+	if err != nil {
+		log.Printf("Error re-marshaling erase_at data from message: %v", err)
+		return
+	}
+	var eraser struct {
+		Point  []float64   `json:"point"`
+		Path   [][]float64 `json:"path"`
+		Radius float64     `json:"radius"`
+	}
+	if err := json.Unmarshal(jsonBytes, &eraser); err != nil {
+		cs.sendErrorToUser(user, "Invalid erase_at data format")
+		return
+	}
+	if eraser.Point != nil {
+		eraser.Path = append([][]float64{eraser.Point}, eraser.Path...)
+	}
+	if len(eraser.Path) == 0 || len(eraser.Path) > maxErasePathPoints {
+		cs.sendErrorToUser(user, fmt.Sprintf("erase_at needs a point or a path of at most %d points", maxErasePathPoints))
+		return
+	}
+	if eraser.Radius <= 0 || eraser.Radius > maxEraseRadius {
+		cs.sendErrorToUser(user, fmt.Sprintf("radius must be greater than 0 and at most %d", maxEraseRadius))
+		return
+	}
+	path := make([][2]float64, 0, len(eraser.Path))
+	for _, p := range eraser.Path {
+		if len(p) != 2 {
+			cs.sendErrorToUser(user, "Eraser points must be [x, y] pairs")
+			return
+		}
+		path = append(path, [2]float64{p[0], p[1]})
+	}
+	area := lib.PathBounds(path, eraser.Radius)
+	if !area.Valid() {
+		cs.sendErrorToUser(user, "Eraser points must be finite numbers")
+		return
+	}
+
+	candidates, _, err := lib.ShapeRepositoryInstance.GetShapesInBounds(*roomID, area)
+	if err != nil {
+		log.Printf("Failed to find shapes to erase in room %s: %v", *roomID, err)
+		cs.sendErrorToUser(user, "Could not erase.")
+		return
+	}
+	var hits []uuid.UUID
+	for i := range candidates {
+		hit, err := candidates[i].HitByPath(path, eraser.Radius)
+		if err != nil {
+			log.Printf("Skipping shape %s while erasing: %v", candidates[i].ID, err)
+			continue
+		}
+		if hit {
+			hits = append(hits, candidates[i].ID)
+		}
+	}
+	if len(hits) == 0 {
+		return
+	}
+
+	erased, arrows, sequence, err := lib.ShapeRepositoryInstance.DeleteShapes(*roomID, user.ID, hits)
+	if err != nil {
+		log.Printf("Failed to erase shapes in room %s: %v", *roomID, err)
+		cs.sendErrorToUser(user, "Could not erase.")
+		return
+	}
+	if len(erased) == 0 {
+		return // Someone else erased them first
+	}
+
+	shapeIDs := make([]string, 0, len(erased))
+	for _, id := range erased {
+		shapeIDs = append(shapeIDs, id.String())
+	}
+	userMessage := &UserMessage{
+		UserID:   user.ID.String(),
+		UserName: user.UserName,
+		Message: map[string]interface{}{
+			"shapeIDs": shapeIDs,
+		},
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type:          lib.MessageTypeEraseAt,
+		Message:       userMessage,
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+	cs.broadcastArrows(user, room, arrows, sequence)
+}
+
+// handleGroupMessage groups shapes so they are selected and moved together.
+// The client sends { "shapeIDs": [...], "groupID": "optional-uuid" }; a new
+// group ID is generated when none is given. Everyone, including the sender,
+// receives the resulting group ID.
+func (cs *ChatServer) handleGroupMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot group, not in a room")
+	if !ok {
+		return
+	}
+
+	shapeIDs, err := uuidsFromMessage(msg.Message, "shapeIDs")
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+	if len(shapeIDs) < 2 || len(shapeIDs) > maxBatchOperations {
+		cs.sendErrorToUser(user, fmt.Sprintf("A group needs between 2 and %d shapes", maxBatchOperations))
+		return
+	}
+
+	groupID := uuid.New()
+	if groupIDStr, ok := msg.Message["groupID"].(string); ok {
+		if groupID, err = uuid.Parse(groupIDStr); err != nil {
+			cs.sendErrorToUser(user, "Invalid Group ID format")
+			return
+		}
+	}
+
+	sequence, err := lib.ShapeRepositoryInstance.GroupShapes(roomID, groupID, user.ID, shapeIDs)
+	if err != nil {
+		log.Printf("Failed to group shapes in room %s: %v", roomID, err)
+		cs.sendErrorToUser(user, "Could not group shapes.")
+		return
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeGroup,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"groupID":  groupID.String(),
+				"shapeIDs": shapeIDs,
+			},
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// handleUngroupMessage dissolves a group. The client sends { "groupID": "uuid" }
+// and everyone receives the IDs of the shapes that were in it.
+func (cs *ChatServer) handleUngroupMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot ungroup, not in a room")
+	if !ok {
+		return
+	}
+
+	groupIDStr, ok := msg.Message["groupID"].(string)
+	if !ok {
+		cs.sendErrorToUser(user, "groupID is required for ungroup message")
+		return
+	}
+	groupID, err := uuid.Parse(groupIDStr)
+	if err != nil {
+		cs.sendErrorToUser(user, "Invalid Group ID format")
+		return
+	}
+
+	shapeIDs, sequence, err := lib.ShapeRepositoryInstance.UngroupShapes(roomID, groupID, user.ID)
+	if err != nil {
+		log.Printf("Failed to ungroup %s in room %s: %v", groupID, roomID, err)
+		cs.sendErrorToUser(user, "Could not ungroup shapes.")
+		return
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeUngroup,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"groupID":  groupID.String(),
+				"shapeIDs": shapeIDs,
+			},
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// handleBatchMessage applies many shape creates, updates and deletes at once,
+// e.g. for moving or deleting a multi-selection. The client sends
+// { "operations": [{ "op": "create"|"update", "shape": {...} } | { "op": "delete", "shapeID": "uuid" }] }.
+// The batch is applied in one transaction and broadcast once; if any
+// operation fails nothing is applied and the sender gets an error.
+func (cs *ChatServer) handleBatchMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot apply batch, not in a room")
+	if !ok {
+		return
+	}
+
+	jsonBytes, err := json.Marshal(msg.Message)
+	if err != nil {
+		log.Printf("Error re-marshaling batch data from message: %v", err)
+		return
+	}
+	var batch struct {
+		Operations []lib.ShapeOperation `json:"operations"`
+	}
+	if err := json.Unmarshal(jsonBytes, &batch); err != nil {
+		cs.sendErrorToUser(user, "Invalid batch data format")
+		return
+	}
+	if len(batch.Operations) == 0 || len(batch.Operations) > maxBatchOperations {
+		cs.sendErrorToUser(user, fmt.Sprintf("A batch needs between 1 and %d operations", maxBatchOperations))
+		return
+	}
+
+	arrows, sequence, err := lib.ShapeRepositoryInstance.ApplyBatch(roomID, user.ID, batch.Operations)
+	if err != nil {
+		log.Printf("Rejected batch from user %s in room %s: %v", user.ID, roomID, err)
+		cs.sendErrorToUser(user, "Batch rejected, no changes were applied.")
+		return
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeBatch,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"operations": batch.Operations,
+			},
+		},
+		Sequence: sequence,
+	}
+	cs.broadcastArrows(user, room, arrows, sequence)
+}
+
+// handleTextEditMessage applies a character-level edit to a text shape. The
+// client sends { "shapeID": "uuid", "revision": n, "operation": [...], "editID": "..." }
+// where revision is the text revision the edit was made on and operation is
+// an ot.js style operation (see lib.TextOperation). The server merges the edit
+// with any concurrent ones and broadcasts it, as applied, to everyone with the
+// new revision. The sender recognizes its own edit by editID.
+func (cs *ChatServer) handleTextEditMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot edit text, not in a room")
+	if !ok {
+		return
+	}
+
+	jsonBytes, err := json.Marshal(msg.Message)
+	if err != nil {
+		log.Printf("Error re-marshaling text edit from message: %v", err)
+		return
+	}
+	var edit struct {
+		ShapeID   uuid.UUID          `json:"shapeID"`
+		Revision  *int64             `json:"revision"`
+		Operation *lib.TextOperation `json:"operation"`
+		EditID    string             `json:"editID"`
+	}
+	if err := json.Unmarshal(jsonBytes, &edit); err != nil || edit.ShapeID == uuid.Nil || edit.Revision == nil || edit.Operation == nil {
+		cs.sendErrorToUser(user, "Invalid text edit format")
+		return
+	}
+
+	operation, shape, arrows, sequence, err := lib.ShapeRepositoryInstance.ApplyTextEdit(roomID, edit.ShapeID, user.ID, *edit.Revision, edit.Operation)
+	if errors.Is(err, lib.ErrStaleTextRevision) {
+		cs.sendErrorToUser(user, "Text is out of date, reload the shape.")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to edit text of shape %s in room %s: %v", edit.ShapeID, roomID, err)
+		cs.sendErrorToUser(user, "Could not apply text edit.")
+		return
+	}
+
+	bounds := shape.Bounds()
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeTextEdit,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"shapeID":   shape.ID.String(),
+				"revision":  shape.TextRevision,
+				"operation": operation,
+				"editID":    edit.EditID,
+				"bounds":    bounds,
+			},
+		},
+		Sequence:      sequence,
+		Bounds:        &bounds,
+		IncludeSender: true,
+	}
+	cs.broadcastArrows(user, room, arrows, sequence)
+}
+
+// broadcastArrows announces arrows that moved because shapes they are bound
+// to changed or were deleted. Everyone, including the sender, receives the
+// arrows in full under arrows_update.
+func (cs *ChatServer) broadcastArrows(user *User, room RoomInterface, arrows []lib.Shape, sequence int64) {
+	if len(arrows) == 0 {
+		return
+	}
+	bounds := arrows[0].Bounds()
+	for i := range arrows[1:] {
+		bounds = bounds.Union(arrows[i+1].Bounds())
+	}
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeArrowsUpdate,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"arrows": arrows,
+			},
+		},
+		Sequence:      sequence,
+		Bounds:        &bounds,
+		IncludeSender: true,
+	}
+}
+
+// zMoves maps the z-order messages to the move they make.
+var zMoves = map[lib.MessageType]lib.ZMove{
+	lib.MessageTypeBringForward: lib.ZMoveForward,
+	lib.MessageTypeSendBackward: lib.ZMoveBackward,
+	lib.MessageTypeToFront:      lib.ZMoveToFront,
+	lib.MessageTypeToBack:       lib.ZMoveToBack,
+}
+
+// handleZOrderMessage handles bring_forward, send_backward, to_front and
+// to_back, which all carry { "shapeID": "uuid" }. The new z-order key is
+// broadcast to everyone under the same message type.
+func (cs *ChatServer) handleZOrderMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot reorder, not in a room")
+	if !ok {
+		return
+	}
+
+	shapeIDStr, ok := msg.Message["shapeID"].(string)
+	if !ok {
+		cs.sendErrorToUser(user, "shapeID is required to reorder a shape")
+		return
+	}
+	shapeID, err := uuid.Parse(shapeIDStr)
+	if err != nil {
+		cs.sendErrorToUser(user, "Invalid Shape ID format")
+		return
+	}
+
+	zIndex, sequence, err := lib.ShapeRepositoryInstance.MoveShapeZ(roomID, shapeID, user.ID, zMoves[msg.Type])
+	if err != nil {
+		log.Printf("Failed to reorder shape %s in room %s: %v", shapeID, roomID, err)
+		cs.sendErrorToUser(user, "Could not reorder shape.")
+		return
+	}
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: msg.Type,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"shapeID": shapeID.String(),
+				"zIndex":  zIndex,
+			},
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// handleLayerCreateMessage adds a named layer on top of the room's layers.
+// The client sends { "name": "..." } and everyone receives the new layer.
+func (cs *ChatServer) handleLayerCreateMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot create layer, not in a room")
+	if !ok {
+		return
+	}
+
+	name, ok := msg.Message["name"].(string)
+	if !ok || name == "" || len(name) > maxLayerNameLength {
+		cs.sendErrorToUser(user, fmt.Sprintf("Layer name must be 1 to %d characters", maxLayerNameLength))
+		return
+	}
+
+	layer, sequence, err := lib.LayerRepositoryInstance.CreateLayer(roomID, name)
+	if err != nil {
+		log.Printf("Failed to create layer in room %s: %v", roomID, err)
+		cs.sendErrorToUser(user, "Could not create layer.")
+		return
+	}
+	cs.broadcastLayerChange(user, room, lib.MessageTypeLayerCreate, map[string]interface{}{"layer": layer}, sequence)
+}
+
+// handleLayerUpdateMessage renames a layer or toggles its visibility. The
+// client sends { "layerID": "uuid", "name": "...", "visible": bool }, with
+// name and visible optional.
+func (cs *ChatServer) handleLayerUpdateMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot update layer, not in a room")
+	if !ok {
+		return
+	}
+
+	layerID, err := layerIDFromMessage(msg.Message)
+	if err != nil || layerID == nil {
+		cs.sendErrorToUser(user, "A valid layerID is required")
+		return
+	}
+	var name *string
+	if value, exists := msg.Message["name"]; exists {
+		str, ok := value.(string)
+		if !ok || str == "" || len(str) > maxLayerNameLength {
+			cs.sendErrorToUser(user, fmt.Sprintf("Layer name must be 1 to %d characters", maxLayerNameLength))
+			return
+		}
+		name = &str
+	}
+	var visible *bool
+	if value, exists := msg.Message["visible"]; exists {
+		flag, ok := value.(bool)
+		if !ok {
+			cs.sendErrorToUser(user, "visible must be a boolean")
+			return
+		}
+		visible = &flag
+	}
+
+	layer, sequence, err := lib.LayerRepositoryInstance.UpdateLayer(roomID, *layerID, name, visible)
+	if err != nil {
+		log.Printf("Failed to update layer %s in room %s: %v", *layerID, roomID, err)
+		cs.sendErrorToUser(user, "Could not update layer.")
+		return
+	}
+	cs.broadcastLayerChange(user, room, lib.MessageTypeLayerUpdate, map[string]interface{}{"layer": layer}, sequence)
+}
+
+// handleLayerDeleteMessage removes a layer; its shapes move on top of the base
+// layer, and the broadcast gives their new z-index.
+// The client sends { "layerID": "uuid" }.
+func (cs *ChatServer) handleLayerDeleteMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot delete layer, not in a room")
+	if !ok {
+		return
+	}
+
+	layerID, err := layerIDFromMessage(msg.Message)
+	if err != nil || layerID == nil {
+		cs.sendErrorToUser(user, "A valid layerID is required")
+		return
+	}
+
+	shapes, sequence, err := lib.LayerRepositoryInstance.DeleteLayer(roomID, *layerID, user.ID)
+	if err != nil {
+		log.Printf("Failed to delete layer %s in room %s: %v", *layerID, roomID, err)
+		cs.sendErrorToUser(user, "Could not delete layer.")
+		return
+	}
+	cs.broadcastLayerChange(user, room, lib.MessageTypeLayerDelete, map[string]interface{}{
+		"layerID": layerID.String(),
+		"shapes":  movedShapes(shapes),
+	}, sequence)
+}
+
+// handleLayerAssignMessage moves shapes onto a layer, on top of its shapes.
+// The client sends { "layerID": "uuid" or null, "shapeIDs": [...] }, null
+// meaning the base layer. Everyone receives the new z-order key of each shape.
+func (cs *ChatServer) handleLayerAssignMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot move shapes, not in a room")
+	if !ok {
+		return
+	}
+
+	layerID, err := layerIDFromMessage(msg.Message)
+	if err != nil {
+		cs.sendErrorToUser(user, "Invalid Layer ID format")
+		return
+	}
+	shapeIDs, err := uuidsFromMessage(msg.Message, "shapeIDs")
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+	if len(shapeIDs) == 0 || len(shapeIDs) > maxBatchOperations {
+		cs.sendErrorToUser(user, fmt.Sprintf("Move between 1 and %d shapes at a time", maxBatchOperations))
+		return
+	}
+
+	shapes, sequence, err := lib.LayerRepositoryInstance.AssignShapesToLayer(roomID, user.ID, layerID, shapeIDs)
+	if err != nil {
+		log.Printf("Failed to move shapes to layer in room %s: %v", roomID, err)
+		cs.sendErrorToUser(user, "Could not move shapes to layer.")
+		return
+	}
+
+	cs.broadcastLayerChange(user, room, lib.MessageTypeLayerAssign, map[string]interface{}{
+		"layerID": layerID,
+		"shapes":  movedShapes(shapes),
+	}, sequence)
+}
+
+// movedShapes describes shapes that changed layer by their new z-index.
+func movedShapes(shapes []lib.Shape) []map[string]interface{} {
+	moved := make([]map[string]interface{}, 0, len(shapes))
+	for _, shape := range shapes {
+		moved = append(moved, map[string]interface{}{"id": shape.ID.String(), "zIndex": shape.ZIndex})
+	}
+	return moved
+}
+
+// broadcastLayerChange announces a layer change to everyone in the room.
+func (cs *ChatServer) broadcastLayerChange(user *User, room RoomInterface, msgType lib.MessageType, content map[string]interface{}, sequence int64) {
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: msgType,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message:  content,
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// handleVersionRestoreMessage replaces the whole canvas with a saved version.
+// The client sends { "versionID": "uuid" }. Everyone, the sender included,
+// receives a single state_replace message with every shape, in paint order,
+// and layer of the restored canvas, which replaces their local state. The
+// canvas as it was before is saved as a version first; it is sent along as
+// "backup".
+func (cs *ChatServer) handleVersionRestoreMessage(user *User, msg *EnhancedMessage) {
+	roomID, room, ok := cs.joinedRoom(user, "Cannot restore version, not in a room")
+	if !ok {
+		return
+	}
+	versionIDStr, ok := msg.Message["versionID"].(string)
+	if !ok {
+		cs.sendErrorToUser(user, "A versionID is required")
+		return
+	}
+	versionID, err := uuid.Parse(versionIDStr)
+	if err != nil {
+		cs.sendErrorToUser(user, "Invalid Version ID format")
+		return
+	}
+
+	backup, shapes, layers, sequence, err := lib.VersionRepositoryInstance.RestoreVersion(roomID, versionID, user.ID)
+	if errors.Is(err, lib.ErrVersionNotFound) {
+		cs.sendErrorToUser(user, "Version not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore version %s in room %s: %v", versionID, roomID, err)
+		cs.sendErrorToUser(user, "Could not restore version.")
+		return
+	}
+	log.Printf("User %s restored version %s with %d shapes in room %s", user.ID, versionID, len(shapes), roomID)
+
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeStateReplace,
+		Message: &UserMessage{
+			UserID:   user.ID.String(),
+			UserName: user.UserName,
+			Message: map[string]interface{}{
+				"versionID": versionID.String(),
+				"backup":    backup,
+				"shapes":    shapes,
+				"layers":    layers,
+			},
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// handleReplayStartMessage replays the history of the room to the user alone,
+// leaving the live room untouched. The message takes "from" and optionally
+// "to" (RFC 3339 times, "to" defaulting to now) and "speed" (a multiple of
+// real time, default 1).
+//
+// The user first receives replay_state frames, shaped like
+// initial_state_chunk, with the canvas as it was at "from". Then every change
+// made until "to" follows as a replay_ops message per room sequence, holding
+// its author, time and operations, with the pauses between changes scaled by
+// speed and capped at maxReplayPause. A replay_done message ends the replay.
+// A new replay_start, replay_stop or leaving the room stops the replay.
+//
+// Only changes made since shape history was recorded can be replayed.
+func (cs *ChatServer) handleReplayStartMessage(user *User, msg *EnhancedMessage) {
+	roomID, _, ok := cs.joinedRoom(user, "Cannot replay history, not in a room")
+	if !ok {
+		return
+	}
+	fromStr, ok := msg.Message["from"].(string)
+	if !ok {
+		cs.sendErrorToUser(user, "A from time is required")
+		return
+	}
+	from, err := time.Parse(time.RFC3339, fromStr)
+	if err != nil {
+		cs.sendErrorToUser(user, "from must be an RFC 3339 time")
+		return
+	}
+	to := time.Now()
+	if value, exists := msg.Message["to"]; exists && value != nil {
+		toStr, ok := value.(string)
+		if !ok {
+			cs.sendErrorToUser(user, "to must be an RFC 3339 time")
+			return
+		}
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			cs.sendErrorToUser(user, "to must be an RFC 3339 time")
+			return
+		}
+	}
+	if !from.Before(to) {
+		cs.sendErrorToUser(user, "from must be before to")
+		return
+	}
+	speed := 1.0
+	if value, exists := msg.Message["speed"]; exists && value != nil {
+		speed, ok = value.(float64)
+		if !ok || speed < minReplaySpeed || speed > maxReplaySpeed {
+			cs.sendErrorToUser(user, fmt.Sprintf("speed must be a number between %g and %g", minReplaySpeed, float64(maxReplaySpeed)))
+			return
+		}
+	}
+
+	stop := user.startReplay()
+	log.Printf("User %s replaying room %s from %s to %s at %gx", user.ID, roomID, from, to, speed)
+	go cs.replayHistory(user, roomID, from, to, speed, stop)
+}
+
+// replayOps is one replay_ops message: every change of a room sequence.
+type replayOps struct {
+	Sequence   int64                    `json:"sequence"`
+	Timestamp  time.Time                `json:"timestamp"`
+	Author     map[string]interface{}   `json:"author"`
+	Operations []map[string]interface{} `json:"operations"`
+}
+
+func (cs *ChatServer) replayHistory(user *User, roomID uuid.UUID, from, to time.Time, speed float64, stop <-chan struct{}) {
+	shapes, err := lib.HistoryRepositoryInstance.GetShapesAt(roomID, from)
+	if err != nil {
+		log.Printf("Error loading history of room %s: %v", roomID, err)
+		cs.sendErrorToUser(user, "Could not load canvas history.")
+		return
+	}
+	encoded := make([]json.RawMessage, len(shapes))
+	for i := range shapes {
+		if encoded[i], err = json.Marshal(&shapes[i]); err != nil {
+			log.Printf("Error encoding history of room %s: %v", roomID, err)
+			cs.sendErrorToUser(user, "Could not load canvas history.")
+			return
+		}
+	}
+	if _, err := cs.sendShapeChunks(user, lib.MessageTypeReplayState, encoded, 0); err != nil {
+		log.Printf("Aborting replay for user %s: %v", user.ID, err)
 		return
 	}
 
-	user.mu.Lock()
-	user.State = StateJoined
-	user.RoomID = &roomID
-	user.mu.Unlock()
-
-	room := cs.GetRoom(roomID)
-	room.RegisterUser(user)
+	var group *replayOps
+	sent := 0
+	flush := func() error {
+		if group == nil {
+			return nil
+		}
+		if replayStopped(user, stop) {
+			return errReplayStopped
+		}
+		sent++
+		return cs.sendMessageToUserBlocking(user, map[string]interface{}{
+			"Type":    lib.MessageTypeReplayOps,
+			"content": group,
+		})
+	}
 
-	// Fetch and send existing shapes in a separate goroutine
-	go func() {
-		shapes, err := lib.ShapeRepositoryInstance.GetShapesByRoomID(roomID)
+	last := from
+	var afterSequence, afterID int64
+	for {
+		events, err := lib.HistoryRepositoryInstance.GetEvents(roomID, from, to, afterSequence, afterID, replayPageSize)
 		if err != nil {
-			log.Printf("Error fetching shapes for room %s: %v", roomID, err)
+			log.Printf("Error loading history of room %s: %v", roomID, err)
 			cs.sendErrorToUser(user, "Could not load canvas history.")
 			return
 		}
-
-		// The user object sent back should be minimal, only what the client needs
-		// to identify itself.
-		joiningUser := map[string]interface{}{
-			"userID": user.ID.String(),
-			"name":   user.UserName,
+		for _, event := range events {
+			if group != nil && group.Sequence != event.Sequence {
+				if err := flush(); err != nil {
+					logReplayEnd(user, err)
+					return
+				}
+				group = nil
+			}
+			if group == nil {
+				pause := time.Duration(float64(event.CreatedAt.Sub(last)) / speed)
+				if !waitForReplay(pause, stop, user.done) {
+					return
+				}
+				last = event.CreatedAt
+				group = &replayOps{Sequence: event.Sequence, Timestamp: event.CreatedAt}
+				if event.Author != nil {
+					group.Author = map[string]interface{}{"id": event.Author.ID, "name": event.Author.UserName}
+				}
+			}
+			operation := map[string]interface{}{"op": event.Op, "shapeId": event.ShapeID}
+			if event.Op != lib.ShapeOpDelete {
+				operation["shape"] = event.Shape
+			}
+			group.Operations = append(group.Operations, operation)
+		}
+		if len(events) < replayPageSize {
+			break
 		}
+		afterSequence, afterID = events[len(events)-1].Sequence, events[len(events)-1].ID
+	}
+	if err := flush(); err != nil {
+		logReplayEnd(user, err)
+		return
+	}
 
-		initialStateMsg := map[string]interface{}{
-			"Type": "initial_state",
-			"content": map[string]interface{}{
-				"shapes": shapes,
-				"user":   joiningUser,
-			},
+	if replayStopped(user, stop) {
+		return
+	}
+	cs.sendMessageToUserBlocking(user, map[string]interface{}{
+		"Type": lib.MessageTypeReplayDone,
+		"content": map[string]interface{}{
+			"from":     from,
+			"to":       to,
+			"replayed": sent,
+		},
+	})
+}
+
+var errReplayStopped = errors.New("replay stopped")
+
+func logReplayEnd(user *User, err error) {
+	if !errors.Is(err, errReplayStopped) {
+		log.Printf("Aborting replay for user %s: %v", user.ID, err)
+	}
+}
+
+// replayStopped reports whether the replay was stopped or the user
+// disconnected.
+func replayStopped(user *User, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	case <-user.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForReplay sleeps for pause, capped at maxReplayPause, and reports false
+// if the replay was stopped or the user disconnected meanwhile.
+func waitForReplay(pause time.Duration, stop, done <-chan struct{}) bool {
+	pause = min(pause, maxReplayPause)
+	if pause <= 0 {
+		select {
+		case <-stop:
+			return false
+		case <-done:
+			return false
+		default:
+			return true
 		}
-		cs.sendMessageToUser(user, initialStateMsg)
-		log.Printf("Sent %d existing shapes and user info to user %s for room %s", len(shapes), user.ID, roomID)
-	}()
+	}
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
-func (cs *ChatServer) handleEraseMessage(user *User, msg *EnhancedMessage) {
+// layerIDFromMessage reads an optional "layerID"; a missing or null value
+// means the base layer.
+func layerIDFromMessage(message map[string]interface{}) (*uuid.UUID, error) {
+	value, exists := message["layerID"]
+	if !exists || value == nil {
+		return nil, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("layerID must be a string")
+	}
+	layerID, err := uuid.Parse(str)
+	if err != nil {
+		return nil, err
+	}
+	return &layerID, nil
+}
+
+// joinedRoom returns the room the user has joined, or sends notInRoomMsg
+// (or a missing-room error) to the user and reports false.
+func (cs *ChatServer) joinedRoom(user *User, notInRoomMsg string) (uuid.UUID, RoomInterface, bool) {
 	user.mu.RLock()
 	roomID := user.RoomID
 	user.mu.RUnlock()
 	if roomID == nil {
-		cs.sendErrorToUser(user, "Cannot erase, not in a room")
-		return
+		cs.sendErrorToUser(user, notInRoomMsg)
+		return uuid.Nil, nil, false
 	}
 
 	cs.mu.RLock()
@@ -419,47 +1923,34 @@ func (cs *ChatServer) handleEraseMessage(user *User, msg *EnhancedMessage) {
 	cs.mu.RUnlock()
 	if !exists {
 		cs.sendErrorToUser(user, "Room no longer exists")
-		return
+		return uuid.Nil, nil, false
 	}
+	return *roomID, room, true
+}
 
-	shapeIDInterface, ok := msg.Message["shapeID"]
-	if !ok {
-		cs.sendErrorToUser(user, "shapeID is required for erase message")
-		return
-	}
-	shapeIDStr, ok := shapeIDInterface.(string)
+// uuidsFromMessage reads a list of distinct UUID strings from a client message.
+func uuidsFromMessage(message map[string]interface{}, field string) ([]uuid.UUID, error) {
+	values, ok := message[field].([]interface{})
 	if !ok {
-		cs.sendErrorToUser(user, "shapeID must be a string")
-		return
-	}
-
-	shapeID, err := uuid.Parse(shapeIDStr)
-	if err != nil {
-		cs.sendErrorToUser(user, "Invalid Shape ID format for erase")
-		return
-	}
-
-	// Delete the shape from the database
-	if err := lib.ShapeRepositoryInstance.DeleteShape(shapeID); err != nil {
-		log.Printf("Failed to delete shape %s for erase: %v", shapeID, err)
-		// Don't send an error to the user, as the shape might have already been deleted.
-		// The client already performed the action optimistically.
-		return
-	}
-
-	// Broadcast the erase action to the room so other clients can remove the shape
-	userMessage := &UserMessage{
-		UserID:   user.ID.String(),
-		UserName: user.UserName,
-		Message: map[string]interface{}{
-			"shapeID": shapeID.String(),
-		},
-	}
-
-	room.BroadCastMessageChannel() <- &BroadcastPayload{
-		Type:    lib.MessageTypeErase, // Use the new type
-		Message: userMessage,
+		return nil, fmt.Errorf("%s must be a list of IDs", field)
+	}
+	seen := make(map[uuid.UUID]bool, len(values))
+	ids := make([]uuid.UUID, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of IDs", field)
+		}
+		id, err := uuid.Parse(str)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ID %q in %s", str, field)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
 	}
+	return ids, nil
 }
 
 func (cs *ChatServer) handleChatMessage(user *User, msg *EnhancedMessage) {
@@ -500,6 +1991,61 @@ func (cs *ChatServer) handleChatMessage(user *User, msg *EnhancedMessage) {
 	}
 }
 
+// handleChatHistoryMessage sends the requesting user one page of older (or
+// newer) chat messages. The client sends { "before": id, "after": id, "limit": n },
+// all optional, mirroring the /room/chats HTTP endpoint.
+func (cs *ChatServer) handleChatHistoryMessage(user *User, msg *EnhancedMessage) {
+	user.mu.RLock()
+	roomID := user.RoomID
+	user.mu.RUnlock()
+	if roomID == nil {
+		cs.sendErrorToUser(user, "Not in a room")
+		return
+	}
+
+	before, err := cursorFromMessage(msg.Message, "before")
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+	after, err := cursorFromMessage(msg.Message, "after")
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+	limit, err := cursorFromMessage(msg.Message, "limit")
+	if err != nil {
+		cs.sendErrorToUser(user, err.Error())
+		return
+	}
+
+	page, err := lib.ChatRepositoryInstance.GetRoomMessagesPage(*roomID, before, after, int(limit))
+	if err != nil {
+		log.Printf("Error fetching chat history for room %s: %v", *roomID, err)
+		cs.sendErrorToUser(user, "Could not load chat history.")
+		return
+	}
+
+	cs.sendMessageToUser(user, map[string]interface{}{
+		"Type":    lib.MessageTypeChatHistory,
+		"content": page,
+	})
+}
+
+// cursorFromMessage reads an optional non-negative integer field from a client
+// message. JSON numbers arrive as float64, so fractional values are rejected.
+func cursorFromMessage(message map[string]interface{}, field string) (uint, error) {
+	value, exists := message[field]
+	if !exists || value == nil {
+		return 0, nil
+	}
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != float64(uint(number)) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", field)
+	}
+	return uint(number), nil
+}
+
 func (cs *ChatServer) handleDrawMessage(user *User, msg *EnhancedMessage) {
 	user.mu.RLock()
 	roomID := user.RoomID
@@ -545,11 +2091,22 @@ func (cs *ChatServer) handleDrawMessage(user *User, msg *EnhancedMessage) {
 	shape.RoomID = *roomID
 	shape.CreatorID = user.ID
 
-	if err := lib.ShapeRepositoryInstance.CreateShape(&shape); err != nil {
+	sequence, err := lib.ShapeRepositoryInstance.CreateShape(&shape)
+	if err != nil {
 		log.Printf("Failed to persist shape: %v", err)
 		cs.sendErrorToUser(user, "Could not save your drawing.")
 		return
 	}
+	if shape.Type == lib.ShapeArrow {
+		// The server placed the bound ends, so everyone, including the
+		// sender, gets the arrow as stored.
+		msg.Message["x"], msg.Message["y"] = shape.X, shape.Y
+		msg.Message["endX"], msg.Message["endY"] = shape.EndX, shape.EndY
+		msg.Message["startShapeId"], msg.Message["endShapeId"] = shape.StartShapeID, shape.EndShapeID
+	}
+	if _, ok := msg.Message["textRevision"]; ok || shape.Type == lib.ShapeText {
+		msg.Message["textRevision"] = shape.TextRevision
+	}
 
 	// The message to broadcast is the original message content from the client.
 	// This ensures the ID matches what the client optimistically created.
@@ -559,9 +2116,13 @@ func (cs *ChatServer) handleDrawMessage(user *User, msg *EnhancedMessage) {
 		Message:  msg.Message,
 	}
 
+	bounds := shape.Bounds()
 	room.BroadCastMessageChannel() <- &BroadcastPayload{
-		Type:    lib.MessageTypeDraw,
-		Message: userMessage,
+		Type:          lib.MessageTypeDraw,
+		Message:       userMessage,
+		Sequence:      sequence,
+		Bounds:        &bounds,
+		IncludeSender: shape.Type == lib.ShapeArrow,
 	}
 }
 
@@ -634,7 +2195,12 @@ func (cs *ChatServer) handleUndoMessage(user *User, msg *EnhancedMessage) {
 	}
 
 	// Delete the shape from the database
-	if err := lib.ShapeRepositoryInstance.DeleteShape(shapeID); err != nil {
+	arrows, sequence, err := lib.ShapeRepositoryInstance.DeleteShape(*roomID, shapeID, user.ID)
+	if errors.Is(err, lib.ErrShapeNotFound) {
+		cs.sendErrorToUser(user, "Shape not found")
+		return
+	}
+	if err != nil {
 		log.Printf("Failed to delete shape %s: %v", shapeID, err)
 		cs.sendErrorToUser(user, "Could not perform undo operation.")
 		return
@@ -650,9 +2216,11 @@ func (cs *ChatServer) handleUndoMessage(user *User, msg *EnhancedMessage) {
 	}
 
 	room.BroadCastMessageChannel() <- &BroadcastPayload{
-		Type:    lib.MessageTypeUndo,
-		Message: userMessage,
+		Type:     lib.MessageTypeUndo,
+		Message:  userMessage,
+		Sequence: sequence,
 	}
+	cs.broadcastArrows(user, room, arrows, sequence)
 }
 
 // highlight-end
@@ -686,14 +2254,19 @@ func (cs *ChatServer) handleLeaveRoom(user *User, msg *EnhancedMessage) {
 
 	log.Printf("User %s attempting to leave room %s", user.ID, roomID)
 
+	user.stopReplay()
+
 	// Update user state
 	user.mu.Lock()
 	user.State = StateConnected
 	user.RoomID = nil
+	user.readOnly = false
+	user.shareLinkID = nil
 	user.mu.Unlock()
 
 	// Unregister user with room
 	room.UnregisterUser(user)
+	markRoomRead(user.ID, roomID)
 }
 
 func (cs *ChatServer) handleCursorMoveMessage(user *User, msg *EnhancedMessage) {
@@ -753,21 +2326,45 @@ func (cs *ChatServer) sendMessageToUser(user *User, message map[string]interface
 	}
 }
 
+// sendMessageToUserBlocking is like sendMessageToUser but waits up to writeWait
+// for room in the send channel instead of dropping the message.
+func (cs *ChatServer) sendMessageToUserBlocking(user *User, message map[string]interface{}) error {
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("marshaling message for user %s: %w", user.ID, err)
+	}
+	return cs.sendBytesToUserBlocking(user, msgBytes)
+}
+
+func (cs *ChatServer) sendBytesToUserBlocking(user *User, msgBytes []byte) error {
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case user.Send <- msgBytes:
+		return nil
+	case <-user.done:
+		return fmt.Errorf("user %s disconnected", user.ID)
+	case <-timer.C:
+		return fmt.Errorf("send channel for user %s stayed full", user.ID)
+	}
+}
+
 func (cs *ChatServer) writePump(user *User) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
+		user.disconnect()
 		user.Conn.Close()
 		log.Printf("WritePump closed for user %s", user.ID)
 	}()
 	for {
 		select {
-		case message, ok := <-user.Send:
+		case <-user.done:
+			user.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			user.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-user.Send:
 			user.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				user.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			if err := user.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				log.Printf("Error writing message to user %s: %v", user.ID, err)
 				return
@@ -795,6 +2392,215 @@ func (cs *ChatServer) GetRoom(roomID uuid.UUID) RoomInterface {
 	return room
 }
 
+// handleRoomEvent relays an event sent by the HTTP server to the users
+// connected to its room, if any.
+func (cs *ChatServer) handleRoomEvent(event lib.RoomEvent) {
+	cs.mu.RLock()
+	room, exists := cs.Rooms[event.RoomID]
+	cs.mu.RUnlock()
+	if !exists {
+		return
+	}
+	if event.Type == lib.MessageTypeRoomDelete {
+		cs.evictUsers(room, event, nil)
+		cs.mu.Lock()
+		if cs.Rooms[event.RoomID] == room {
+			delete(cs.Rooms, event.RoomID)
+		}
+		cs.mu.Unlock()
+		room.Stop()
+		return
+	}
+	if event.Type == lib.MessageTypeShapesImport {
+		cs.broadcastImport(room, event)
+		return
+	}
+	if event.Type == lib.MessageTypeShareRevoke {
+		// Only the users who joined with the link are told.
+		linkID, err := uuid.Parse(fmt.Sprint(event.Content["linkId"]))
+		if err != nil {
+			log.Printf("Invalid link in %s event for room %s: %v", event.Type, event.RoomID, err)
+			return
+		}
+		cs.evictUsers(room, event, func(user *User) bool {
+			user.mu.RLock()
+			defer user.mu.RUnlock()
+			return user.shareLinkID != nil && *user.shareLinkID == linkID
+		})
+		return
+	}
+
+	payload := &BroadcastPayload{
+		Type: event.Type,
+		Message: &UserMessage{
+			UserID:   event.UserID.String(),
+			UserName: event.UserName,
+			Message:  event.Content,
+		},
+		IncludeSender: true,
+	}
+	if event.Type == lib.MessageTypeMemberRemove {
+		// The removed member is taken out of the room and told on their
+		// own before everyone left in it is told through the room.
+		memberID, err := uuid.Parse(fmt.Sprint(event.Content["userId"]))
+		if err != nil {
+			log.Printf("Invalid member in %s event for room %s: %v", event.Type, event.RoomID, err)
+			return
+		}
+		cs.evictUsers(room, event, func(user *User) bool { return user.ID == memberID })
+		payload.Recipients = make(map[uuid.UUID]bool)
+		for _, user := range room.ConnectedUsers() {
+			if user.ID != memberID {
+				payload.Recipients[user.ID] = true
+			}
+		}
+	}
+	if event.AdminsOnly {
+		admins, err := lib.ChatRepositoryInstance.GetAdminRooms(event.RoomID)
+		if err != nil {
+			log.Printf("Failed to get admins of room %s for %s event: %v", event.RoomID, event.Type, err)
+			return
+		}
+		payload.Recipients = make(map[uuid.UUID]bool, len(admins))
+		for _, admin := range admins {
+			payload.Recipients[admin.ID] = true
+		}
+	}
+	room.BroadCastMessageChannel() <- payload
+}
+
+// broadcastImport sends the shapes a file import added to a room to everyone
+// in it, the importer included, as a batch message naming the file format.
+// The event only carries the room sequence of the import; the shapes are read
+// from its history.
+func (cs *ChatServer) broadcastImport(room RoomInterface, event lib.RoomEvent) {
+	roomID := room.GetRoomID()
+	value, ok := event.Content["sequence"].(float64)
+	if !ok {
+		log.Printf("Invalid sequence in %s event for room %s", event.Type, roomID)
+		return
+	}
+	sequence := int64(value)
+	events, err := lib.HistoryRepositoryInstance.GetSequenceEvents(roomID, sequence)
+	if err != nil {
+		log.Printf("Failed to load imported shapes of room %s: %v", roomID, err)
+		return
+	}
+	operations := make([]map[string]interface{}, 0, len(events))
+	for _, shapeEvent := range events {
+		operation := map[string]interface{}{"op": shapeEvent.Op, "shapeID": shapeEvent.ShapeID}
+		if shapeEvent.Op != lib.ShapeOpDelete {
+			operation["shape"] = shapeEvent.Shape
+		}
+		operations = append(operations, operation)
+	}
+	room.BroadCastMessageChannel() <- &BroadcastPayload{
+		Type: lib.MessageTypeBatch,
+		Message: &UserMessage{
+			UserID:   event.UserID.String(),
+			UserName: event.UserName,
+			Message: map[string]interface{}{
+				"operations": operations,
+				"import":     event.Content["format"],
+			},
+		},
+		Sequence:      sequence,
+		IncludeSender: true,
+	}
+}
+
+// maxEvictionPasses bounds how often evictUsers looks for users that
+// registered with a room while it was emptying it.
+const maxEvictionPasses = 3
+
+// evictUsers takes users out of a room right away, as if they had left, and
+// then sends them event: all of them, or only those match reports. Their
+// connections stay open to join other rooms.
+func (cs *ChatServer) evictUsers(room RoomInterface, event lib.RoomEvent, match func(*User) bool) {
+	roomID := room.GetRoomID()
+	notice := map[string]interface{}{
+		"Type": event.Type,
+		"sender": map[string]string{
+			"id":   event.UserID.String(),
+			"name": event.UserName,
+		},
+		"content":   event.Content,
+		"timestamp": time.Now().Unix(),
+	}
+	evicted := 0
+	for pass := 0; pass < maxEvictionPasses; pass++ {
+		var users []*User
+		for _, user := range room.ConnectedUsers() {
+			if match == nil || match(user) {
+				users = append(users, user)
+			}
+		}
+		if len(users) == 0 {
+			log.Printf("Evicted %d users from room %s after %s", evicted, roomID, event.Type)
+			return
+		}
+		for _, user := range users {
+			user.stopReplay()
+			user.mu.Lock()
+			if user.RoomID != nil && *user.RoomID == roomID {
+				user.State = StateConnected
+				user.RoomID = nil
+				user.readOnly = false
+				user.shareLinkID = nil
+			}
+			user.mu.Unlock()
+			if !room.RemoveUser(user) {
+				continue
+			}
+			evicted++
+			// The notice must not be dropped, but a slow user must not hold
+			// up the others either.
+			go func(user *User) {
+				if err := cs.sendMessageToUserBlocking(user, notice); err != nil {
+					log.Printf("Failed to tell user %s about %s: %v", user.ID, event.Type, err)
+				}
+			}(user)
+		}
+	}
+	log.Printf("Evicted %d users from room %s after %s, but users joining meanwhile remain", evicted, roomID, event.Type)
+}
+
+// handlePresence serves GET /presence, which maps the IDs of the caller's
+// rooms with users connected to who those users are. The http service uses it
+// for room listings.
+func (cs *ChatServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	userID, _, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	roomIDs, err := lib.ChatRepositoryInstance.GetUserRoomIDs(userID)
+	if err != nil {
+		log.Printf("Failed to get rooms of user %s for presence: %v", userID, err)
+		http.Error(w, "Could not get presence", http.StatusInternalServerError)
+		return
+	}
+
+	presence := make(map[uuid.UUID][]lib.OnlineUser)
+	cs.mu.RLock()
+	for _, roomID := range roomIDs {
+		if room, exists := cs.Rooms[roomID]; exists {
+			if users := room.OnlineUsers(); len(users) > 0 {
+				presence[roomID] = users
+			}
+		}
+	}
+	cs.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(presence); err != nil {
+		log.Printf("Failed to write presence for user %s: %v", userID, err)
+	}
+}
+
 func (cs *ChatServer) Cleanup() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -810,6 +2616,7 @@ func (cs *ChatServer) Cleanup() {
 		}
 
 		for _, id := range emptyRooms {
+			cs.Rooms[id].Stop()
 			delete(cs.Rooms, id)
 			log.Printf("Cleaned up empty room %s", id)
 		}
@@ -869,6 +2676,40 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512000 // Increased significantly for large canvas state
+
+	// A room snapshot is recompacted once this many shape operations pile up,
+	// or on the next snapshotInterval tick if any happened at all.
+	snapshotOpThreshold = 200
+	// A join that has to apply at least snapshotJoinThreshold shape events on
+	// top of the snapshot has it rebuilt in the background.
+	snapshotJoinThreshold = 50
+	snapshotInterval      = 2 * time.Minute
+
+	// Initial state frames stay well below maxMessageSize, and a joining
+	// user may buffer at most maxPendingBroadcasts live messages meanwhile.
+	initialStateChunkSize = 64 * 1024
+	maxPendingBroadcasts  = 1024
+
+	// Shapes are loaded and broadcast this far around a viewport, as a
+	// fraction of its larger side.
+	viewportMarginRatio = 0.5
+
+	// Limits on a single erase_at request.
+	maxErasePathPoints = 1000
+	maxEraseRadius     = 500
+
+	// Most shapes a single group or batch message may touch.
+	maxBatchOperations = 500
+
+	maxLayerNameLength = 50
+
+	// Replay speeds, as a multiple of real time, and the longest pause
+	// between two replayed changes whatever the speed.
+	minReplaySpeed = 0.1
+	maxReplaySpeed = 100
+	maxReplayPause = 2 * time.Second
+	// History events read at a time during a replay.
+	replayPageSize = 500
 )
 
 type EnhancedMessage struct {
@@ -876,23 +2717,36 @@ type EnhancedMessage struct {
 	Message map[string]interface{} `json:"Message"`
 }
 
+// authenticate reads the user from the token cookie of a request. If there is
+// none it writes the error response and reports false.
+func authenticate(w http.ResponseWriter, r *http.Request) (uuid.UUID, *CustomClaims, bool) {
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		http.Error(w, "Unauthorized: No Token Cookie", http.StatusUnauthorized)
+		return uuid.Nil, nil, false
+	}
+	claims, err := VerifyJWT(cookie.Value)
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid Token", http.StatusUnauthorized)
+		return uuid.Nil, nil, false
+	}
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		http.Error(w, "Invalid User ID in token", http.StatusBadRequest)
+		return uuid.Nil, nil, false
+	}
+	return userID, claims, true
+}
+
 func main() {
+	lib.InitDB()
 	fmt.Println("WebSocket Chat & Canvas Server Starting")
 	go chatServer.Cleanup()
+	go lib.ListenRoomEvents(context.Background(), chatServer.handleRoomEvent)
+	http.HandleFunc("/presence", chatServer.handlePresence)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			http.Error(w, "Unauthorized: No Token Cookie", http.StatusUnauthorized)
-			return
-		}
-		claims, err := VerifyJWT(cookie.Value)
-		if err != nil {
-			http.Error(w, "Unauthorized: Invalid Token", http.StatusUnauthorized)
-			return
-		}
-		userID, err := uuid.Parse(claims.UserID)
-		if err != nil {
-			http.Error(w, "Invalid User ID in token", http.StatusBadRequest)
+		userID, claims, ok := authenticate(w, r)
+		if !ok {
 			return
 		}
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -7,7 +7,7 @@ import { useSocket } from "../../../hooks/useSocket";
 
 // Server message structure
 interface ServerMessage {
-    Type: 'initial_state' | 'draw' | 'error' | 'undo' | 'pencil_chunk' | 'erase' | 'cursor_move' | 'user_left'; 
+    Type: 'initial_state_chunk' | 'initial_state_done' | 'draw' | 'error' | 'undo' | 'pencil_chunk' | 'erase' | 'erase_at' | 'cursor_move' | 'user_left'; 
     content?: any;
     sender?: { id: string; name: string };
 }
@@ -40,6 +40,7 @@ export default function Canvas() {
     // --- Refs and State ---
     const canvasRef = useRef<HTMLCanvasElement>(null);
     const handlerRef = useRef<CanvasHandler | null>(null);
+    const initialShapesRef = useRef<UserShape[]>([]);
     const [currentTool, setCurrentTool] = useState<ShapeType>(ShapeType.Rectangle);
     const [userToAdd, setUserToAdd] = useState('');
     const [user, setUser] = useState<User | null>(null);
@@ -55,11 +56,21 @@ export default function Canvas() {
             const data: ServerMessage = JSON.parse(event.data);
             
             switch (data.Type) {
-                case 'initial_state':
+                case 'initial_state_chunk':
+                    if (data.content?.chunkIndex === 0) {
+                        initialShapesRef.current = [];
+                    }
+                    if (data.content?.shapes) {
+                        initialShapesRef.current.push(...data.content.shapes);
+                    }
+                    break;
+
+                case 'initial_state_done':
                     console.log(`Initial data is:`, data);
-                    if (data.content?.shapes && data.content?.user?.userID) {
-                        handlerRef.current?.loadShapes(data.content.shapes, data.content.user.userID);
+                    if (data.content?.user?.userID) {
+                        handlerRef.current?.loadShapes(initialShapesRef.current, data.content.user.userID);
                     }
+                    initialShapesRef.current = [];
                     if (data.content?.user) {
                         setUser(data.content.user);
                     }
@@ -89,6 +100,12 @@ export default function Canvas() {
                     }
                     break;
                 
+                case 'erase_at':
+                    (data.content?.shapeIDs as string[] | undefined)?.forEach(shapeID => {
+                        handlerRef.current?.removeShapeById(shapeID);
+                    });
+                    break;
+                
                 case 'cursor_move':
                     if (data.sender && data.content) {
                         handlerRef.current?.updateRemoteCursor(data.sender.id, data.sender.name, data.content);
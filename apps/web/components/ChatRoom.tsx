@@ -3,9 +3,13 @@ import { ReceivedMessage } from "../app/room/[roomID]/page";
 
 type SavedMessages = {
   chats : ReceivedMessage[];
+  hasMore : boolean;
+  before? : number;
+  after? : number;
 }
-export async function getChats(roomID : string,limit : number = 50, offset : number = 0) : Promise<SavedMessages["chats"]> {
-    const response = axios.get(`/api/room/chats?roomID=${roomID}&limit=${limit}&offset=${offset}`)
+export async function getChats(roomID : string,limit : number = 50, before? : number) : Promise<SavedMessages["chats"]> {
+    const cursor = before ? `&before=${before}` : ""
+    const response = axios.get(`/api/room/chats?roomID=${roomID}&limit=${limit}${cursor}`)
     return (await response).data.chats
 }
 